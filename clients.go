@@ -1,18 +1,31 @@
 package main
 
 import (
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/codedeploy/codedeployiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 )
@@ -20,15 +33,35 @@ import (
 // Client sets up a client with configurable options
 type Client struct {
 	Region string
+
+	// MaxRetries and MaxThrottleDelay configure how AWS API calls are
+	// retried, which mostly matters when being throttled. The SDK defaults
+	// are used if they are not set
+	MaxRetries       int
+	MaxThrottleDelay time.Duration
+}
+
+// NewClient returns a client using the configured options
+func NewClient(cfg Config) Client {
+	return Client{
+		Region:           cfg.Options.Region,
+		MaxRetries:       cfg.Options.AWSMaxRetries,
+		MaxThrottleDelay: time.Duration(cfg.Options.AWSMaxThrottleDelay),
+	}
 }
 
 // Clients contains all AWS clients we're using
 type Clients struct {
 	CloudWatchLogs cloudwatchlogsiface.CloudWatchLogsAPI
+	CodeDeploy     codedeployiface.CodeDeployAPI
 	EC2            ec2iface.EC2API
 	ECR            ecriface.ECRAPI
 	ECS            ecsiface.ECSAPI
+	ELBV2          elbv2iface.ELBV2API
 	IAM            iamiface.IAMAPI
+	KMS            kmsiface.KMSAPI
+	SecretsManager secretsmanageriface.SecretsManagerAPI
+	SSM            ssmiface.SSMAPI
 	STS            stsiface.STSAPI
 }
 
@@ -41,10 +74,15 @@ func (c Client) InitClients() (clients Clients, err error) {
 
 	clients = Clients{
 		CloudWatchLogs: cloudwatchlogs.New(session),
+		CodeDeploy:     codedeploy.New(session),
 		EC2:            ec2.New(session),
 		ECR:            ecr.New(session),
 		ECS:            ecs.New(session),
+		ELBV2:          elbv2.New(session),
 		IAM:            iam.New(session),
+		KMS:            kms.New(session),
+		SecretsManager: secretsmanager.New(session),
+		SSM:            ssm.New(session),
 		STS:            sts.New(session),
 	}
 
@@ -56,6 +94,22 @@ func (c Client) session() (sess *session.Session, err error) {
 		Region: aws.String(c.Region),
 	}
 
+	if c.MaxRetries > 0 || c.MaxThrottleDelay > 0 {
+		retryer := client.DefaultRetryer{
+			NumMaxRetries: client.DefaultRetryerMaxNumRetries,
+		}
+
+		if c.MaxRetries > 0 {
+			retryer.NumMaxRetries = c.MaxRetries
+		}
+
+		if c.MaxThrottleDelay > 0 {
+			retryer.MaxThrottleDelay = c.MaxThrottleDelay
+		}
+
+		config.Retryer = retryer
+	}
+
 	sess, err = session.NewSession(&config)
 	if err != nil {
 		return sess, err
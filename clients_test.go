@@ -1,8 +1,29 @@
 package main
 
 import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/codedeploy/codedeployiface"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 )
 
 // This file contains all the interfaces we want to stub using the AWS
@@ -16,16 +37,506 @@ type mockedECSClient struct {
 	CreateClusterResp    ecs.CreateClusterOutput
 	DeleteClusterResp    ecs.DeleteClusterOutput
 	DescribeClustersResp ecs.DescribeClustersOutput
+	DescribeServicesResp ecs.DescribeServicesOutput
 }
 
 func (m mockedECSClient) CreateCluster(*ecs.CreateClusterInput) (*ecs.CreateClusterOutput, error) {
 	return &m.CreateClusterResp, nil
 }
 
+func (m mockedECSClient) CreateClusterWithContext(aws.Context, *ecs.CreateClusterInput, ...request.Option) (*ecs.CreateClusterOutput, error) {
+	return &m.CreateClusterResp, nil
+}
+
 func (m mockedECSClient) DeleteCluster(*ecs.DeleteClusterInput) (*ecs.DeleteClusterOutput, error) {
 	return &m.DeleteClusterResp, nil
 }
 
+func (m mockedECSClient) DeleteClusterWithContext(aws.Context, *ecs.DeleteClusterInput, ...request.Option) (*ecs.DeleteClusterOutput, error) {
+	return &m.DeleteClusterResp, nil
+}
+
+func (m mockedECSClient) DeleteServiceWithContext(aws.Context, *ecs.DeleteServiceInput, ...request.Option) (*ecs.DeleteServiceOutput, error) {
+	return &ecs.DeleteServiceOutput{}, nil
+}
+
+func (m mockedECSClient) DescribeServicesWithContext(aws.Context, *ecs.DescribeServicesInput, ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	return &m.DescribeServicesResp, nil
+}
+
 func (m mockedECSClient) DescribeClusters(*ecs.DescribeClustersInput) (*ecs.DescribeClustersOutput, error) {
 	return &m.DescribeClustersResp, nil
 }
+
+func (m mockedECSClient) DescribeClustersWithContext(aws.Context, *ecs.DescribeClustersInput, ...request.Option) (*ecs.DescribeClustersOutput, error) {
+	return &m.DescribeClustersResp, nil
+}
+
+// ECR
+type mockedECRClient struct {
+	ecriface.ECRAPI
+
+	BatchGetImageResp        ecr.BatchGetImageOutput
+	DescribeImagesResp       ecr.DescribeImagesOutput
+	DescribeImagesErr        error
+	DescribeRepositoriesResp ecr.DescribeRepositoriesOutput
+	GetLifecyclePolicyResp   ecr.GetLifecyclePolicyOutput
+	GetRepositoryPolicyErr   error
+	PutImageErr              error
+
+	// ScanFindings is called for each DescribeImageScanFindings request
+	ScanFindings func() (*ecr.DescribeImageScanFindingsOutput, error)
+
+	// PutImageInputs records each image that is put
+	PutImageInputs *[]*ecr.PutImageInput
+
+	// Calls records the name of each call that changes a repository
+	Calls *[]string
+}
+
+func (m mockedECRClient) call(name string) {
+	if m.Calls != nil {
+		*m.Calls = append(*m.Calls, name)
+	}
+}
+
+func (m mockedECRClient) BatchGetImageWithContext(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+	return &m.BatchGetImageResp, nil
+}
+
+func (m mockedECRClient) DescribeImagesWithContext(aws.Context, *ecr.DescribeImagesInput, ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	return &m.DescribeImagesResp, m.DescribeImagesErr
+}
+
+func (m mockedECRClient) PutImageWithContext(ctx aws.Context, input *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
+	if m.PutImageInputs != nil {
+		*m.PutImageInputs = append(*m.PutImageInputs, input)
+	}
+
+	return &ecr.PutImageOutput{}, m.PutImageErr
+}
+
+func (m mockedECRClient) DescribeRepositoriesWithContext(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+	return &m.DescribeRepositoriesResp, nil
+}
+
+func (m mockedECRClient) GetLifecyclePolicyWithContext(aws.Context, *ecr.GetLifecyclePolicyInput, ...request.Option) (*ecr.GetLifecyclePolicyOutput, error) {
+	return &m.GetLifecyclePolicyResp, nil
+}
+
+func (m mockedECRClient) GetRepositoryPolicyWithContext(aws.Context, *ecr.GetRepositoryPolicyInput, ...request.Option) (*ecr.GetRepositoryPolicyOutput, error) {
+	return &ecr.GetRepositoryPolicyOutput{}, m.GetRepositoryPolicyErr
+}
+
+func (m mockedECRClient) PutImageScanningConfigurationWithContext(aws.Context, *ecr.PutImageScanningConfigurationInput, ...request.Option) (*ecr.PutImageScanningConfigurationOutput, error) {
+	m.call("PutImageScanningConfiguration")
+	return &ecr.PutImageScanningConfigurationOutput{}, nil
+}
+
+func (m mockedECRClient) PutImageTagMutabilityWithContext(aws.Context, *ecr.PutImageTagMutabilityInput, ...request.Option) (*ecr.PutImageTagMutabilityOutput, error) {
+	m.call("PutImageTagMutability")
+	return &ecr.PutImageTagMutabilityOutput{}, nil
+}
+
+func (m mockedECRClient) PutLifecyclePolicyWithContext(aws.Context, *ecr.PutLifecyclePolicyInput, ...request.Option) (*ecr.PutLifecyclePolicyOutput, error) {
+	m.call("PutLifecyclePolicy")
+	return &ecr.PutLifecyclePolicyOutput{}, nil
+}
+
+func (m mockedECRClient) SetRepositoryPolicyWithContext(aws.Context, *ecr.SetRepositoryPolicyInput, ...request.Option) (*ecr.SetRepositoryPolicyOutput, error) {
+	m.call("SetRepositoryPolicy")
+	return &ecr.SetRepositoryPolicyOutput{}, nil
+}
+
+func (m mockedECRClient) TagResourceWithContext(aws.Context, *ecr.TagResourceInput, ...request.Option) (*ecr.TagResourceOutput, error) {
+	m.call("TagResource")
+	return &ecr.TagResourceOutput{}, nil
+}
+
+func (m mockedECRClient) DescribeImageScanFindingsWithContext(aws.Context, *ecr.DescribeImageScanFindingsInput, ...request.Option) (*ecr.DescribeImageScanFindingsOutput, error) {
+	return m.ScanFindings()
+}
+
+func (m mockedECRClient) StartImageScanWithContext(aws.Context, *ecr.StartImageScanInput, ...request.Option) (*ecr.StartImageScanOutput, error) {
+	m.call("StartImageScan")
+	return &ecr.StartImageScanOutput{}, nil
+}
+
+// CloudWatch Logs
+type mockedCloudWatchLogsClient struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+
+	DescribeLogGroupsResp cloudwatchlogs.DescribeLogGroupsOutput
+	ListTagsLogGroupResp  cloudwatchlogs.ListTagsLogGroupOutput
+
+	// Calls records the name of each call that changes a log group
+	Calls *[]string
+}
+
+func (m mockedCloudWatchLogsClient) call(name string) {
+	if m.Calls != nil {
+		*m.Calls = append(*m.Calls, name)
+	}
+}
+
+func (m mockedCloudWatchLogsClient) DescribeLogGroupsWithContext(aws.Context, *cloudwatchlogs.DescribeLogGroupsInput, ...request.Option) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	return &m.DescribeLogGroupsResp, nil
+}
+
+func (m mockedCloudWatchLogsClient) ListTagsLogGroupWithContext(aws.Context, *cloudwatchlogs.ListTagsLogGroupInput, ...request.Option) (*cloudwatchlogs.ListTagsLogGroupOutput, error) {
+	return &m.ListTagsLogGroupResp, nil
+}
+
+func (m mockedCloudWatchLogsClient) CreateLogGroupWithContext(aws.Context, *cloudwatchlogs.CreateLogGroupInput, ...request.Option) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	m.call("CreateLogGroup")
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+func (m mockedCloudWatchLogsClient) PutRetentionPolicyWithContext(aws.Context, *cloudwatchlogs.PutRetentionPolicyInput, ...request.Option) (*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	m.call("PutRetentionPolicy")
+	return &cloudwatchlogs.PutRetentionPolicyOutput{}, nil
+}
+
+func (m mockedCloudWatchLogsClient) AssociateKmsKeyWithContext(aws.Context, *cloudwatchlogs.AssociateKmsKeyInput, ...request.Option) (*cloudwatchlogs.AssociateKmsKeyOutput, error) {
+	m.call("AssociateKmsKey")
+	return &cloudwatchlogs.AssociateKmsKeyOutput{}, nil
+}
+
+func (m mockedCloudWatchLogsClient) TagLogGroupWithContext(aws.Context, *cloudwatchlogs.TagLogGroupInput, ...request.Option) (*cloudwatchlogs.TagLogGroupOutput, error) {
+	m.call("TagLogGroup")
+	return &cloudwatchlogs.TagLogGroupOutput{}, nil
+}
+
+// IAM
+type mockedIAMClient struct {
+	iamiface.IAMAPI
+
+	// Role is returned by GetRole, which fails if it is nil
+	Role                   *iam.Role
+	AttachedPolicies       []string
+	InlinePolicies         []string
+	GetRolePolicyResp      iam.GetRolePolicyOutput
+	GetRolePolicyErr       error
+	PutRolePolicyDocuments *[]string
+
+	// Calls records the name of each call that changes a role
+	Calls *[]string
+}
+
+func (m mockedIAMClient) call(name string) {
+	if m.Calls != nil {
+		*m.Calls = append(*m.Calls, name)
+	}
+}
+
+func (m mockedIAMClient) GetRoleWithContext(aws.Context, *iam.GetRoleInput, ...request.Option) (*iam.GetRoleOutput, error) {
+	if m.Role == nil {
+		return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "not found", nil)
+	}
+
+	return &iam.GetRoleOutput{Role: m.Role}, nil
+}
+
+func (m mockedIAMClient) CreateRoleWithContext(ctx aws.Context, input *iam.CreateRoleInput, opts ...request.Option) (*iam.CreateRoleOutput, error) {
+	m.call("CreateRole")
+	return &iam.CreateRoleOutput{Role: &iam.Role{
+		Arn:      aws.String("arn:aws:iam::123456789012:role/" + aws.StringValue(input.RoleName)),
+		RoleName: input.RoleName,
+	}}, nil
+}
+
+func (m mockedIAMClient) DeleteRoleWithContext(aws.Context, *iam.DeleteRoleInput, ...request.Option) (*iam.DeleteRoleOutput, error) {
+	m.call("DeleteRole")
+	return &iam.DeleteRoleOutput{}, nil
+}
+
+func (m mockedIAMClient) ListAttachedRolePoliciesPagesWithContext(ctx aws.Context, input *iam.ListAttachedRolePoliciesInput, fn func(*iam.ListAttachedRolePoliciesOutput, bool) bool, opts ...request.Option) error {
+	var output iam.ListAttachedRolePoliciesOutput
+	for _, policy := range m.AttachedPolicies {
+		output.AttachedPolicies = append(output.AttachedPolicies, &iam.AttachedPolicy{PolicyArn: aws.String(policy)})
+	}
+
+	fn(&output, true)
+	return nil
+}
+
+func (m mockedIAMClient) ListRolePoliciesPagesWithContext(ctx aws.Context, input *iam.ListRolePoliciesInput, fn func(*iam.ListRolePoliciesOutput, bool) bool, opts ...request.Option) error {
+	fn(&iam.ListRolePoliciesOutput{PolicyNames: aws.StringSlice(m.InlinePolicies)}, true)
+	return nil
+}
+
+func (m mockedIAMClient) AttachRolePolicyWithContext(aws.Context, *iam.AttachRolePolicyInput, ...request.Option) (*iam.AttachRolePolicyOutput, error) {
+	m.call("AttachRolePolicy")
+	return &iam.AttachRolePolicyOutput{}, nil
+}
+
+func (m mockedIAMClient) DetachRolePolicyWithContext(aws.Context, *iam.DetachRolePolicyInput, ...request.Option) (*iam.DetachRolePolicyOutput, error) {
+	m.call("DetachRolePolicy")
+	return &iam.DetachRolePolicyOutput{}, nil
+}
+
+func (m mockedIAMClient) GetRolePolicyWithContext(aws.Context, *iam.GetRolePolicyInput, ...request.Option) (*iam.GetRolePolicyOutput, error) {
+	return &m.GetRolePolicyResp, m.GetRolePolicyErr
+}
+
+func (m mockedIAMClient) PutRolePolicyWithContext(ctx aws.Context, input *iam.PutRolePolicyInput, opts ...request.Option) (*iam.PutRolePolicyOutput, error) {
+	m.call("PutRolePolicy")
+	if m.PutRolePolicyDocuments != nil {
+		*m.PutRolePolicyDocuments = append(*m.PutRolePolicyDocuments, aws.StringValue(input.PolicyDocument))
+	}
+
+	return &iam.PutRolePolicyOutput{}, nil
+}
+
+func (m mockedIAMClient) DeleteRolePolicyWithContext(aws.Context, *iam.DeleteRolePolicyInput, ...request.Option) (*iam.DeleteRolePolicyOutput, error) {
+	m.call("DeleteRolePolicy")
+	return &iam.DeleteRolePolicyOutput{}, nil
+}
+
+func (m mockedIAMClient) PutRolePermissionsBoundaryWithContext(aws.Context, *iam.PutRolePermissionsBoundaryInput, ...request.Option) (*iam.PutRolePermissionsBoundaryOutput, error) {
+	m.call("PutRolePermissionsBoundary")
+	return &iam.PutRolePermissionsBoundaryOutput{}, nil
+}
+
+func (m mockedIAMClient) TagRoleWithContext(aws.Context, *iam.TagRoleInput, ...request.Option) (*iam.TagRoleOutput, error) {
+	m.call("TagRole")
+	return &iam.TagRoleOutput{}, nil
+}
+
+// KMS
+type mockedKMSClient struct {
+	kmsiface.KMSAPI
+
+	// Key is the plaintext data key, which is "encrypted" by reversing it
+	Key []byte
+}
+
+func reverseBytes(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+
+	return reversed
+}
+
+func (m mockedKMSClient) GenerateDataKeyWithContext(aws.Context, *kms.GenerateDataKeyInput, ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+	return &kms.GenerateDataKeyOutput{CiphertextBlob: reverseBytes(m.Key), Plaintext: m.Key}, nil
+}
+
+func (m mockedKMSClient) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	return &kms.DecryptOutput{Plaintext: reverseBytes(input.CiphertextBlob)}, nil
+}
+
+// CodeDeploy
+type mockedCodeDeployClient struct {
+	codedeployiface.CodeDeployAPI
+
+	ApplicationExists     bool
+	DeploymentGroupExists bool
+
+	// Statuses are returned in turn by GetDeployment
+	Statuses *[]string
+
+	// AppSpecs records the AppSpec of each deployment
+	AppSpecs *[]string
+
+	// LifecycleEvents are returned by GetDeploymentTarget
+	LifecycleEvents []*codedeploy.LifecycleEvent
+
+	// Calls records the name of each call that changes something
+	Calls *[]string
+}
+
+func (m mockedCodeDeployClient) call(name string) {
+	if m.Calls != nil {
+		*m.Calls = append(*m.Calls, name)
+	}
+}
+
+func (m mockedCodeDeployClient) GetApplicationWithContext(aws.Context, *codedeploy.GetApplicationInput, ...request.Option) (*codedeploy.GetApplicationOutput, error) {
+	if !m.ApplicationExists {
+		return nil, awserr.New(codedeploy.ErrCodeApplicationDoesNotExistException, "not found", nil)
+	}
+
+	return &codedeploy.GetApplicationOutput{}, nil
+}
+
+func (m mockedCodeDeployClient) CreateApplicationWithContext(aws.Context, *codedeploy.CreateApplicationInput, ...request.Option) (*codedeploy.CreateApplicationOutput, error) {
+	m.call("CreateApplication")
+	return &codedeploy.CreateApplicationOutput{}, nil
+}
+
+func (m mockedCodeDeployClient) CreateDeploymentConfigWithContext(ctx aws.Context, input *codedeploy.CreateDeploymentConfigInput, opts ...request.Option) (*codedeploy.CreateDeploymentConfigOutput, error) {
+	m.call("CreateDeploymentConfig")
+	return &codedeploy.CreateDeploymentConfigOutput{}, nil
+}
+
+func (m mockedCodeDeployClient) GetDeploymentGroupWithContext(aws.Context, *codedeploy.GetDeploymentGroupInput, ...request.Option) (*codedeploy.GetDeploymentGroupOutput, error) {
+	if !m.DeploymentGroupExists {
+		return nil, awserr.New(codedeploy.ErrCodeDeploymentGroupDoesNotExistException, "not found", nil)
+	}
+
+	return &codedeploy.GetDeploymentGroupOutput{}, nil
+}
+
+func (m mockedCodeDeployClient) CreateDeploymentGroupWithContext(aws.Context, *codedeploy.CreateDeploymentGroupInput, ...request.Option) (*codedeploy.CreateDeploymentGroupOutput, error) {
+	m.call("CreateDeploymentGroup")
+	return &codedeploy.CreateDeploymentGroupOutput{}, nil
+}
+
+func (m mockedCodeDeployClient) UpdateDeploymentGroupWithContext(aws.Context, *codedeploy.UpdateDeploymentGroupInput, ...request.Option) (*codedeploy.UpdateDeploymentGroupOutput, error) {
+	m.call("UpdateDeploymentGroup")
+	return &codedeploy.UpdateDeploymentGroupOutput{}, nil
+}
+
+func (m mockedCodeDeployClient) DeleteDeploymentGroupWithContext(aws.Context, *codedeploy.DeleteDeploymentGroupInput, ...request.Option) (*codedeploy.DeleteDeploymentGroupOutput, error) {
+	m.call("DeleteDeploymentGroup")
+	return &codedeploy.DeleteDeploymentGroupOutput{}, nil
+}
+
+func (m mockedCodeDeployClient) ListDeploymentGroupsWithContext(ctx aws.Context, input *codedeploy.ListDeploymentGroupsInput, opts ...request.Option) (*codedeploy.ListDeploymentGroupsOutput, error) {
+	if !m.ApplicationExists {
+		return nil, awserr.New(codedeploy.ErrCodeApplicationDoesNotExistException, "not found", nil)
+	}
+
+	var groups []*string
+	if m.DeploymentGroupExists {
+		groups = aws.StringSlice([]string{"flecs-shop-web"})
+	}
+
+	return &codedeploy.ListDeploymentGroupsOutput{ApplicationName: input.ApplicationName, DeploymentGroups: groups}, nil
+}
+
+func (m mockedCodeDeployClient) DeleteApplicationWithContext(aws.Context, *codedeploy.DeleteApplicationInput, ...request.Option) (*codedeploy.DeleteApplicationOutput, error) {
+	m.call("DeleteApplication")
+	return &codedeploy.DeleteApplicationOutput{}, nil
+}
+
+func (m mockedCodeDeployClient) CreateDeploymentWithContext(ctx aws.Context, input *codedeploy.CreateDeploymentInput, opts ...request.Option) (*codedeploy.CreateDeploymentOutput, error) {
+	m.call("CreateDeployment")
+	if m.AppSpecs != nil {
+		*m.AppSpecs = append(*m.AppSpecs, aws.StringValue(input.Revision.AppSpecContent.Content))
+	}
+
+	return &codedeploy.CreateDeploymentOutput{DeploymentId: aws.String("d-123")}, nil
+}
+
+func (m mockedCodeDeployClient) GetDeploymentWithContext(ctx aws.Context, input *codedeploy.GetDeploymentInput, opts ...request.Option) (*codedeploy.GetDeploymentOutput, error) {
+	status := (*m.Statuses)[0]
+	if len(*m.Statuses) > 1 {
+		*m.Statuses = (*m.Statuses)[1:]
+	}
+
+	return &codedeploy.GetDeploymentOutput{DeploymentInfo: &codedeploy.DeploymentInfo{
+		DeploymentId: input.DeploymentId,
+		Status:       aws.String(status),
+	}}, nil
+}
+
+func (m mockedCodeDeployClient) GetDeploymentTargetWithContext(aws.Context, *codedeploy.GetDeploymentTargetInput, ...request.Option) (*codedeploy.GetDeploymentTargetOutput, error) {
+	events := m.LifecycleEvents
+	if events == nil {
+		events = []*codedeploy.LifecycleEvent{
+			{LifecycleEventName: aws.String("Install"), Status: aws.String("Succeeded")},
+		}
+	}
+
+	return &codedeploy.GetDeploymentTargetOutput{DeploymentTarget: &codedeploy.DeploymentTarget{
+		EcsTarget: &codedeploy.ECSTarget{
+			LifecycleEvents: events,
+			TaskSetsInfo: []*codedeploy.ECSTaskSet{
+				{TaskSetLabel: aws.String("Blue"), TrafficWeight: aws.Float64(100), RunningCount: aws.Int64(1), DesiredCount: aws.Int64(1)},
+				{TaskSetLabel: aws.String("Green"), TrafficWeight: aws.Float64(0), RunningCount: aws.Int64(1), DesiredCount: aws.Int64(1)},
+			},
+		},
+	}}, nil
+}
+
+func (m mockedCodeDeployClient) ContinueDeploymentWithContext(aws.Context, *codedeploy.ContinueDeploymentInput, ...request.Option) (*codedeploy.ContinueDeploymentOutput, error) {
+	m.call("ContinueDeployment")
+	return &codedeploy.ContinueDeploymentOutput{}, nil
+}
+
+func (m mockedCodeDeployClient) StopDeploymentWithContext(aws.Context, *codedeploy.StopDeploymentInput, ...request.Option) (*codedeploy.StopDeploymentOutput, error) {
+	m.call("StopDeployment")
+	return &codedeploy.StopDeploymentOutput{}, nil
+}
+
+// ELBV2
+type mockedELBV2Client struct {
+	elbv2iface.ELBV2API
+
+	// TargetGroups are the ARNs of target groups by name
+	TargetGroups map[string]string
+}
+
+func (m mockedELBV2Client) DescribeTargetGroupsPagesWithContext(ctx aws.Context, input *elbv2.DescribeTargetGroupsInput, fn func(*elbv2.DescribeTargetGroupsOutput, bool) bool, opts ...request.Option) error {
+	var output elbv2.DescribeTargetGroupsOutput
+	for _, name := range aws.StringValueSlice(input.Names) {
+		arn, ok := m.TargetGroups[name]
+		if !ok {
+			return awserr.New(elbv2.ErrCodeTargetGroupNotFoundException, "One or more target groups not found", nil)
+		}
+
+		output.TargetGroups = append(output.TargetGroups, &elbv2.TargetGroup{
+			TargetGroupArn:  aws.String(arn),
+			TargetGroupName: aws.String(name),
+		})
+	}
+
+	fn(&output, true)
+	return nil
+}
+
+// Secrets Manager
+type mockedSecretsManagerClient struct {
+	secretsmanageriface.SecretsManagerAPI
+
+	// Secrets are the values of secrets by ID
+	Secrets map[string]string
+
+	// ARNs are the full ARNs of secrets by name
+	ARNs map[string]string
+}
+
+func (m mockedSecretsManagerClient) DescribeSecretWithContext(ctx aws.Context, input *secretsmanager.DescribeSecretInput, opts ...request.Option) (*secretsmanager.DescribeSecretOutput, error) {
+	arn, ok := m.ARNs[aws.StringValue(input.SecretId)]
+	if !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "Secrets Manager can't find the specified secret.", nil)
+	}
+
+	return &secretsmanager.DescribeSecretOutput{ARN: aws.String(arn)}, nil
+}
+
+func (m mockedSecretsManagerClient) GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	value, ok := m.Secrets[aws.StringValue(input.SecretId)]
+	if !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "Secrets Manager can't find the specified secret.", nil)
+	}
+
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+// SSM
+type mockedSSMClient struct {
+	ssmiface.SSMAPI
+
+	// Parameters are the values of parameters by name
+	Parameters map[string]string
+}
+
+func (m mockedSSMClient) GetParametersByPathPagesWithContext(ctx aws.Context, input *ssm.GetParametersByPathInput, fn func(*ssm.GetParametersByPathOutput, bool) bool, opts ...request.Option) error {
+	var output ssm.GetParametersByPathOutput
+	for _, name := range sortedKeys(m.Parameters) {
+		rest := strings.TrimPrefix(name, aws.StringValue(input.Path))
+		if rest == name || (strings.Contains(rest, "/") && !aws.BoolValue(input.Recursive)) {
+			continue
+		}
+
+		output.Parameters = append(output.Parameters, &ssm.Parameter{Name: aws.String(name), Value: aws.String(m.Parameters[name])})
+	}
+
+	fn(&output, true)
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -9,11 +10,11 @@ import (
 )
 
 // ClusterExists returns true if the cluster exists
-func (c Clients) ClusterExists(cfg Config) (result bool, err error) {
+func (c Clients) ClusterExists(ctx context.Context, cfg Config) (result bool, err error) {
 	describeClusterInput := ecs.DescribeClustersInput{
 		Clusters: aws.StringSlice([]string{cfg.Options.ClusterName}),
 	}
-	describeCluster, err := c.ECS.DescribeClusters(&describeClusterInput)
+	describeCluster, err := c.ECS.DescribeClustersWithContext(ctx, &describeClusterInput)
 	if err != nil {
 		return result, err
 	}
@@ -27,55 +28,37 @@ func (c Clients) ClusterExists(cfg Config) (result bool, err error) {
 	return result, err
 }
 
-// CreateCluster creates a new cluster
-func (c Clients) CreateCluster(cfg Config, timeout time.Duration) (err error) {
+// CreateCluster creates a new cluster, and waits for it to become active
+func (c Clients) CreateCluster(ctx context.Context, cfg Config, wait WaitOptions) (err error) {
+	wait = wait.merge(clusterWait)
+
 	createClusterInput := ecs.CreateClusterInput{
 		ClusterName: aws.String(cfg.Options.ClusterName),
 	}
-	_, err = c.ECS.CreateCluster(&createClusterInput)
+	_, err = c.ECS.CreateClusterWithContext(ctx, &createClusterInput)
 	if err != nil {
 		return err
 	}
 
-	clusterCreated := false
-	for count := 0; count < 30; count++ {
-		time.Sleep(timeout * time.Second)
-
-		describeClusterInput := ecs.DescribeClustersInput{
-			Clusters: aws.StringSlice([]string{cfg.Options.ClusterName}),
-		}
-		describeCluster, err := c.ECS.DescribeClusters(&describeClusterInput)
-		if err != nil {
-			return err
-		}
-
-		if len(describeCluster.Clusters) < 1 {
-			continue
-		}
-
-		cluster := describeCluster.Clusters[0]
-		if aws.StringValue(cluster.Status) == "ACTIVE" {
-			clusterCreated = true
-			break
-		}
-	}
-
-	if !clusterCreated {
-		return fmt.Errorf("failed to create cluster")
+	err = wait.poll(ctx, func() (bool, error) {
+		return c.ClusterExists(ctx, cfg)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create cluster: %s", err)
 	}
 
-	// Wait 5 seconds for luck
-	time.Sleep(timeout * time.Second)
+	// Wait a little longer for luck
+	err = aws.SleepWithContext(ctx, time.Duration(wait.PollInterval))
 
 	return err
 }
 
 // DeleteCluster deletes a cluster
-func (c Clients) DeleteCluster(cfg Config) (err error) {
+func (c Clients) DeleteCluster(ctx context.Context, cfg Config) (err error) {
 	deleteClusterInput := ecs.DeleteClusterInput{
 		Cluster: aws.String(cfg.Options.ClusterName),
 	}
-	_, err = c.ECS.DeleteCluster(&deleteClusterInput)
+	_, err = c.ECS.DeleteClusterWithContext(ctx, &deleteClusterInput)
 	if err != nil {
 		return err
 	}
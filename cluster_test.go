@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecs"
@@ -26,7 +28,7 @@ func TestClusterExists(t *testing.T) {
 		ECS: mockedECSClient{},
 	}
 
-	resp, err = clients.ClusterExists(Config{})
+	resp, err = clients.ClusterExists(context.Background(), Config{})
 	assert.Nil(t, err)
 
 	assert.Equal(t, false, resp, "Cluster does not exist")
@@ -44,7 +46,7 @@ func TestClusterExists(t *testing.T) {
 		},
 	}
 
-	resp, err = clients.ClusterExists(config)
+	resp, err = clients.ClusterExists(context.Background(), config)
 	assert.Nil(t, err)
 
 	t.Log(resp)
@@ -67,7 +69,7 @@ func TestCreateCluster(t *testing.T) {
 		},
 	}
 
-	err = clients.CreateCluster(config, 0)
+	err = clients.CreateCluster(context.Background(), config, WaitOptions{PollInterval: Duration(time.Millisecond)})
 	assert.Nil(t, err)
 }
 
@@ -86,6 +88,32 @@ func TestDeleteCluster(t *testing.T) {
 		},
 	}
 
-	err = clients.DeleteCluster(config)
+	err = clients.DeleteCluster(context.Background(), config)
 	assert.Nil(t, err)
 }
+
+func TestCreateClusterCancelled(t *testing.T) {
+	clients = Clients{
+		ECS: mockedECSClient{},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = clients.CreateCluster(ctx, config, WaitOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestCreateClusterTimeout(t *testing.T) {
+	clients = Clients{
+		ECS: mockedECSClient{},
+	}
+
+	wait := WaitOptions{
+		Timeout:      Duration(3 * time.Millisecond),
+		PollInterval: Duration(time.Millisecond),
+	}
+
+	err = clients.CreateCluster(context.Background(), config, wait)
+	assert.NotNil(t, err)
+}
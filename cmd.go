@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
 	homedir "github.com/mitchellh/go-homedir"
@@ -33,7 +36,30 @@ func init() {
 	deploy.PersistentFlags().Bool("recreate-services", false, "Force a recreation of all services")
 	CheckError(viper.BindPFlag("deploy.recreate_services", deploy.PersistentFlags().Lookup("recreate-services")))
 
-	cmd.AddCommand(deploy, rm)
+	deploy.PersistentFlags().String("from-step", "", "Start the pipeline from a step, given by name or number")
+	CheckError(viper.BindPFlag("deploy.from_step", deploy.PersistentFlags().Lookup("from-step")))
+
+	deploy.PersistentFlags().StringSlice("only", []string{}, "Only run the given steps, by name or number")
+	CheckError(viper.BindPFlag("deploy.only", deploy.PersistentFlags().Lookup("only")))
+
+	deploy.PersistentFlags().StringSlice("skip", []string{}, "Skip the given steps, by name or number")
+	CheckError(viper.BindPFlag("deploy.skip", deploy.PersistentFlags().Lookup("skip")))
+
+	deploy.PersistentFlags().Bool("resume", false, "Resume the pipeline from the first step that has not completed for the same tag")
+	CheckError(viper.BindPFlag("deploy.resume", deploy.PersistentFlags().Lookup("resume")))
+
+	deploy.PersistentFlags().String("state-file", defaultStateFile, "Path to the file that records pipeline progress")
+	CheckError(viper.BindPFlag("deploy.state_file", deploy.PersistentFlags().Lookup("state-file")))
+
+	deploy.PersistentFlags().String("changed-since", "", "Revision that changed() compares against, instead of the last deployed tag")
+	CheckError(viper.BindPFlag("deploy.changed_since", deploy.PersistentFlags().Lookup("changed-since")))
+	CheckError(viper.BindEnv("deploy.changed_since", "FLECS_CHANGED_SINCE"))
+
+	secretsSync.Flags().Bool("prune", false, "Delete secrets that are not in the secrets file")
+	CheckError(viper.BindPFlag("secrets.prune", secretsSync.Flags().Lookup("prune")))
+
+	secrets.AddCommand(secretsSet, secretsGet, secretsList, secretsDiff, secretsSync)
+	cmd.AddCommand(deploy, rm, secrets)
 }
 
 func initConfig() {
@@ -68,6 +94,9 @@ var deploy = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		Log.Info("START")
 
+		ctx, cancel := SignalContext()
+		defer cancel()
+
 		file, err := ioutil.ReadFile(flecsFile)
 		CheckError(err)
 
@@ -89,7 +118,30 @@ var deploy = &cobra.Command{
 		)
 		CheckError(err)
 
-		err = config.Deploy()
+		config.StateFile = viper.GetString("deploy.state_file")
+		config.ChangedSince = viper.GetString("deploy.changed_since")
+
+		// Filter the pipeline
+		from := viper.GetString("deploy.from_step")
+		if viper.GetBool("deploy.resume") {
+			if from != "" {
+				Log.Fatal("Cannot use --from-step with --resume")
+			}
+
+			from, err = config.ResumeFrom()
+			CheckError(err)
+			Log.Infof("Resuming from step %s", from)
+		}
+
+		config.Options.Pipeline, err = FilterPipeline(
+			config.Options.Pipeline,
+			from,
+			viper.GetStringSlice("deploy.only"),
+			viper.GetStringSlice("deploy.skip"),
+		)
+		CheckError(err)
+
+		err = config.Deploy(ctx)
 		CheckError(err)
 
 		Log.Info("END")
@@ -102,6 +154,9 @@ var rm = &cobra.Command{
 	Short: "Run through the configured pipeline",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := SignalContext()
+		defer cancel()
+
 		file, err := ioutil.ReadFile(flecsFile)
 		CheckError(err)
 
@@ -129,14 +184,21 @@ var rm = &cobra.Command{
 				Log.Fatal("Must specify service name")
 			}
 
-			err = config.Remove("service", args[1])
+			err = config.Remove(ctx, "service", args[1])
 			CheckError(err)
 		case "cluster":
 			if len(args) > 1 {
 				Log.Fatal("Deleting cluster does not take any arguments. Use --environment to choose different clusters.")
 			}
 
-			err = config.Remove("cluster", "")
+			err = config.Remove(ctx, "cluster", "")
+			CheckError(err)
+		case "role":
+			if len(args) < 2 {
+				Log.Fatal("Must specify definition name")
+			}
+
+			err = config.Remove(ctx, "role", args[1])
 			CheckError(err)
 		default:
 			Log.Fatalf("Unrecognised resource %s", args[0])
@@ -144,6 +206,148 @@ var rm = &cobra.Command{
 	},
 }
 
+// secrets manages the secrets that tasks read from SSM or Secrets Manager
+var secrets = &cobra.Command{
+	Use:   "secrets",
+	Short: "Manage secrets in an encrypted file, and sync them to AWS",
+}
+
+var secretsSet = &cobra.Command{
+	Use:   "set [name] [value]",
+	Short: "Set a secret in the secrets file, reading the value from stdin if not given",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := SignalContext()
+		defer cancel()
+
+		config, _, file := unlockSecretsFile(ctx)
+
+		var value string
+		if len(args) > 1 {
+			value = args[1]
+		} else {
+			data, err := ioutil.ReadAll(os.Stdin)
+			CheckError(err)
+			value = strings.TrimSuffix(string(data), "\n")
+		}
+
+		CheckError(file.Set(args[0], value))
+		CheckError(file.Save())
+
+		Log.Infof("Set %s in %s. Run flecs secrets sync to push it to %s", args[0], config.secretsFile(), config.secretsPrefix())
+	},
+}
+
+var secretsGet = &cobra.Command{
+	Use:   "get [name]",
+	Short: "Print a secret from the secrets file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := SignalContext()
+		defer cancel()
+
+		_, _, file := unlockSecretsFile(ctx)
+
+		value, err := file.Get(args[0])
+		CheckError(err)
+
+		fmt.Println(value)
+	},
+}
+
+var secretsList = &cobra.Command{
+	Use:   "list",
+	Short: "List the names of the secrets in the secrets file",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := loadCommandConfig()
+
+		file, err := loadSecretsFile(config.secretsFile())
+		CheckError(err)
+
+		for _, name := range sortedKeys(file.Secrets) {
+			fmt.Println(name)
+		}
+	},
+}
+
+var secretsDiff = &cobra.Command{
+	Use:   "diff",
+	Short: "Show which secrets differ between the secrets file and AWS",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := SignalContext()
+		defer cancel()
+
+		config, clients, file := unlockSecretsFile(ctx)
+
+		local, err := file.Values()
+		CheckError(err)
+
+		remote, err := newSecretStore(clients, config).List(ctx)
+		CheckError(err)
+
+		for _, change := range diffSecrets(local, remote) {
+			fmt.Printf("%s\t%s%s\n", change.Action, config.secretsPrefix(), change.Name)
+		}
+	},
+}
+
+var secretsSync = &cobra.Command{
+	Use:   "sync",
+	Short: "Push secrets that were added or changed in the secrets file to AWS",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := SignalContext()
+		defer cancel()
+
+		config, clients, file := unlockSecretsFile(ctx)
+
+		local, err := file.Values()
+		CheckError(err)
+
+		changes, err := syncSecrets(ctx, newSecretStore(clients, config), local, viper.GetBool("secrets.prune"))
+		CheckError(err)
+
+		for _, change := range changes {
+			Log.Infof("Secret %s%s: %s", config.secretsPrefix(), change.Name, change.Action)
+		}
+
+		Log.Infof("%d secrets changed", len(changes))
+	},
+}
+
+// loadCommandConfig loads the configuration for commands that don't run the
+// pipeline
+func loadCommandConfig() Config {
+	file, err := ioutil.ReadFile(flecsFile)
+	CheckError(err)
+
+	tag, err := getTag()
+	CheckError(err)
+
+	project, err := getProject()
+	CheckError(err)
+
+	config, err := LoadConfig(string(file), viper.GetString("environment"), tag, project, false)
+	CheckError(err)
+
+	return config
+}
+
+// unlockSecretsFile loads the configuration and the secrets file, and
+// decrypts the file's data key
+func unlockSecretsFile(ctx context.Context) (config Config, clients Clients, file SecretsFile) {
+	config = loadCommandConfig()
+
+	clients, err := NewClient(config).InitClients()
+	CheckError(err)
+
+	file, err = loadSecretsFile(config.secretsFile())
+	CheckError(err)
+
+	CheckError(file.unlock(ctx, clients, config.Options.SecretsKMSKeyID))
+
+	return config, clients, file
+}
+
 func getTag() (tag string, err error) {
 	if viper.GetString("tag") != "" {
 		tag = viper.GetString("tag")
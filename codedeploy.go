@@ -0,0 +1,791 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+const (
+	// codeDeployAssumeRolePolicy allows CodeDeploy to assume a role
+	codeDeployAssumeRolePolicy = `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Effect": "Allow",
+      "Principal": {"Service": "codedeploy.amazonaws.com"},
+      "Action": "sts:AssumeRole"
+    }
+  ]
+}`
+
+	codeDeployRolePolicy = "arn:aws:iam::aws:policy/AWSCodeDeployRoleForECS"
+
+	// allowTrafficEvent is the lifecycle event that moves production
+	// traffic to the replacement tasks
+	allowTrafficEvent = "AllowTraffic"
+
+	// defaultHookTimeout is how long CodeDeploy waits for hook tasks to
+	// finish before rolling back, in minutes
+	defaultHookTimeout = 60
+)
+
+// trafficShiftTypes are the ways traffic can be moved to the replacement
+// tasks
+var trafficShiftTypes = []string{"all_at_once", "linear", "canary"}
+
+// BlueGreen configures blue/green deployments through CodeDeploy, for
+// services using the CODE_DEPLOY deployment controller
+type BlueGreen struct {
+	// AlternateTargetGroupArn or AlternateTargetGroupName is the second
+	// target group, which receives traffic for the replacement tasks
+	AlternateTargetGroupArn  string `yaml:"alternate_target_group_arn"`
+	AlternateTargetGroupName string `yaml:"alternate_target_group_name"`
+
+	// ListenerArn is the production listener, and TestListenerArn a
+	// listener that sends test traffic to the replacement tasks before
+	// production traffic is moved
+	ListenerArn     string `yaml:"listener_arn"`
+	TestListenerArn string `yaml:"test_listener_arn"`
+
+	TrafficShift TrafficShift `yaml:"traffic_shift"`
+
+	// TerminationWait is how long to keep the original tasks after a
+	// successful deployment, in minutes
+	TerminationWait int64 `yaml:"termination_wait"`
+
+	// RollbackAlarms are CloudWatch alarms that roll back the deployment
+	RollbackAlarms []string `yaml:"rollback_alarms"`
+
+	// RoleName is an existing role for CodeDeploy to use, instead of the
+	// role flecs creates
+	RoleName string `yaml:"role_name"`
+
+	Hooks BlueGreenHooks `yaml:"hooks"`
+}
+
+// TrafficShift configures how traffic is moved to the replacement tasks:
+// all_at_once, linear to move a percentage every interval, or canary to move a
+// percentage and then the rest after the interval. Intervals are in minutes
+type TrafficShift struct {
+	Type       string `yaml:"type"`
+	Percentage int64  `yaml:"percentage"`
+	Interval   int64  `yaml:"interval"`
+}
+
+// BlueGreenHooks run flecs tasks during a deployment
+type BlueGreenHooks struct {
+	// BeforeAllowTraffic are tasks that run once the replacement tasks
+	// receive test traffic. If any fail, the deployment is rolled back
+	BeforeAllowTraffic []string `yaml:"before_allow_traffic"`
+
+	// Timeout is how long CodeDeploy waits for the tasks, in minutes
+	Timeout int64 `yaml:"timeout"`
+}
+
+// taskRunner runs a task configured in tasks
+type taskRunner func(ctx context.Context, task string) error
+
+// validate checks the blue/green configuration
+func (b BlueGreen) validate(cfg Config) (err error) {
+	if (b.AlternateTargetGroupArn == "") == (b.AlternateTargetGroupName == "") {
+		return fmt.Errorf("must specify one of alternate_target_group_arn or alternate_target_group_name")
+	}
+
+	if b.ListenerArn == "" {
+		return fmt.Errorf("must specify listener_arn")
+	}
+
+	err = b.TrafficShift.validate()
+	if err != nil {
+		return err
+	}
+
+	if len(b.Hooks.BeforeAllowTraffic) > 0 && b.TestListenerArn == "" {
+		return fmt.Errorf("must specify test_listener_arn to use hooks")
+	}
+
+	for _, task := range b.Hooks.BeforeAllowTraffic {
+		if _, ok := cfg.Tasks[task]; !ok {
+			return fmt.Errorf("cannot find task configured called %s", task)
+		}
+	}
+
+	return err
+}
+
+// hookTimeout returns how long CodeDeploy waits for the hook tasks before
+// stopping the deployment, in minutes
+func (b BlueGreen) hookTimeout() int64 {
+	if b.Hooks.Timeout == 0 {
+		return defaultHookTimeout
+	}
+
+	return b.Hooks.Timeout
+}
+
+// deploymentWait returns how long to wait for a deployment by default.
+// CodeDeploy keeps a deployment in progress while it waits for the hooks,
+// shifts traffic and keeps the original tasks, so the timeout allows for all
+// of them on top of the time it takes to start the replacement tasks
+func (b BlueGreen) deploymentWait() WaitOptions {
+	minutes := b.TrafficShift.duration() + b.TerminationWait
+	if len(b.Hooks.BeforeAllowTraffic) > 0 {
+		minutes += b.hookTimeout()
+	}
+
+	wait := codeDeployWait
+	wait.Timeout += Duration(time.Duration(minutes) * time.Minute)
+
+	return wait
+}
+
+// alternateTargetGroupName returns the name of the alternate target group,
+// which is all CodeDeploy needs
+func (b BlueGreen) alternateTargetGroupName() string {
+	if b.AlternateTargetGroupName != "" {
+		return b.AlternateTargetGroupName
+	}
+
+	return targetGroupName(b.AlternateTargetGroupArn)
+}
+
+// validate checks the traffic shift configuration
+func (t TrafficShift) validate() (err error) {
+	if t.Type != "" && !stringInSlice(t.Type, trafficShiftTypes) {
+		return fmt.Errorf("invalid traffic_shift type %s, must be one of %s", t.Type, strings.Join(trafficShiftTypes, ", "))
+	}
+
+	if t.Type == "linear" || t.Type == "canary" {
+		if t.Percentage < 1 || t.Percentage > 99 {
+			return fmt.Errorf("traffic_shift percentage must be between 1 and 99")
+		}
+
+		if t.Interval < 1 {
+			return fmt.Errorf("traffic_shift interval must be at least 1 minute")
+		}
+	} else if t.Percentage != 0 || t.Interval != 0 {
+		return fmt.Errorf("traffic_shift percentage and interval can only be used with linear or canary")
+	}
+
+	return err
+}
+
+// deploymentConfigName returns the name of the CodeDeploy deployment
+// configuration for the traffic shift
+func (t TrafficShift) deploymentConfigName() string {
+	switch t.Type {
+	case "linear":
+		return fmt.Sprintf("flecs.ECSLinear%dPercentEvery%dMinutes", t.Percentage, t.Interval)
+	case "canary":
+		return fmt.Sprintf("flecs.ECSCanary%dPercent%dMinutes", t.Percentage, t.Interval)
+	}
+
+	return "CodeDeployDefault.ECSAllAtOnce"
+}
+
+// duration returns how long it takes to move all traffic, in minutes
+func (t TrafficShift) duration() int64 {
+	switch t.Type {
+	case "linear":
+		return (100 + t.Percentage - 1) / t.Percentage * t.Interval
+	case "canary":
+		return t.Interval
+	}
+
+	return 0
+}
+
+// trafficRoutingConfig returns how CodeDeploy moves traffic for linear and
+// canary shifts
+func (t TrafficShift) trafficRoutingConfig() *codedeploy.TrafficRoutingConfig {
+	switch t.Type {
+	case "linear":
+		return &codedeploy.TrafficRoutingConfig{
+			Type: aws.String(codedeploy.TrafficRoutingTypeTimeBasedLinear),
+			TimeBasedLinear: &codedeploy.TimeBasedLinear{
+				LinearInterval:   aws.Int64(t.Interval),
+				LinearPercentage: aws.Int64(t.Percentage),
+			},
+		}
+	case "canary":
+		return &codedeploy.TrafficRoutingConfig{
+			Type: aws.String(codedeploy.TrafficRoutingTypeTimeBasedCanary),
+			TimeBasedCanary: &codedeploy.TimeBasedCanary{
+				CanaryInterval:   aws.Int64(t.Interval),
+				CanaryPercentage: aws.Int64(t.Percentage),
+			},
+		}
+	}
+
+	return nil
+}
+
+// targetGroupName returns the name of a target group from its ARN, such as
+// arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/web/abc
+func targetGroupName(targetGroupArn string) string {
+	parts := strings.Split(targetGroupArn, "/")
+	if len(parts) < 2 {
+		return targetGroupArn
+	}
+
+	return parts[1]
+}
+
+// codeDeployApplicationName returns the name of the CodeDeploy application
+// for the project and environment
+func (cfg Config) codeDeployApplicationName() string {
+	parts := []string{"flecs", cfg.ProjectName}
+	if cfg.EnvironmentName != "" {
+		parts = append(parts, cfg.EnvironmentName)
+	}
+
+	return strings.Join(parts, "-")
+}
+
+// codeDeployRoleName returns the name of the role flecs manages for
+// CodeDeploy, which is unique to the project and environment
+func (cfg Config) codeDeployRoleName() string {
+	return shortenRoleName(cfg.codeDeployApplicationName() + "-codedeploy")
+}
+
+// appSpec returns the AppSpec for a deployment of the task definition
+func (s Service) appSpec(taskDefinitionArn string, networkConfiguration ecs.NetworkConfiguration) (string, error) {
+	type awsvpcConfiguration struct {
+		Subnets        []string
+		SecurityGroups []string `json:",omitempty"`
+		AssignPublicIp string
+	}
+
+	// Services using CodeDeploy have exactly one load balancer
+	lb := s.loadBalancers()[0]
+
+	properties := map[string]interface{}{
+		"TaskDefinition": taskDefinitionArn,
+		"LoadBalancerInfo": map[string]interface{}{
+			"ContainerName": lb.ContainerName,
+			"ContainerPort": lb.ContainerPort,
+		},
+	}
+
+	if s.PlatformVersion != "" {
+		properties["PlatformVersion"] = s.PlatformVersion
+	}
+
+	if vpc := networkConfiguration.AwsvpcConfiguration; vpc != nil {
+		properties["NetworkConfiguration"] = map[string]interface{}{
+			"AwsvpcConfiguration": awsvpcConfiguration{
+				Subnets:        aws.StringValueSlice(vpc.Subnets),
+				SecurityGroups: aws.StringValueSlice(vpc.SecurityGroups),
+				AssignPublicIp: aws.StringValue(vpc.AssignPublicIp),
+			},
+		}
+	}
+
+	appSpec := map[string]interface{}{
+		"version": json.Number("0.0"),
+		"Resources": []interface{}{
+			map[string]interface{}{
+				"TargetService": map[string]interface{}{
+					"Type":       "AWS::ECS::Service",
+					"Properties": properties,
+				},
+			},
+		},
+	}
+
+	data, err := json.MarshalIndent(appSpec, "", "  ")
+	return string(data), err
+}
+
+// deploymentGroup returns the settings for the service's deployment group
+func (s Service) deploymentGroup(cfg Config, serviceName, roleArn string) codedeploy.CreateDeploymentGroupInput {
+	b := s.BlueGreen
+
+	ready := codedeploy.DeploymentReadyOption{
+		ActionOnTimeout: aws.String(codedeploy.DeploymentReadyActionContinueDeployment),
+	}
+
+	// Wait for flecs to run the hooks before moving production traffic
+	if len(b.Hooks.BeforeAllowTraffic) > 0 {
+		ready.SetActionOnTimeout(codedeploy.DeploymentReadyActionStopDeployment)
+		ready.SetWaitTimeInMinutes(b.hookTimeout())
+	}
+
+	targetGroups := codedeploy.TargetGroupPairInfo{
+		ProdTrafficRoute: &codedeploy.TrafficRoute{ListenerArns: aws.StringSlice([]string{b.ListenerArn})},
+		TargetGroups: []*codedeploy.TargetGroupInfo{
+			{Name: aws.String(s.loadBalancers()[0].targetGroupName())},
+			{Name: aws.String(b.alternateTargetGroupName())},
+		},
+	}
+
+	if b.TestListenerArn != "" {
+		targetGroups.TestTrafficRoute = &codedeploy.TrafficRoute{ListenerArns: aws.StringSlice([]string{b.TestListenerArn})}
+	}
+
+	rollback := codedeploy.AutoRollbackConfiguration{
+		Enabled: aws.Bool(true),
+		Events: aws.StringSlice([]string{
+			codedeploy.AutoRollbackEventDeploymentFailure,
+			codedeploy.AutoRollbackEventDeploymentStopOnRequest,
+		}),
+	}
+
+	alarms := codedeploy.AlarmConfiguration{Enabled: aws.Bool(false)}
+	if len(b.RollbackAlarms) > 0 {
+		alarms.SetEnabled(true)
+		for _, alarm := range b.RollbackAlarms {
+			alarms.Alarms = append(alarms.Alarms, &codedeploy.Alarm{Name: aws.String(alarm)})
+		}
+
+		rollback.Events = append(rollback.Events, aws.String(codedeploy.AutoRollbackEventDeploymentStopOnAlarm))
+	}
+
+	return codedeploy.CreateDeploymentGroupInput{
+		AlarmConfiguration:        &alarms,
+		ApplicationName:           aws.String(cfg.codeDeployApplicationName()),
+		AutoRollbackConfiguration: &rollback,
+		BlueGreenDeploymentConfiguration: &codedeploy.BlueGreenDeploymentConfiguration{
+			DeploymentReadyOption: &ready,
+			TerminateBlueInstancesOnDeploymentSuccess: &codedeploy.BlueInstanceTerminationOption{
+				Action:                       aws.String(codedeploy.InstanceActionTerminate),
+				TerminationWaitTimeInMinutes: aws.Int64(b.TerminationWait),
+			},
+		},
+		DeploymentConfigName: aws.String(b.TrafficShift.deploymentConfigName()),
+		DeploymentGroupName:  aws.String(s.serviceNamePrefix(cfg)),
+		DeploymentStyle: &codedeploy.DeploymentStyle{
+			DeploymentOption: aws.String(codedeploy.DeploymentOptionWithTrafficControl),
+			DeploymentType:   aws.String(codedeploy.DeploymentTypeBlueGreen),
+		},
+		EcsServices: []*codedeploy.ECSService{{
+			ClusterName: aws.String(cfg.Options.ClusterName),
+			ServiceName: aws.String(serviceName),
+		}},
+		LoadBalancerInfo: &codedeploy.LoadBalancerInfo{
+			TargetGroupPairInfoList: []*codedeploy.TargetGroupPairInfo{&targetGroups},
+		},
+		ServiceRoleArn: aws.String(roleArn),
+	}
+}
+
+// createDeploymentGroup creates the CodeDeploy application, deployment
+// configuration and deployment group for the service if they don't exist,
+// and updates the deployment group to match the configuration
+func (s Service) createDeploymentGroup(ctx context.Context, c Clients, cfg Config, serviceName string) (err error) {
+	applicationName := cfg.codeDeployApplicationName()
+
+	_, err = c.CodeDeploy.GetApplicationWithContext(ctx, &codedeploy.GetApplicationInput{
+		ApplicationName: aws.String(applicationName),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == codedeploy.ErrCodeApplicationDoesNotExistException {
+		_, err = c.CodeDeploy.CreateApplicationWithContext(ctx, &codedeploy.CreateApplicationInput{
+			ApplicationName: aws.String(applicationName),
+			ComputePlatform: aws.String(codedeploy.ComputePlatformEcs),
+		})
+		if err == nil {
+			Log.Infof("Created CodeDeploy application %s", applicationName)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if routing := s.BlueGreen.TrafficShift.trafficRoutingConfig(); routing != nil {
+		_, err = c.CodeDeploy.CreateDeploymentConfigWithContext(ctx, &codedeploy.CreateDeploymentConfigInput{
+			ComputePlatform:      aws.String(codedeploy.ComputePlatformEcs),
+			DeploymentConfigName: aws.String(s.BlueGreen.TrafficShift.deploymentConfigName()),
+			TrafficRoutingConfig: routing,
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == codedeploy.ErrCodeDeploymentConfigAlreadyExistsException {
+			err = nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	roleArn, err := createCodeDeployRole(ctx, c, cfg, s.BlueGreen.RoleName)
+	if err != nil {
+		return err
+	}
+
+	group := s.deploymentGroup(cfg, serviceName, roleArn)
+
+	_, err = c.CodeDeploy.GetDeploymentGroupWithContext(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     group.ApplicationName,
+		DeploymentGroupName: group.DeploymentGroupName,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == codedeploy.ErrCodeDeploymentGroupDoesNotExistException {
+		_, err = c.CodeDeploy.CreateDeploymentGroupWithContext(ctx, &group)
+		if err == nil {
+			Log.Infof("Created CodeDeploy deployment group %s", aws.StringValue(group.DeploymentGroupName))
+		}
+
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.CodeDeploy.UpdateDeploymentGroupWithContext(ctx, &codedeploy.UpdateDeploymentGroupInput{
+		AlarmConfiguration:               group.AlarmConfiguration,
+		ApplicationName:                  group.ApplicationName,
+		AutoRollbackConfiguration:        group.AutoRollbackConfiguration,
+		BlueGreenDeploymentConfiguration: group.BlueGreenDeploymentConfiguration,
+		CurrentDeploymentGroupName:       group.DeploymentGroupName,
+		DeploymentConfigName:             group.DeploymentConfigName,
+		DeploymentStyle:                  group.DeploymentStyle,
+		EcsServices:                      group.EcsServices,
+		LoadBalancerInfo:                 group.LoadBalancerInfo,
+		ServiceRoleArn:                   group.ServiceRoleArn,
+	})
+
+	return err
+}
+
+// deleteDeploymentGroup deletes the CodeDeploy deployment group for the
+// service if it exists
+func (s Service) deleteDeploymentGroup(ctx context.Context, c Clients, cfg Config) (err error) {
+	groupName := s.serviceNamePrefix(cfg)
+
+	_, err = c.CodeDeploy.DeleteDeploymentGroupWithContext(ctx, &codedeploy.DeleteDeploymentGroupInput{
+		ApplicationName:     aws.String(cfg.codeDeployApplicationName()),
+		DeploymentGroupName: aws.String(groupName),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == codedeploy.ErrCodeApplicationDoesNotExistException {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	Log.Infof("Deleted CodeDeploy deployment group %s", groupName)
+	return err
+}
+
+// deleteCodeDeployApplication deletes the CodeDeploy application and the
+// role flecs manages for it, once no deployment groups are left in it
+func deleteCodeDeployApplication(ctx context.Context, c Clients, cfg Config) (err error) {
+	applicationName := cfg.codeDeployApplicationName()
+
+	resp, err := c.CodeDeploy.ListDeploymentGroupsWithContext(ctx, &codedeploy.ListDeploymentGroupsInput{
+		ApplicationName: aws.String(applicationName),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == codedeploy.ErrCodeApplicationDoesNotExistException {
+		return nil
+	}
+
+	if err != nil || len(resp.DeploymentGroups) > 0 {
+		return err
+	}
+
+	_, err = c.CodeDeploy.DeleteApplicationWithContext(ctx, &codedeploy.DeleteApplicationInput{
+		ApplicationName: aws.String(applicationName),
+	})
+	if err != nil {
+		return err
+	}
+
+	Log.Infof("Deleted CodeDeploy application %s", applicationName)
+
+	roleName := cfg.codeDeployRoleName()
+	role, err := getRole(ctx, c, roleName)
+	if err != nil || role == nil {
+		return err
+	}
+
+	err = deleteRole(ctx, c, roleName)
+	if err != nil {
+		return err
+	}
+
+	Log.Infof("Deleted role %s", roleName)
+	return err
+}
+
+// createCodeDeployRole returns the ARN of the role CodeDeploy uses, creating
+// it if flecs manages it
+func createCodeDeployRole(ctx context.Context, c Clients, cfg Config, existingRoleName string) (roleArn string, err error) {
+	if existingRoleName != "" {
+		role, err := getRole(ctx, c, existingRoleName)
+		if err != nil {
+			return roleArn, err
+		}
+
+		if role == nil {
+			return roleArn, fmt.Errorf("cannot find role %s", existingRoleName)
+		}
+
+		return aws.StringValue(role.Arn), err
+	}
+
+	roleName := cfg.codeDeployRoleName()
+
+	role, err := getRole(ctx, c, roleName)
+	if err != nil {
+		return roleArn, err
+	}
+
+	if role == nil {
+		resp, err := c.IAM.CreateRoleWithContext(ctx, &iam.CreateRoleInput{
+			AssumeRolePolicyDocument: aws.String(codeDeployAssumeRolePolicy),
+			Description:              aws.String("CodeDeploy role managed by flecs"),
+			RoleName:                 aws.String(roleName),
+		})
+		if err != nil {
+			return roleArn, err
+		}
+
+		Log.Infof("Created role %s", roleName)
+		role = resp.Role
+	}
+
+	attached, err := attachedRolePolicies(ctx, c, roleName)
+	if err != nil {
+		return roleArn, err
+	}
+
+	if !stringInSlice(codeDeployRolePolicy, attached) {
+		_, err = c.IAM.AttachRolePolicyWithContext(ctx, &iam.AttachRolePolicyInput{
+			PolicyArn: aws.String(codeDeployRolePolicy),
+			RoleName:  aws.String(roleName),
+		})
+		if err != nil {
+			return roleArn, err
+		}
+	}
+
+	return aws.StringValue(role.Arn), err
+}
+
+// deployBlueGreen starts a CodeDeploy deployment of the task definition,
+// and waits for it to finish. Hook tasks run once the replacement tasks
+// receive test traffic, and the deployment is rolled back if they fail
+func (s Service) deployBlueGreen(ctx context.Context, c Clients, cfg Config, serviceName, taskDefinitionArn string, networkConfiguration ecs.NetworkConfiguration, wait WaitOptions, runTask taskRunner) (err error) {
+	err = s.createDeploymentGroup(ctx, c, cfg, serviceName)
+	if err != nil {
+		return err
+	}
+
+	appSpec, err := s.appSpec(taskDefinitionArn, networkConfiguration)
+	if err != nil {
+		return err
+	}
+
+	Log.Debugf("AppSpec:\n%s", appSpec)
+
+	resp, err := c.CodeDeploy.CreateDeploymentWithContext(ctx, &codedeploy.CreateDeploymentInput{
+		ApplicationName:     aws.String(cfg.codeDeployApplicationName()),
+		DeploymentGroupName: aws.String(s.serviceNamePrefix(cfg)),
+		Description:         aws.String(fmt.Sprintf("Deployed by flecs: %s", cfg.Tag)),
+		Revision: &codedeploy.RevisionLocation{
+			AppSpecContent: &codedeploy.AppSpecContent{Content: aws.String(appSpec)},
+			RevisionType:   aws.String(codedeploy.RevisionLocationTypeAppSpecContent),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	deploymentID := aws.StringValue(resp.DeploymentId)
+	Log.Infof("Started deployment %s", deploymentID)
+
+	return s.waitForDeployment(ctx, c, cfg, serviceName, deploymentID, wait, runTask)
+}
+
+// waitForDeployment waits for a deployment to succeed, logging its progress
+// and running hooks when it is ready. If flecs stops waiting before the
+// deployment has finished, such as when a hook fails, it is rolled back,
+// unless production traffic has already moved to the replacement tasks
+func (s Service) waitForDeployment(ctx context.Context, c Clients, cfg Config, serviceName, deploymentID string, wait WaitOptions, runTask taskRunner) (err error) {
+	progress := deploymentProgress{events: make(map[string]string)}
+	targetID := fmt.Sprintf("%s:%s", cfg.Options.ClusterName, serviceName)
+	hooksRun := false
+
+	err = wait.merge(s.BlueGreen.deploymentWait()).poll(ctx, func() (bool, error) {
+		resp, err := c.CodeDeploy.GetDeploymentWithContext(ctx, &codedeploy.GetDeploymentInput{
+			DeploymentId: aws.String(deploymentID),
+		})
+		if err != nil {
+			return false, err
+		}
+
+		info := resp.DeploymentInfo
+
+		err = progress.log(ctx, c, deploymentID, targetID, aws.StringValue(info.Status))
+		if err != nil {
+			return false, err
+		}
+
+		switch aws.StringValue(info.Status) {
+		case codedeploy.DeploymentStatusSucceeded:
+			return true, nil
+		case codedeploy.DeploymentStatusFailed, codedeploy.DeploymentStatusStopped:
+			return false, deploymentError(info)
+		case codedeploy.DeploymentStatusReady:
+			if hooksRun {
+				return false, nil
+			}
+
+			hooksRun = true
+			return false, s.runHooks(ctx, c, deploymentID, runTask)
+		}
+
+		return false, nil
+	})
+
+	switch progress.status {
+	case codedeploy.DeploymentStatusSucceeded, codedeploy.DeploymentStatusFailed, codedeploy.DeploymentStatusStopped:
+	default:
+		if err == nil {
+			break
+		}
+
+		// Once production traffic has moved, the deployment is only waiting
+		// to terminate the original tasks, so rolling back would undo a
+		// working deployment
+		if progress.events[allowTrafficEvent] == codedeploy.LifecycleEventStatusSucceeded {
+			Log.Warnf("Deployment %s has moved production traffic, leaving it to finish", deploymentID)
+			return fmt.Errorf("%s, but deployment %s has moved production traffic and was left to finish", err, deploymentID)
+		}
+
+		stopDeployment(c, deploymentID)
+	}
+
+	return err
+}
+
+// runHooks runs the tasks that check the replacement tasks, then lets the
+// deployment move production traffic
+func (s Service) runHooks(ctx context.Context, c Clients, deploymentID string, runTask taskRunner) (err error) {
+	for _, task := range s.BlueGreen.Hooks.BeforeAllowTraffic {
+		Log.Infof("Running hook task %s", task)
+
+		err = runTask(ctx, task)
+		if err != nil {
+			return fmt.Errorf("hook task %s failed: %s", task, err)
+		}
+	}
+
+	Log.Info("Allowing production traffic")
+
+	_, err = c.CodeDeploy.ContinueDeploymentWithContext(ctx, &codedeploy.ContinueDeploymentInput{
+		DeploymentId:       aws.String(deploymentID),
+		DeploymentWaitType: aws.String(codedeploy.DeploymentWaitTypeReadyWait),
+	})
+
+	return err
+}
+
+// stopDeployment stops a deployment and rolls it back. The pipeline context
+// may already be cancelled at this point, so we use a fresh one
+func stopDeployment(c Clients, deploymentID string) {
+	Log.Warnf("Stopping deployment %s", deploymentID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := c.CodeDeploy.StopDeploymentWithContext(ctx, &codedeploy.StopDeploymentInput{
+		AutoRollbackEnabled: aws.Bool(true),
+		DeploymentId:        aws.String(deploymentID),
+	})
+	if err != nil {
+		Log.Errorf("Failed to stop deployment %s: %s", deploymentID, err)
+		return
+	}
+
+	Log.Infof("Stopped deployment %s", deploymentID)
+}
+
+// deploymentError describes why a deployment failed, and whether it was
+// rolled back
+func deploymentError(info *codedeploy.DeploymentInfo) error {
+	message := fmt.Sprintf("deployment %s %s", aws.StringValue(info.DeploymentId), strings.ToLower(aws.StringValue(info.Status)))
+	if info.ErrorInformation != nil {
+		message = fmt.Sprintf("%s: %s", message, aws.StringValue(info.ErrorInformation.Message))
+	}
+
+	if info.RollbackInfo != nil && aws.StringValue(info.RollbackInfo.RollbackDeploymentId) != "" {
+		message = fmt.Sprintf("%s (rolled back by deployment %s)", message, aws.StringValue(info.RollbackInfo.RollbackDeploymentId))
+	}
+
+	return fmt.Errorf("%s", message)
+}
+
+// deploymentProgress remembers what has been logged about a deployment, so
+// that only changes are logged
+type deploymentProgress struct {
+	status  string
+	events  map[string]string
+	traffic string
+}
+
+// log logs any changes to the status of the deployment, its lifecycle
+// events and how traffic is split between the original and replacement tasks
+func (p *deploymentProgress) log(ctx context.Context, c Clients, deploymentID, targetID, status string) (err error) {
+	if status != p.status {
+		Log.Infof("Deployment %s: %s", deploymentID, status)
+		p.status = status
+	}
+
+	resp, err := c.CodeDeploy.GetDeploymentTargetWithContext(ctx, &codedeploy.GetDeploymentTargetInput{
+		DeploymentId: aws.String(deploymentID),
+		TargetId:     aws.String(targetID),
+	})
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case codedeploy.ErrCodeDeploymentTargetDoesNotExistException, codedeploy.ErrCodeDeploymentNotStartedException:
+			return nil
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	target := resp.DeploymentTarget.EcsTarget
+	if target == nil {
+		return err
+	}
+
+	for _, event := range target.LifecycleEvents {
+		name := aws.StringValue(event.LifecycleEventName)
+		eventStatus := aws.StringValue(event.Status)
+
+		if eventStatus != p.events[name] {
+			Log.Infof("Deployment %s: %s %s", deploymentID, name, eventStatus)
+			p.events[name] = eventStatus
+		}
+	}
+
+	var traffic []string
+	for _, taskSet := range target.TaskSetsInfo {
+		traffic = append(traffic, fmt.Sprintf("%s %.0f%% (%d/%d tasks)",
+			strings.ToLower(aws.StringValue(taskSet.TaskSetLabel)),
+			aws.Float64Value(taskSet.TrafficWeight),
+			aws.Int64Value(taskSet.RunningCount),
+			aws.Int64Value(taskSet.DesiredCount),
+		))
+	}
+
+	if summary := strings.Join(traffic, ", "); summary != p.traffic {
+		Log.Infof("Deployment %s: %s", deploymentID, summary)
+		p.traffic = summary
+	}
+
+	return err
+}
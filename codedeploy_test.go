@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/stretchr/testify/assert"
+)
+
+var blueGreenService = Service{
+	Name:                 "web",
+	Definition:           "web",
+	DeploymentController: "CODE_DEPLOY",
+	LoadBalancer: LoadBalancer{
+		TargetGroupArn: "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/web-blue/abc",
+		ContainerName:  "web",
+		ContainerPort:  8080,
+	},
+	BlueGreen: BlueGreen{
+		AlternateTargetGroupArn: "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/web-green/def",
+		ListenerArn:             "arn:aws:elasticloadbalancing:eu-west-1:123456789012:listener/app/web/abc/443",
+		TestListenerArn:         "arn:aws:elasticloadbalancing:eu-west-1:123456789012:listener/app/web/abc/8443",
+		TrafficShift:            TrafficShift{Type: "canary", Percentage: 10, Interval: 5},
+		Hooks:                   BlueGreenHooks{BeforeAllowTraffic: []string{"smoke-test"}},
+	},
+}
+
+func TestTrafficShift(t *testing.T) {
+	assert.Nil(t, TrafficShift{}.validate())
+	assert.Nil(t, TrafficShift{Type: "linear", Percentage: 10, Interval: 1}.validate())
+	assert.NotNil(t, TrafficShift{Type: "gradual"}.validate())
+	assert.NotNil(t, TrafficShift{Type: "canary", Percentage: 100, Interval: 5}.validate())
+	assert.NotNil(t, TrafficShift{Type: "linear", Percentage: 10}.validate())
+	assert.NotNil(t, TrafficShift{Type: "all_at_once", Percentage: 10}.validate())
+
+	assert.Equal(t, "CodeDeployDefault.ECSAllAtOnce", TrafficShift{}.deploymentConfigName())
+	assert.Equal(t, "flecs.ECSLinear10PercentEvery1Minutes", TrafficShift{Type: "linear", Percentage: 10, Interval: 1}.deploymentConfigName())
+	assert.Equal(t, "flecs.ECSCanary10Percent5Minutes", TrafficShift{Type: "canary", Percentage: 10, Interval: 5}.deploymentConfigName())
+
+	assert.Nil(t, TrafficShift{Type: "all_at_once"}.trafficRoutingConfig())
+	assert.Equal(t, &codedeploy.TrafficRoutingConfig{
+		Type:            aws.String("TimeBasedCanary"),
+		TimeBasedCanary: &codedeploy.TimeBasedCanary{CanaryInterval: aws.Int64(5), CanaryPercentage: aws.Int64(10)},
+	}, TrafficShift{Type: "canary", Percentage: 10, Interval: 5}.trafficRoutingConfig())
+}
+
+func TestServiceValidateBlueGreen(t *testing.T) {
+	cfg := Config{
+		Definitions: map[string]Definition{"web": {Containers: []Container{
+			{Name: "web", PortMappings: []PortMapping{{ContainerPort: 8080}}},
+		}}},
+		Tasks: map[string]Task{"smoke-test": {}},
+	}
+
+	assert.Nil(t, blueGreenService.validate(cfg))
+
+	service := blueGreenService
+	service.LoadBalancer.ContainerPort = 80
+	assert.EqualError(t, service.validate(cfg), "service web: container web in definition web does not map port 80 for load balancer web-blue")
+
+	service = blueGreenService
+	service.BlueGreen.TestListenerArn = ""
+	assert.EqualError(t, service.validate(cfg), "service web: blue_green: must specify test_listener_arn to use hooks")
+
+	service = blueGreenService
+	service.BlueGreen.Hooks.BeforeAllowTraffic = []string{"load-test"}
+	assert.EqualError(t, service.validate(cfg), "service web: blue_green: cannot find task configured called load-test")
+
+	service = blueGreenService
+	service.LoadBalancer.TargetGroupArn = ""
+	service.LoadBalancer.TargetGroupName = "web-blue"
+	service.BlueGreen.AlternateTargetGroupArn = ""
+	service.BlueGreen.AlternateTargetGroupName = "web-green"
+	assert.Nil(t, service.validate(cfg))
+
+	group := service.deploymentGroup(cfg, "flecs-shop-web-abcd1234", "arn:aws:iam::123456789012:role/codedeploy")
+	assert.Equal(t, "web-blue", aws.StringValue(group.LoadBalancerInfo.TargetGroupPairInfoList[0].TargetGroups[0].Name))
+	assert.Equal(t, "web-green", aws.StringValue(group.LoadBalancerInfo.TargetGroupPairInfoList[0].TargetGroups[1].Name))
+
+	service.BlueGreen.AlternateTargetGroupArn = "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/web-green/def"
+	assert.NotNil(t, service.validate(cfg))
+
+	service = blueGreenService
+	service.DeploymentController = ""
+	assert.NotNil(t, service.validate(cfg))
+
+	service.DeploymentController = "EXTERNAL"
+	assert.NotNil(t, service.validate(cfg))
+}
+
+func TestServiceAppSpec(t *testing.T) {
+	appSpec, err := blueGreenService.appSpec("arn:aws:ecs:eu-west-1:123456789012:task-definition/flecs-shop-web:3", ecs.NetworkConfiguration{
+		AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
+			AssignPublicIp: aws.String("DISABLED"),
+			SecurityGroups: aws.StringSlice([]string{"sg-1"}),
+			Subnets:        aws.StringSlice([]string{"subnet-1", "subnet-2"}),
+		},
+	})
+	assert.Nil(t, err)
+	assert.True(t, equalJSON(`{
+  "version": 0.0,
+  "Resources": [
+    {
+      "TargetService": {
+        "Type": "AWS::ECS::Service",
+        "Properties": {
+          "TaskDefinition": "arn:aws:ecs:eu-west-1:123456789012:task-definition/flecs-shop-web:3",
+          "LoadBalancerInfo": {"ContainerName": "web", "ContainerPort": 8080},
+          "NetworkConfiguration": {
+            "AwsvpcConfiguration": {
+              "Subnets": ["subnet-1", "subnet-2"],
+              "SecurityGroups": ["sg-1"],
+              "AssignPublicIp": "DISABLED"
+            }
+          }
+        }
+      }
+    }
+  ]
+}`, appSpec), appSpec)
+	assert.Contains(t, appSpec, `"version": 0.0`)
+}
+
+func TestServiceDeploymentGroup(t *testing.T) {
+	cfg := Config{ProjectName: "shop", EnvironmentName: "production", Options: ConfigOptions{ClusterName: "flecs"}}
+
+	group := blueGreenService.deploymentGroup(cfg, "flecs-shop-web-abcd1234", "arn:aws:iam::123456789012:role/codedeploy")
+
+	assert.Equal(t, "flecs-shop-production", aws.StringValue(group.ApplicationName))
+	assert.Equal(t, "flecs-shop-web", aws.StringValue(group.DeploymentGroupName))
+	assert.Equal(t, "flecs.ECSCanary10Percent5Minutes", aws.StringValue(group.DeploymentConfigName))
+	assert.Equal(t, "STOP_DEPLOYMENT", aws.StringValue(group.BlueGreenDeploymentConfiguration.DeploymentReadyOption.ActionOnTimeout))
+	assert.Equal(t, int64(60), aws.Int64Value(group.BlueGreenDeploymentConfiguration.DeploymentReadyOption.WaitTimeInMinutes))
+	assert.Equal(t, "flecs-shop-web-abcd1234", aws.StringValue(group.EcsServices[0].ServiceName))
+
+	pair := group.LoadBalancerInfo.TargetGroupPairInfoList[0]
+	assert.Equal(t, "web-blue", aws.StringValue(pair.TargetGroups[0].Name))
+	assert.Equal(t, "web-green", aws.StringValue(pair.TargetGroups[1].Name))
+	assert.Equal(t, []string{blueGreenService.BlueGreen.TestListenerArn}, aws.StringValueSlice(pair.TestTrafficRoute.ListenerArns))
+
+	assert.True(t, aws.BoolValue(group.AutoRollbackConfiguration.Enabled))
+	assert.False(t, aws.BoolValue(group.AlarmConfiguration.Enabled))
+}
+
+func TestCodeDeployRoleName(t *testing.T) {
+	cfg := Config{ProjectName: "shop", EnvironmentName: "production"}
+	assert.Equal(t, "flecs-shop-production-codedeploy", cfg.codeDeployRoleName())
+
+	// Long names keep a hash of the environment, so each has its own role
+	cfg.ProjectName = strings.Repeat("a", 64)
+	staging := cfg
+	staging.EnvironmentName = "staging"
+	assert.Len(t, cfg.codeDeployRoleName(), maxRoleNameLength)
+	assert.NotEqual(t, cfg.codeDeployRoleName(), staging.codeDeployRoleName())
+}
+
+func TestDeployBlueGreen(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{ProjectName: "shop", Options: ConfigOptions{ClusterName: "flecs"}}
+	wait := WaitOptions{Timeout: Duration(time.Second), PollInterval: Duration(time.Millisecond)}
+
+	var calls, iamCalls, appSpecs, tasks []string
+	statuses := []string{"InProgress", "Ready", "Ready", "Succeeded"}
+	clients := Clients{
+		CodeDeploy: mockedCodeDeployClient{Statuses: &statuses, AppSpecs: &appSpecs, Calls: &calls},
+		IAM:        mockedIAMClient{Calls: &iamCalls},
+	}
+
+	runTask := func(ctx context.Context, task string) error {
+		tasks = append(tasks, task)
+		return nil
+	}
+
+	err := blueGreenService.deployBlueGreen(ctx, clients, cfg, "flecs-shop-web-abcd1234", "arn:task-definition", ecs.NetworkConfiguration{}, wait, runTask)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CreateApplication", "CreateDeploymentConfig", "CreateDeploymentGroup", "CreateDeployment", "ContinueDeployment"}, calls)
+	assert.Equal(t, []string{"CreateRole", "AttachRolePolicy"}, iamCalls)
+	assert.Equal(t, []string{"smoke-test"}, tasks)
+	assert.Contains(t, appSpecs[0], "arn:task-definition")
+
+	// A failed hook stops the deployment so that it is rolled back
+	calls = nil
+	statuses = []string{"Ready"}
+	clients.CodeDeploy = mockedCodeDeployClient{ApplicationExists: true, DeploymentGroupExists: true, Statuses: &statuses, Calls: &calls}
+	clients.IAM = mockedIAMClient{
+		Role:             &iam.Role{Arn: aws.String("arn:aws:iam::123456789012:role/flecs-shop-codedeploy")},
+		AttachedPolicies: []string{codeDeployRolePolicy},
+	}
+
+	runTask = func(ctx context.Context, task string) error {
+		return fmt.Errorf("container smoke-test failed with exit code 1")
+	}
+
+	err = blueGreenService.deployBlueGreen(ctx, clients, cfg, "flecs-shop-web-abcd1234", "arn:task-definition", ecs.NetworkConfiguration{}, wait, runTask)
+	assert.EqualError(t, err, "hook task smoke-test failed: container smoke-test failed with exit code 1")
+	assert.Equal(t, []string{"CreateDeploymentConfig", "UpdateDeploymentGroup", "CreateDeployment", "StopDeployment"}, calls)
+
+	// A deployment that fails is not stopped again
+	calls = nil
+	statuses = []string{"InProgress", "Failed"}
+	clients.CodeDeploy = mockedCodeDeployClient{ApplicationExists: true, DeploymentGroupExists: true, Statuses: &statuses, Calls: &calls}
+
+	err = blueGreenService.deployBlueGreen(ctx, clients, cfg, "flecs-shop-web-abcd1234", "arn:task-definition", ecs.NetworkConfiguration{}, wait, runTask)
+	assert.EqualError(t, err, "deployment d-123 failed")
+	assert.NotContains(t, calls, "StopDeployment")
+
+	// Once production traffic has moved, the deployment is not rolled back
+	calls = nil
+	statuses = []string{"InProgress"}
+	clients.CodeDeploy = mockedCodeDeployClient{
+		ApplicationExists:     true,
+		DeploymentGroupExists: true,
+		Statuses:              &statuses,
+		Calls:                 &calls,
+		LifecycleEvents: []*codedeploy.LifecycleEvent{
+			{LifecycleEventName: aws.String("AllowTraffic"), Status: aws.String("Succeeded")},
+		},
+	}
+
+	wait.Timeout = Duration(5 * time.Millisecond)
+	err = blueGreenService.deployBlueGreen(ctx, clients, cfg, "flecs-shop-web-abcd1234", "arn:task-definition", ecs.NetworkConfiguration{}, wait, runTask)
+	assert.EqualError(t, err, "timed out after 5ms, but deployment d-123 has moved production traffic and was left to finish")
+	assert.NotContains(t, calls, "StopDeployment")
+}
+
+func TestDeleteBlueGreen(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{ProjectName: "shop", Options: ConfigOptions{ClusterName: "flecs"}}
+	wait := WaitOptions{Timeout: Duration(time.Second), PollInterval: Duration(time.Millisecond)}
+
+	running := func(controller string) mockedECSClient {
+		return mockedECSClient{DescribeServicesResp: ecs.DescribeServicesOutput{Services: []*ecs.Service{{
+			DeploymentController: &ecs.DeploymentController{Type: aws.String(controller)},
+			Status:               aws.String("INACTIVE"),
+		}}}}
+	}
+
+	// The deployment group goes with a service that uses CodeDeploy, even
+	// if it is being re-created to use ECS
+	var calls []string
+	clients := Clients{ECS: running("CODE_DEPLOY"), CodeDeploy: mockedCodeDeployClient{Calls: &calls}}
+	err := Service{Name: "web"}.Delete(ctx, clients, cfg, "flecs-shop-web-abcd1234", wait)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DeleteDeploymentGroup"}, calls)
+
+	// Re-creating a service to use CodeDeploy keeps the new deployment group
+	calls = nil
+	clients.ECS = running("ECS")
+	err = blueGreenService.Delete(ctx, clients, cfg, "flecs-shop-web-abcd1234", wait)
+	assert.Nil(t, err)
+	assert.Nil(t, calls)
+
+	// The application and role are only deleted once no services use them
+	var iamCalls []string
+	clients.CodeDeploy = mockedCodeDeployClient{ApplicationExists: true, DeploymentGroupExists: true, Calls: &calls}
+	clients.IAM = mockedIAMClient{Role: &iam.Role{RoleName: aws.String("flecs-shop-codedeploy")}, Calls: &iamCalls}
+	err = deleteCodeDeployApplication(ctx, clients, cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, calls)
+	assert.Nil(t, iamCalls)
+
+	clients.CodeDeploy = mockedCodeDeployClient{ApplicationExists: true, Calls: &calls}
+	err = deleteCodeDeployApplication(ctx, clients, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DeleteApplication"}, calls)
+	assert.Contains(t, iamCalls, "DeleteRole")
+}
+
+func TestDeploymentWait(t *testing.T) {
+	// Waits long enough to start the tasks, wait for hooks, shift traffic
+	// and keep the original tasks
+	b := BlueGreen{
+		TrafficShift:    TrafficShift{Type: "linear", Percentage: 10, Interval: 10},
+		TerminationWait: 60,
+		Hooks:           BlueGreenHooks{BeforeAllowTraffic: []string{"smoke-test"}, Timeout: 20},
+	}
+	assert.Equal(t, Duration(30*time.Minute+100*time.Minute+60*time.Minute+20*time.Minute), b.deploymentWait().Timeout)
+
+	b = BlueGreen{TrafficShift: TrafficShift{Type: "linear", Percentage: 30, Interval: 5}}
+	assert.Equal(t, Duration(50*time.Minute), b.deploymentWait().Timeout)
+
+	b = BlueGreen{TrafficShift: TrafficShift{Type: "canary", Percentage: 10, Interval: 15}, Hooks: BlueGreenHooks{BeforeAllowTraffic: []string{"smoke-test"}}}
+	assert.Equal(t, Duration(105*time.Minute), b.deploymentWait().Timeout)
+
+	assert.Equal(t, codeDeployWait, BlueGreen{}.deploymentWait())
+}
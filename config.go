@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -10,14 +11,25 @@ import (
 // ConfigOptions contains all the configuration options that are configurable
 // either at a per environment level or at the plain top level.
 type ConfigOptions struct {
+	AWSMaxRetries        int               `yaml:"aws_max_retries"`
+	AWSMaxThrottleDelay  Duration          `yaml:"aws_max_throttle_delay"`
 	AssignPublicIP       bool              `yaml:"public_ip"`
 	ClusterName          string            `yaml:"cluster_name"`
 	ECRRegion            string            `yaml:"ecr_region"`
+	EnvironmentFiles     []string          `yaml:"environment_files"`
 	EnvironmentVariables map[string]string `yaml:"environment_variables"`
 	LogGroupName         string            `yaml:"log_group_name"`
+	LogGroupTags         map[string]string `yaml:"log_group_tags"`
+	LogKMSKeyID          string            `yaml:"log_kms_key_id"`
+	LogRetentionDays     int64             `yaml:"log_retention_days"`
+	PinDigest            *bool             `yaml:"pin_digest"`
 	Pipeline             []Step            `yaml:"pipeline"`
 	Region               string            `yaml:"region"`
+	RequiredVariables    []string          `yaml:"required_environment_variables"`
 	Secrets              map[string]string `yaml:"secrets"`
+	SecretsFile          string            `yaml:"secrets_file"`
+	SecretsKMSKeyID      string            `yaml:"secrets_kms_key_id"`
+	SecretsStore         string            `yaml:"secrets_store"`
 	SecurityGroupNames   []string          `yaml:"security_group_names"`
 	SubnetNames          []string          `yaml:"subnet_names"`
 }
@@ -36,6 +48,16 @@ type Config struct {
 	Tag             string
 
 	RecreateServices bool
+
+	// StateFile is where progress through the pipeline is saved
+	StateFile string `yaml:"-"`
+
+	// ChangedSince is the revision that changed() compares against, instead
+	// of the last deployed tag
+	ChangedSince string `yaml:"-"`
+
+	// Outputs contains the outputs of each step that has run, by step name
+	Outputs map[string]Outputs `yaml:"-"`
 }
 
 // Step describes a step in the pipeline
@@ -45,9 +67,30 @@ type Step struct {
 	Service ServiceStep `yaml:",inline"`
 	Task    TaskStep    `yaml:",inline"`
 
+	// Wait overrides how long service and task steps wait, and sets a
+	// timeout for script and docker steps
+	Wait WaitOptions `yaml:",inline"`
+
+	// Retry configures retrying the step if it fails
+	Retry RetryOptions `yaml:",inline"`
+
+	// When is an expression that decides whether the step runs
+	When string `yaml:"when"`
+
+	// OnFailure is either "abort" (the default) to stop the pipeline when
+	// the step fails, or "continue" to carry on regardless
+	OnFailure string `yaml:"on_failure"`
+
+	// Always runs the step even if an earlier step failed, which is useful
+	// for cleaning up
+	Always bool `yaml:"always"`
+
 	Description string `yaml:"description"`
 	Name        string `yaml:"name"`
 	Type        string `yaml:"type"`
+
+	// skip is set when the step has been filtered out of the pipeline
+	skip bool
 }
 
 // LoadConfig will load all configuration options if they exist, allowing
@@ -105,6 +148,20 @@ func LoadConfig(yamlConfig, environment, tag, projectName string, recreate bool)
 		config.Options.Region = envConfig.Region
 	}
 
+	// Check and set AWS retry options
+	if envConfig.AWSMaxRetries != 0 {
+		config.Options.AWSMaxRetries = envConfig.AWSMaxRetries
+	}
+
+	if envConfig.AWSMaxThrottleDelay != 0 {
+		config.Options.AWSMaxThrottleDelay = envConfig.AWSMaxThrottleDelay
+	}
+
+	// Pin images by digest. Environments can turn this off as well as on
+	if envConfig.PinDigest != nil {
+		config.Options.PinDigest = envConfig.PinDigest
+	}
+
 	// Check and set security group names
 	if len(envConfig.SecurityGroupNames) > 0 {
 		config.Options.SecurityGroupNames = envConfig.SecurityGroupNames
@@ -117,18 +174,52 @@ func LoadConfig(yamlConfig, environment, tag, projectName string, recreate bool)
 
 	// Merge environment variables
 	if len(envConfig.EnvironmentVariables) > 0 {
+		if config.Options.EnvironmentVariables == nil {
+			config.Options.EnvironmentVariables = make(map[string]string)
+		}
+
 		for key, value := range envConfig.EnvironmentVariables {
 			config.Options.EnvironmentVariables[key] = value
 		}
 	}
 
+	// Load environment files, which are read after the top level files so
+	// that they can override them. Variables set in the configuration take
+	// precedence over both
+	config.Options.EnvironmentFiles = append(config.Options.EnvironmentFiles, envConfig.EnvironmentFiles...)
+
+	fileVariables, err := loadEnvironmentFiles(config.Options.EnvironmentFiles)
+	if err != nil {
+		return config, err
+	}
+
+	if len(fileVariables) > 0 {
+		for key, value := range config.Options.EnvironmentVariables {
+			fileVariables[key] = value
+		}
+
+		config.Options.EnvironmentVariables = fileVariables
+	}
+
 	// Merge secrets
 	if len(envConfig.Secrets) > 0 {
+		if config.Options.Secrets == nil {
+			config.Options.Secrets = make(map[string]string)
+		}
+
 		for key, value := range envConfig.Secrets {
 			config.Options.Secrets[key] = value
 		}
 	}
 
+	// Check required environment variables
+	config.Options.RequiredVariables = append(config.Options.RequiredVariables, envConfig.RequiredVariables...)
+
+	err = config.validateRequiredVariables()
+	if err != nil {
+		return config, err
+	}
+
 	// Check and set LogGroupName
 	if config.Options.LogGroupName == "" && envConfig.LogGroupName != "" {
 		config.Options.LogGroupName = envConfig.LogGroupName
@@ -139,6 +230,50 @@ func LoadConfig(yamlConfig, environment, tag, projectName string, recreate bool)
 		config.Options.LogGroupName = fmt.Sprintf("/flecs/%s", config.ProjectName)
 	}
 
+	// Check and set where secrets are managed
+	if envConfig.SecretsFile != "" {
+		config.Options.SecretsFile = envConfig.SecretsFile
+	}
+
+	if envConfig.SecretsKMSKeyID != "" {
+		config.Options.SecretsKMSKeyID = envConfig.SecretsKMSKeyID
+	}
+
+	if envConfig.SecretsStore != "" {
+		config.Options.SecretsStore = envConfig.SecretsStore
+	}
+
+	if config.Options.SecretsStore != "" && !stringInSlice(config.Options.SecretsStore, secretsStores) {
+		return config, fmt.Errorf("invalid secrets_store %s, must be one of %s", config.Options.SecretsStore, strings.Join(secretsStores, ", "))
+	}
+
+	// Check and set log group retention, encryption and tags
+	if envConfig.LogRetentionDays != 0 {
+		config.Options.LogRetentionDays = envConfig.LogRetentionDays
+	}
+
+	if config.Options.LogRetentionDays != 0 && !int64InSlice(config.Options.LogRetentionDays, logRetentionDays) {
+		return config, fmt.Errorf("invalid log_retention_days %d", config.Options.LogRetentionDays)
+	}
+
+	if envConfig.LogKMSKeyID != "" {
+		config.Options.LogKMSKeyID = envConfig.LogKMSKeyID
+	}
+
+	if config.Options.LogKMSKeyID != "" && !strings.HasPrefix(config.Options.LogKMSKeyID, "arn:") {
+		return config, fmt.Errorf("log_kms_key_id must be the ARN of a KMS key")
+	}
+
+	if len(envConfig.LogGroupTags) > 0 {
+		if config.Options.LogGroupTags == nil {
+			config.Options.LogGroupTags = make(map[string]string)
+		}
+
+		for key, value := range envConfig.LogGroupTags {
+			config.Options.LogGroupTags[key] = value
+		}
+	}
+
 	// Check and set ECR region
 	if envConfig.ECRRegion != "" {
 		config.Options.ECRRegion = envConfig.ECRRegion
@@ -159,6 +294,27 @@ func LoadConfig(yamlConfig, environment, tag, projectName string, recreate bool)
 		config.Options.Pipeline = envConfig.Pipeline
 	}
 
+	// Check definitions for errors
+	for name, definition := range config.Definitions {
+		err = definition.validate(name)
+		if err != nil {
+			return config, err
+		}
+
+		definition.name = name
+		config.Definitions[name] = definition
+	}
+
+	// Check services for errors
+	for name, service := range config.Services {
+		service.Name = name
+
+		err = service.validate(config)
+		if err != nil {
+			return config, err
+		}
+	}
+
 	// Check Pipeline for syntax errors
 	for index, step := range config.Options.Pipeline {
 		if step.Type == "" {
@@ -180,11 +336,29 @@ func LoadConfig(yamlConfig, environment, tag, projectName string, recreate bool)
 			}
 		}
 
-		if valid {
-			continue
+		if !valid {
+			return config, fmt.Errorf("invalid step config on step %d", index)
+		}
+
+		if step.When != "" {
+			_, err = parseWhen(step.When)
+			if err != nil {
+				return config, fmt.Errorf("invalid when on step %d: %s", index, err)
+			}
+		}
+
+		switch step.OnFailure {
+		case "", "abort", "continue":
+		default:
+			return config, fmt.Errorf("invalid on_failure on step %d: must be abort or continue", index)
 		}
 
-		return config, fmt.Errorf("invalid step config on step %d", index)
+		if step.Type == "docker" {
+			err = step.Docker.validate()
+			if err != nil {
+				return config, fmt.Errorf("invalid docker step %d: %s", index, err)
+			}
+		}
 	}
 
 	return config, err
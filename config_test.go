@@ -1,8 +1,13 @@
 package main
 
 import (
-	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 var (
@@ -160,7 +165,7 @@ pipeline:
 		Step{
 			Docker: DockerStep{
 				Dockerfile: "Dockerfile",
-				Repository: "test/repo",
+				Repository: Repository{Name: "test/repo"},
 			},
 			Type: "docker",
 			Name: "Docker test",
@@ -328,3 +333,504 @@ pipeline:
 	assert.Equal(t, "my-project-cluster", actual.Options.ClusterName)
 	assert.Equal(t, "test/some-tag", actual.Options.LogGroupName)
 }
+
+func TestLoadConfigWaitOptions(t *testing.T) {
+	yamlConfig = `---
+pipeline:
+  - type: service
+    service: web
+    timeout: 20m
+    poll_interval: 30
+
+services:
+  web:
+    definition: web
+    timeout: 1h
+`
+
+	actual, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.Nil(t, err)
+
+	assert.Equal(t, Duration(20*time.Minute), actual.Options.Pipeline[0].Wait.Timeout)
+	assert.Equal(t, Duration(30*time.Second), actual.Options.Pipeline[0].Wait.PollInterval)
+	assert.Equal(t, Duration(time.Hour), actual.Services["web"].Wait.Timeout)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+    timeout: soon
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigWhenErrors(t *testing.T) {
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+    when: environment = "staging"
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+    on_failure: ignore
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: docker
+    builder: podman
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: docker
+    scan:
+      fail_on: HIGH
+      ignore:
+        - id: CVE-2021-1
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: docker
+    registry:
+      url: ghcr.io
+    promote:
+      to:
+        - production
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: docker
+    registry:
+      url: ghcr.io
+    repository:
+      name: org/app
+      scan_on_push: true
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+definitions:
+  web:
+    containers:
+      - name: web
+        image: artifactory.example.com/web
+        repository_credentials: artifactory
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+definitions:
+  web:
+    volumes:
+      - name: media
+        efs:
+          file_system_id: fs-1
+    containers:
+      - name: web
+        image: web
+        mount_points:
+          - container_path: /uploads
+            source_volume: uploads
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+definitions:
+  web:
+    containers:
+      - name: envoy
+        image: envoy
+      - name: web
+        image: web
+        depends_on:
+          - container: envoy
+            condition: HEALTHY
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+definitions:
+  web:
+    logging:
+      driver: splunk
+    containers:
+      - name: web
+        image: web
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+definitions:
+  web:
+    task_role_name: web
+    iam:
+      managed_policies:
+        - arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+definitions:
+  web:
+    containers:
+      - name: web
+        image: web
+        port_mappings:
+          - container_port: 8080
+            protocol: http
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+services:
+  web:
+    definition: web
+    deployment_controller: CODE_DEPLOY
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigRuntimePlatform(t *testing.T) {
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+definitions:
+  web:
+    runtime_platform:
+      cpu_architecture: ARM64
+      operating_system_family: LINUX
+    containers:
+      - name: web
+        image: web
+`
+
+	actual, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.Nil(t, err)
+
+	expected := RuntimePlatform{
+		CPUArchitecture:       "ARM64",
+		OperatingSystemFamily: "LINUX",
+	}
+
+	assert.Equal(t, expected, actual.Definitions["web"].RuntimePlatform)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+definitions:
+  web:
+    runtime_platform:
+      cpu_architecture: arm
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigVolumes(t *testing.T) {
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+definitions:
+  media:
+    volumes:
+      - name: media
+        efs:
+          file_system_id: fs-1
+          access_point_id: fsap-1
+          transit_encryption: true
+          iam: true
+      - name: scratch
+        host_path: /scratch
+    containers:
+      - name: media
+        image: media
+        mount_points:
+          - container_path: /media
+            source_volume: media
+`
+
+	actual, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.Nil(t, err)
+
+	expected := []Volume{
+		{Name: "media", EFS: &EFSVolume{FileSystemID: "fs-1", AccessPointID: "fsap-1", TransitEncryption: true, IAM: true}},
+		{Name: "scratch", HostPath: "/scratch"},
+	}
+
+	assert.Equal(t, expected, actual.Definitions["media"].Volumes)
+}
+
+func TestLoadConfigLogGroup(t *testing.T) {
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+log_retention_days: 30
+log_group_tags:
+  team: web
+
+environments:
+  production:
+    log_retention_days: 365
+    log_kms_key_id: arn:aws:kms:eu-west-1:123456789012:key/abc
+    log_group_tags:
+      environment: production
+`
+
+	actual, err = LoadConfig(yamlConfig, "production", "", "", false)
+	assert.Nil(t, err)
+
+	assert.Equal(t, int64(365), actual.Options.LogRetentionDays)
+	assert.Equal(t, "arn:aws:kms:eu-west-1:123456789012:key/abc", actual.Options.LogKMSKeyID)
+	assert.Equal(t, map[string]string{"team": "web", "environment": "production"}, actual.Options.LogGroupTags)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+log_retention_days: 10
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigEnvironmentFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flecs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".env"), []byte("RAILS_ENV=development\nPORT=3000\nHOST=localhost\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".env.production"), []byte("RAILS_ENV=production\nHOST=\n"), 0644))
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+environment_files:
+  - ` + filepath.Join(dir, ".env") + `
+environment_variables:
+  PORT: "8080"
+required_environment_variables:
+  - RAILS_ENV
+  - HOST
+
+environments:
+  staging: {}
+  production:
+    environment_files:
+      - ` + filepath.Join(dir, ".env.{{ environment }}") + `
+      - arn:aws:s3:::shop-config/production.env
+`
+
+	actual, err = LoadConfig(yamlConfig, "staging", "", "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"RAILS_ENV": "development", "PORT": "8080", "HOST": "localhost"}, actual.Options.EnvironmentVariables)
+
+	// HOST is emptied by the production file
+	_, err = LoadConfig(yamlConfig, "production", "", "", false)
+	assert.EqualError(t, err, "required environment variables missing or empty for environment production: HOST")
+
+	yamlConfig += `    environment_variables:
+      HOST: shop.example.com
+`
+
+	actual, err = LoadConfig(yamlConfig, "production", "", "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"RAILS_ENV": "production", "PORT": "8080", "HOST": "shop.example.com"}, actual.Options.EnvironmentVariables)
+	assert.Equal(t, "arn:aws:s3:::shop-config/production.env", actual.Options.EnvironmentFiles[2])
+}
+
+func TestLoadConfigServiceDeployment(t *testing.T) {
+	yamlConfig = `---
+pipeline:
+  - type: service
+    service: web
+
+services:
+  web:
+    definition: web
+    launch_type: FARGATE
+    platform_version: LATEST
+    propagate_tags: SERVICE
+    enable_execute_command: true
+    deployment_configuration:
+      maximum_percent: 200
+      minimum_healthy_percent: 0
+      circuit_breaker:
+        enable: true
+        rollback: true
+`
+
+	actual, err := LoadConfig(yamlConfig, "", "", "", false)
+	assert.Nil(t, err)
+
+	service := actual.Services["web"]
+	assert.Equal(t, "LATEST", service.PlatformVersion)
+	assert.True(t, service.EnableExecuteCommand)
+	assert.Equal(t, int64(200), service.DeploymentConfiguration.MaximumPercent)
+	assert.Equal(t, int64(0), *service.DeploymentConfiguration.MinimumHealthyPercent)
+	assert.Equal(t, CircuitBreaker{Enable: true, Rollback: true}, service.DeploymentConfiguration.CircuitBreaker)
+}
+
+func TestLoadConfigSecretsStore(t *testing.T) {
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+secrets:
+  DB_PASSWORD:
+
+environments:
+  production:
+    secrets_store: secretsmanager
+    secrets:
+      API_KEY:
+`
+
+	actual, err = LoadConfig(yamlConfig, "production", "", "", false)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "secretsmanager", actual.Options.SecretsStore)
+	assert.Equal(t, map[string]string{"DB_PASSWORD": "", "API_KEY": ""}, actual.Options.Secrets)
+
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: test
+
+secrets_store: vault
+`
+
+	_, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigDockerScan(t *testing.T) {
+	yamlConfig = `---
+pipeline:
+  - type: docker
+    scan:
+      fail_on: HIGH
+      timeout: 5m
+      ignore:
+        - id: CVE-2021-1
+          expires: 2021-07-01
+          reason: Not exploitable
+`
+
+	actual, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.Nil(t, err)
+
+	expected := ScanOptions{
+		FailOn: "HIGH",
+		Ignore: []IgnoredFinding{
+			{ID: "CVE-2021-1", Expires: time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC), Reason: "Not exploitable"},
+		},
+		Wait: WaitOptions{Timeout: Duration(5 * time.Minute)},
+	}
+
+	assert.Equal(t, expected, actual.Options.Pipeline[0].Docker.Scan)
+}
+
+func TestLoadConfigPinDigest(t *testing.T) {
+	yamlConfig = `---
+pipeline:
+  - type: script
+    inline: "true"
+
+pin_digest: true
+
+environments:
+  staging:
+    pin_digest: false
+  production: {}
+`
+
+	actual, err := LoadConfig(yamlConfig, "staging", "", "", false)
+	assert.Nil(t, err)
+	assert.False(t, *actual.Options.PinDigest)
+
+	actual, err = LoadConfig(yamlConfig, "production", "", "", false)
+	assert.Nil(t, err)
+	assert.True(t, *actual.Options.PinDigest)
+}
@@ -1,15 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/ecs"
-	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/sts"
 )
 
@@ -19,10 +18,29 @@ type Definition struct {
 	Tag                  string              `yaml:"tag"`
 	TaskRoleName         string              `yaml:"task_role_name"`
 	VolumeName           string              `yaml:"volume_name"`
+	Volumes              []Volume            `yaml:"volumes"`
 	Containers           []Container         `yaml:"containers"`
 	CPU                  int                 `yaml:"cpu"`
 	Memory               int                 `yaml:"memory"`
 	PlacementConstraints []map[string]string `yaml:"placement_constraints"`
+	RuntimePlatform      RuntimePlatform     `yaml:"runtime_platform"`
+
+	// Logging configures logging for containers that don't set their own
+	Logging Logging `yaml:"logging"`
+
+	// IAM configures a task role that flecs creates and manages, instead of
+	// using an existing task_role_name
+	IAM IAMRole `yaml:"iam"`
+
+	// name is the name of the definition in the configuration
+	name string
+}
+
+// RuntimePlatform sets the CPU architecture and operating system that tasks
+// run on, such as ARM64 to run on Graviton
+type RuntimePlatform struct {
+	CPUArchitecture       string `yaml:"cpu_architecture"`
+	OperatingSystemFamily string `yaml:"operating_system_family"`
 }
 
 // Container sets up a container definition
@@ -31,9 +49,34 @@ type Container struct {
 	Essential   bool         `yaml:"essential"`
 	HealthCheck HealthCheck  `yaml:"healthcheck"`
 	Image       string       `yaml:"image"`
+	Logging     Logging      `yaml:"logging"`
 	MountPoints []MountPoint `yaml:"mount_points"`
 	Name        string       `yaml:"name"`
 	VolumesFrom []VolumeFrom `yaml:"volumes_from"`
+
+	// PortMappings expose container ports, such as to a load balancer
+	PortMappings []PortMapping `yaml:"port_mappings"`
+
+	// DependsOn are containers that must reach a condition before this
+	// container starts
+	DependsOn []ContainerDependency `yaml:"depends_on"`
+
+	// StartTimeout and StopTimeout are in seconds. StartTimeout is how long
+	// to wait for dependencies before giving up, and StopTimeout how long to
+	// wait before the container is killed if it doesn't exit
+	StartTimeout int64 `yaml:"start_timeout"`
+	StopTimeout  int64 `yaml:"stop_timeout"`
+
+	// RepositoryCredentials is the ARN of a Secrets Manager secret with the
+	// credentials to pull the image from a private registry other than ECR
+	RepositoryCredentials string `yaml:"repository_credentials"`
+}
+
+// ContainerDependency makes a container wait for another container to
+// START, COMPLETE, SUCCESS or be HEALTHY
+type ContainerDependency struct {
+	Container string `yaml:"container"`
+	Condition string `yaml:"condition"`
 }
 
 // HealthCheck is used to check the health of a container
@@ -52,20 +95,152 @@ type MountPoint struct {
 	SourceVolume  string `yaml:"source_volume"`
 }
 
+// PortMapping exposes a container port. HostPort defaults to the container
+// port, and Protocol to tcp
+type PortMapping struct {
+	ContainerPort int64  `yaml:"container_port"`
+	HostPort      int64  `yaml:"host_port"`
+	Protocol      string `yaml:"protocol"`
+}
+
 // VolumeFrom allows sharing a volume with another container
 type VolumeFrom struct {
 	ReadOnly        bool   `yaml:"read_only"`
 	SourceContainer string `yaml:"source_container"`
 }
 
+// validate checks the definition for configuration errors
+func (d Definition) validate(name string) (err error) {
+	if arch := d.RuntimePlatform.CPUArchitecture; arch != "" && !stringInSlice(arch, ecs.CPUArchitecture_Values()) {
+		return fmt.Errorf("definition %s: invalid cpu_architecture %s, must be one of %s", name, arch, strings.Join(ecs.CPUArchitecture_Values(), ", "))
+	}
+
+	if family := d.RuntimePlatform.OperatingSystemFamily; family != "" && !stringInSlice(family, ecs.OSFamily_Values()) {
+		return fmt.Errorf("definition %s: invalid operating_system_family %s", name, family)
+	}
+
+	if d.IAM.enabled() && d.TaskRoleName != "" {
+		return fmt.Errorf("definition %s: cannot set both iam and task_role_name", name)
+	}
+
+	err = d.IAM.validate()
+	if err != nil {
+		return fmt.Errorf("definition %s: iam: %s", name, err)
+	}
+
+	err = d.validateVolumes()
+	if err != nil {
+		return fmt.Errorf("definition %s: %s", name, err)
+	}
+
+	for _, container := range d.Containers {
+		if container.RepositoryCredentials != "" && !strings.HasPrefix(container.RepositoryCredentials, "arn:") {
+			return fmt.Errorf("definition %s: repository_credentials for container %s must be the ARN of a secret", name, container.Name)
+		}
+	}
+
+	err = d.validateDependencies()
+	if err != nil {
+		return fmt.Errorf("definition %s: %s", name, err)
+	}
+
+	err = d.validatePortMappings()
+	if err != nil {
+		return fmt.Errorf("definition %s: %s", name, err)
+	}
+
+	err = d.validateLogging()
+	if err != nil {
+		return fmt.Errorf("definition %s: %s", name, err)
+	}
+
+	return err
+}
+
+// validatePortMappings checks that each port mapping has a container port
+// and a valid protocol
+func (d Definition) validatePortMappings() (err error) {
+	for _, container := range d.Containers {
+		for _, mapping := range container.PortMappings {
+			if mapping.ContainerPort == 0 {
+				return fmt.Errorf("container %s: must specify container_port in port_mappings", container.Name)
+			}
+
+			if mapping.Protocol != "" && !stringInSlice(mapping.Protocol, ecs.TransportProtocol_Values()) {
+				return fmt.Errorf("container %s: invalid protocol %s, must be one of %s", container.Name, mapping.Protocol, strings.Join(ecs.TransportProtocol_Values(), ", "))
+			}
+		}
+	}
+
+	return err
+}
+
+// hasPortMapping returns true if the container maps the port
+func (d Definition) hasPortMapping(container string, port int64) bool {
+	for _, c := range d.Containers {
+		if c.Name != container {
+			continue
+		}
+
+		for _, mapping := range c.PortMappings {
+			if mapping.ContainerPort == port {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// validateDependencies checks that containers only depend on other
+// containers in the definition that can reach the condition
+func (d Definition) validateDependencies() (err error) {
+	containers := make(map[string]Container)
+	for _, container := range d.Containers {
+		containers[container.Name] = container
+	}
+
+	for _, container := range d.Containers {
+		for _, dependency := range container.DependsOn {
+			if !stringInSlice(dependency.Condition, ecs.ContainerCondition_Values()) {
+				return fmt.Errorf("invalid condition %q for dependency of container %s, must be one of %s", dependency.Condition, container.Name, strings.Join(ecs.ContainerCondition_Values(), ", "))
+			}
+
+			target, ok := containers[dependency.Container]
+			if !ok || dependency.Container == container.Name {
+				return fmt.Errorf("container %s depends on unknown container %q", container.Name, dependency.Container)
+			}
+
+			switch dependency.Condition {
+			case ecs.ContainerConditionHealthy:
+				if target.HealthCheck.Command == "" {
+					return fmt.Errorf("container %s depends on %s being healthy, but %s has no healthcheck", container.Name, target.Name, target.Name)
+				}
+			case ecs.ContainerConditionComplete, ecs.ContainerConditionSuccess:
+				if d.essential(target) {
+					return fmt.Errorf("container %s depends on %s exiting, so %s cannot be essential", container.Name, target.Name, target.Name)
+				}
+			}
+		}
+	}
+
+	return err
+}
+
+// essential returns whether the task stops when the container stops. A
+// container on its own is always essential
+func (d Definition) essential(container Container) bool {
+	return len(d.Containers) == 1 || container.Essential
+}
+
 // Create registers a new task definition, and creates any resources if they
 // do not exist
-func (d Definition) Create(c Clients, cfg Config, name string) (arn string, err error) {
+func (d Definition) Create(ctx context.Context, c Clients, cfg Config, name string) (arn string, err error) {
 	client := c.ECS
 	clientSTS := c.STS
 
 	// Fetch current account ID
-	getCallerIdentityOutput, err := clientSTS.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	getCallerIdentityOutput, err := clientSTS.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
 	if err != nil {
 		return arn, err
 	}
@@ -79,25 +254,55 @@ func (d Definition) Create(c Clients, cfg Config, name string) (arn string, err
 	}
 
 	if d.ExecutionRoleName == "" {
-		executionRoleArn, err = d.createDefaultExecutionRole(c)
+		executionRoleArn, err = createExecutionRole(ctx, c, cfg, accountID)
 		if err != nil {
 			return arn, err
 		}
 	}
 
-	// Generate task role arn
+	// Generate task role arn, creating the role if flecs manages it
 	var taskRoleArn string
-	if d.ExecutionRoleName != "" {
+	if d.TaskRoleName != "" {
 		taskRoleArn = fmt.Sprintf("arn:aws:iam::%s:role/%s", accountID, d.TaskRoleName)
 	}
 
+	if d.IAM.enabled() {
+		role := d.IAM
+		if cfg.executeCommandEnabled(d.name) {
+			role.Statements = append(append([]PolicyStatement{}, role.Statements...), executeCommandStatement)
+		}
+
+		taskRoleArn, err = role.createTaskRole(ctx, c, cfg.taskRoleName(d.name))
+		if err != nil {
+			return arn, err
+		}
+	}
+
 	// Generate family name
 	family := strings.Join([]string{"flecs", name}, "-")
 	if cfg.EnvironmentName != "" {
 		family = strings.Join([]string{family, cfg.EnvironmentName}, "-")
 	}
 
-	err = d.createLogGroup(c, cfg.Options.LogGroupName)
+	// Only create log groups that awslogs sends logs to
+	for logGroupName, retentionDays := range d.logRetention(cfg, cfg.Options.LogGroupName) {
+		err = d.createLogGroup(ctx, c, cfg, logGroupName, retentionDays)
+		if err != nil {
+			return arn, err
+		}
+	}
+
+	// Refer to images by digest, so that the task definition always runs
+	// the same image even if the tag is pushed again
+	if aws.BoolValue(cfg.Options.PinDigest) {
+		d.Containers, err = d.pinImages(ctx, cfg)
+		if err != nil {
+			return arn, err
+		}
+	}
+
+	// Refer to secrets that flecs manages by their ARN
+	cfg.Options.Secrets, err = cfg.resolveSecretARNs(ctx, c, accountID)
 	if err != nil {
 		return arn, err
 	}
@@ -120,8 +325,9 @@ func (d Definition) Create(c Clients, cfg Config, name string) (arn string, err
 	}
 
 	// Volumes
-	volumes := []*ecs.Volume{
-		&ecs.Volume{Name: aws.String(d.VolumeName)},
+	var volumes []*ecs.Volume
+	for _, volume := range d.volumes() {
+		volumes = append(volumes, volume.ecsVolume())
 	}
 
 	var cpu, memory string
@@ -145,14 +351,31 @@ func (d Definition) Create(c Clients, cfg Config, name string) (arn string, err
 		Family:               aws.String(family),
 		NetworkMode:          aws.String("awsvpc"),
 		PlacementConstraints: placementConstraints,
-		TaskRoleArn:          aws.String(taskRoleArn),
 	}
 
-	if d.VolumeName != "" {
+	if taskRoleArn != "" {
+		registerTaskDefinitionInput.SetTaskRoleArn(taskRoleArn)
+	}
+
+	if len(volumes) > 0 {
 		registerTaskDefinitionInput.SetVolumes(volumes)
 	}
 
-	output, err := client.RegisterTaskDefinition(&registerTaskDefinitionInput)
+	if d.RuntimePlatform != (RuntimePlatform{}) {
+		runtimePlatform := ecs.RuntimePlatform{}
+
+		if d.RuntimePlatform.CPUArchitecture != "" {
+			runtimePlatform.SetCpuArchitecture(d.RuntimePlatform.CPUArchitecture)
+		}
+
+		if d.RuntimePlatform.OperatingSystemFamily != "" {
+			runtimePlatform.SetOperatingSystemFamily(d.RuntimePlatform.OperatingSystemFamily)
+		}
+
+		registerTaskDefinitionInput.SetRuntimePlatform(&runtimePlatform)
+	}
+
+	output, err := client.RegisterTaskDefinitionWithContext(ctx, &registerTaskDefinitionInput)
 	if err != nil {
 		return arn, err
 	}
@@ -181,22 +404,14 @@ func (d Definition) generateContainerDefinitions(cfg Config, logStreamPrefix, lo
 		})
 	}
 
-	// Log configuration
-	logConfiguration := ecs.LogConfiguration{
-		LogDriver: aws.String("awslogs"),
-		Options: aws.StringMap(map[string]string{
-			"awslogs-region":        cfg.Options.Region,
-			"awslogs-stream-prefix": logStreamPrefix,
-			"awslogs-group":         logGroupName,
-		}),
-	}
+	environmentFiles := cfg.s3EnvironmentFiles()
 
 	for _, container := range d.Containers {
 		// Set healthcheck options if they exist
-		var healthcheck ecs.HealthCheck
-		healthcheckCommand := strings.Split(container.HealthCheck.Command, " ")
-		if len(healthcheckCommand) > 0 {
-			healthcheck.SetCommand(aws.StringSlice(healthcheckCommand))
+		var healthcheck *ecs.HealthCheck
+		if container.HealthCheck.Command != "" {
+			healthcheck = &ecs.HealthCheck{}
+			healthcheck.SetCommand(aws.StringSlice(strings.Split(container.HealthCheck.Command, " ")))
 
 			if container.HealthCheck.Interval != 0 {
 				healthcheck.SetInterval(container.HealthCheck.Interval)
@@ -215,13 +430,6 @@ func (d Definition) generateContainerDefinitions(cfg Config, logStreamPrefix, lo
 			}
 		}
 
-		essential := false
-		if len(d.Containers) == 1 {
-			essential = true
-		} else {
-			essential = container.Essential
-		}
-
 		var mountPoints []*ecs.MountPoint
 		for _, mount := range container.MountPoints {
 			mountPoints = append(mountPoints, &ecs.MountPoint{
@@ -239,18 +447,61 @@ func (d Definition) generateContainerDefinitions(cfg Config, logStreamPrefix, lo
 			})
 		}
 
+		var portMappings []*ecs.PortMapping
+		for _, mapping := range container.PortMappings {
+			portMapping := ecs.PortMapping{ContainerPort: aws.Int64(mapping.ContainerPort)}
+
+			if mapping.HostPort != 0 {
+				portMapping.SetHostPort(mapping.HostPort)
+			}
+
+			if mapping.Protocol != "" {
+				portMapping.SetProtocol(mapping.Protocol)
+			}
+
+			portMappings = append(portMappings, &portMapping)
+		}
+
+		image, err := cfg.interpolate(container.Image)
+		if err != nil {
+			return def, err
+		}
+
 		containerDefinition := ecs.ContainerDefinition{
 			Environment:      environmentVariables,
-			Essential:        aws.Bool(essential),
-			Image:            aws.String(container.Image),
-			LogConfiguration: &logConfiguration,
+			EnvironmentFiles: environmentFiles,
+			Essential:        aws.Bool(d.essential(container)),
+			Image:            aws.String(image),
+			LogConfiguration: d.containerLogging(container.Name).logConfiguration(cfg, logStreamPrefix, logGroupName),
 			Name:             aws.String(container.Name),
 			Secrets:          secrets,
-			HealthCheck:      &healthcheck,
+			HealthCheck:      healthcheck,
 			MountPoints:      mountPoints,
+			PortMappings:     portMappings,
 			VolumesFrom:      volumesFrom,
 		}
 
+		if container.RepositoryCredentials != "" {
+			containerDefinition.RepositoryCredentials = &ecs.RepositoryCredentials{
+				CredentialsParameter: aws.String(container.RepositoryCredentials),
+			}
+		}
+
+		for _, dependency := range container.DependsOn {
+			containerDefinition.DependsOn = append(containerDefinition.DependsOn, &ecs.ContainerDependency{
+				Condition:     aws.String(dependency.Condition),
+				ContainerName: aws.String(dependency.Container),
+			})
+		}
+
+		if container.StartTimeout != 0 {
+			containerDefinition.SetStartTimeout(container.StartTimeout)
+		}
+
+		if container.StopTimeout != 0 {
+			containerDefinition.SetStopTimeout(container.StopTimeout)
+		}
+
 		if container.Command != "" {
 			containerDefinition.SetCommand(aws.StringSlice(strings.Split(container.Command, " ")))
 		}
@@ -258,94 +509,141 @@ func (d Definition) generateContainerDefinitions(cfg Config, logStreamPrefix, lo
 		def = append(def, &containerDefinition)
 	}
 
+	if d.usesLogDriver(ecs.LogDriverAwsfirelens) {
+		def = append(def, d.logRouterDefinition(cfg, logStreamPrefix, logGroupName))
+	}
+
 	return def, err
 }
 
-func (d Definition) createDefaultExecutionRole(c Clients) (roleArn string, err error) {
-	clientIAM := c.IAM
-
-	defaultExecutionRoleName := "FlecsDefaultExecutionRole"
+// createLogGroup creates the log group if it doesn't already exist, and
+// applies the configured retention, encryption and tags to it
+func (d Definition) createLogGroup(ctx context.Context, c Clients, cfg Config, logGroupName string, retentionDays int64) (err error) {
+	client := c.CloudWatchLogs
 
-	getRoleOutput, err := clientIAM.GetRole(&iam.GetRoleInput{
-		RoleName: aws.String(defaultExecutionRoleName),
-	})
+	logGroup, err := describeLogGroup(ctx, c, logGroupName)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case iam.ErrCodeNoSuchEntityException:
-				Log.Info("Creating default execution role")
-			default:
-				return roleArn, aerr
-			}
-		} else {
-			return roleArn, aerr
+		return err
+	}
+
+	if logGroup == nil {
+		createLogGroupInput := cloudwatchlogs.CreateLogGroupInput{
+			LogGroupName: aws.String(logGroupName),
+		}
+
+		if cfg.Options.LogKMSKeyID != "" {
+			createLogGroupInput.SetKmsKeyId(cfg.Options.LogKMSKeyID)
+		}
+
+		if len(cfg.Options.LogGroupTags) > 0 {
+			createLogGroupInput.SetTags(aws.StringMap(cfg.Options.LogGroupTags))
+		}
+
+		_, err = client.CreateLogGroupWithContext(ctx, &createLogGroupInput)
+		if err != nil {
+			return err
+		}
+
+		Log.Infof("Created log group %s", logGroupName)
+		logGroup = &cloudwatchlogs.LogGroup{
+			LogGroupName: aws.String(logGroupName),
+			KmsKeyId:     createLogGroupInput.KmsKeyId,
 		}
 	} else {
-		return aws.StringValue(getRoleOutput.Role.Arn), err
-	}
-
-	assumeRolePolicy := `{
-  "Version": "2012-10-17",
-  "Statement": [
-    {
-      "Sid": "",
-      "Effect": "Allow",
-      "Principal": {
-        "Service": "ecs-tasks.amazonaws.com"
-      },
-      "Action": "sts:AssumeRole"
-    }
-  ]
-}`
-
-	createRoleOutput, err := clientIAM.CreateRole(&iam.CreateRoleInput{
-		RoleName:                 aws.String("FlecsDefaultExecutionRole"),
-		AssumeRolePolicyDocument: aws.String(assumeRolePolicy),
-	})
-	if err != nil {
-		return roleArn, err
+		err = updateLogGroupTags(ctx, c, logGroupName, cfg.Options.LogGroupTags)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = clientIAM.AttachRolePolicy(&iam.AttachRolePolicyInput{
-		PolicyArn: aws.String("aws:iam::aws:policy/service-role/AmazonECSTaskExecutionRolePolicy"),
-		RoleName:  createRoleOutput.Role.RoleName,
-	})
-	if err != nil {
-		return roleArn, err
+	if retentionDays != 0 && aws.Int64Value(logGroup.RetentionInDays) != retentionDays {
+		_, err = client.PutRetentionPolicyWithContext(ctx, &cloudwatchlogs.PutRetentionPolicyInput{
+			LogGroupName:    aws.String(logGroupName),
+			RetentionInDays: aws.Int64(retentionDays),
+		})
+		if err != nil {
+			return err
+		}
+
+		Log.Infof("Set retention of log group %s to %d days", logGroupName, retentionDays)
 	}
 
-	Log.Infof("Created role %s", defaultExecutionRoleName)
+	if cfg.Options.LogKMSKeyID != "" && aws.StringValue(logGroup.KmsKeyId) != cfg.Options.LogKMSKeyID {
+		_, err = client.AssociateKmsKeyWithContext(ctx, &cloudwatchlogs.AssociateKmsKeyInput{
+			KmsKeyId:     aws.String(cfg.Options.LogKMSKeyID),
+			LogGroupName: aws.String(logGroupName),
+		})
+		if err != nil {
+			return err
+		}
 
-	return aws.StringValue(createRoleOutput.Role.Arn), err
-}
+		Log.Infof("Encrypted log group %s with %s", logGroupName, cfg.Options.LogKMSKeyID)
+	}
 
-// createLogGroup only creates the log group if it doesn't already exist
-func (d Definition) createLogGroup(c Clients, logGroupName string) (err error) {
-	client := c.CloudWatchLogs
+	return err
+}
 
-	describeLogGroupsInput := cloudwatchlogs.DescribeLogGroupsInput{
+// describeLogGroup returns the log group with exactly the name, or nil if it
+// doesn't exist. Log groups can only be looked up by prefix, so other groups
+// starting with the same name are ignored
+func describeLogGroup(ctx context.Context, c Clients, logGroupName string) (logGroup *cloudwatchlogs.LogGroup, err error) {
+	input := cloudwatchlogs.DescribeLogGroupsInput{
 		LogGroupNamePrefix: aws.String(logGroupName),
 	}
 
-	// Check if it exists already
-	resp, err := client.DescribeLogGroups(&describeLogGroupsInput)
-	if err != nil {
-		return err
+	for {
+		resp, err := c.CloudWatchLogs.DescribeLogGroupsWithContext(ctx, &input)
+		if err != nil {
+			return logGroup, err
+		}
+
+		for _, group := range resp.LogGroups {
+			if aws.StringValue(group.LogGroupName) == logGroupName {
+				return group, err
+			}
+		}
+
+		if resp.NextToken == nil {
+			return logGroup, err
+		}
+
+		input.NextToken = resp.NextToken
 	}
+}
 
-	if len(resp.LogGroups) > 0 {
+// updateLogGroupTags adds any tags that are missing or different on an
+// existing log group. Other tags are left alone
+func updateLogGroupTags(ctx context.Context, c Clients, logGroupName string, tags map[string]string) (err error) {
+	if len(tags) == 0 {
 		return err
 	}
 
-	createLogGroupInput := cloudwatchlogs.CreateLogGroupInput{
+	resp, err := c.CloudWatchLogs.ListTagsLogGroupWithContext(ctx, &cloudwatchlogs.ListTagsLogGroupInput{
 		LogGroupName: aws.String(logGroupName),
+	})
+	if err != nil {
+		return err
+	}
+
+	changed := make(map[string]string)
+	for key, value := range tags {
+		if aws.StringValue(resp.Tags[key]) != value {
+			changed[key] = value
+		}
 	}
 
-	_, err = client.CreateLogGroup(&createLogGroupInput)
+	if len(changed) == 0 {
+		return err
+	}
+
+	_, err = c.CloudWatchLogs.TagLogGroupWithContext(ctx, &cloudwatchlogs.TagLogGroupInput{
+		LogGroupName: aws.String(logGroupName),
+		Tags:         aws.StringMap(changed),
+	})
 	if err != nil {
 		return err
 	}
 
-	Log.Infof("Created log group %s", logGroupName)
+	Log.Infof("Tagged log group %s", logGroupName)
 	return err
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefinitionValidateDependencies(t *testing.T) {
+	definition := Definition{
+		Containers: []Container{
+			{Name: "envoy", Essential: true, HealthCheck: HealthCheck{Command: "CMD-SHELL curl -f localhost:9901/ready"}},
+			{Name: "migrate"},
+			{Name: "app", Essential: true, DependsOn: []ContainerDependency{
+				{Container: "envoy", Condition: "HEALTHY"},
+				{Container: "migrate", Condition: "SUCCESS"},
+			}},
+		},
+	}
+
+	assert.Nil(t, definition.validateDependencies())
+
+	definition.Containers[2].DependsOn[0].Condition = "READY"
+	assert.NotNil(t, definition.validateDependencies())
+
+	definition.Containers[2].DependsOn[0] = ContainerDependency{Container: "proxy", Condition: "START"}
+	assert.NotNil(t, definition.validateDependencies())
+
+	definition.Containers[2].DependsOn[0] = ContainerDependency{Container: "migrate", Condition: "HEALTHY"}
+	assert.NotNil(t, definition.validateDependencies())
+
+	definition.Containers[2].DependsOn[0] = ContainerDependency{Container: "envoy", Condition: "COMPLETE"}
+	assert.NotNil(t, definition.validateDependencies())
+}
+
+func TestGenerateContainerDefinitions(t *testing.T) {
+	definition := Definition{
+		Containers: []Container{
+			{Name: "envoy", Image: "envoy", Essential: true, HealthCheck: HealthCheck{Command: "CMD-SHELL true", Retries: 3}},
+			{Name: "app", Image: "app:v1", Essential: true, StartTimeout: 120, StopTimeout: 30, DependsOn: []ContainerDependency{
+				{Container: "envoy", Condition: "HEALTHY"},
+			}, PortMappings: []PortMapping{{ContainerPort: 8080}, {ContainerPort: 8125, Protocol: "udp"}}},
+		},
+	}
+
+	def, err := definition.generateContainerDefinitions(Config{}, "web", "flecs")
+	assert.Nil(t, err)
+	assert.Len(t, def, 2)
+
+	assert.Equal(t, &ecs.HealthCheck{Command: aws.StringSlice([]string{"CMD-SHELL", "true"}), Retries: aws.Int64(3)}, def[0].HealthCheck)
+	assert.Nil(t, def[0].DependsOn)
+
+	assert.Nil(t, def[1].HealthCheck)
+	assert.Equal(t, "app:v1", aws.StringValue(def[1].Image))
+	assert.Equal(t, []*ecs.ContainerDependency{{ContainerName: aws.String("envoy"), Condition: aws.String("HEALTHY")}}, def[1].DependsOn)
+	assert.Equal(t, int64(120), aws.Int64Value(def[1].StartTimeout))
+	assert.Equal(t, int64(30), aws.Int64Value(def[1].StopTimeout))
+	assert.Equal(t, []*ecs.PortMapping{
+		{ContainerPort: aws.Int64(8080)},
+		{ContainerPort: aws.Int64(8125), Protocol: aws.String("udp")},
+	}, def[1].PortMappings)
+}
+
+func TestCreateLogGroup(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Options: ConfigOptions{
+		LogKMSKeyID:  "arn:aws:kms:eu-west-1:123456789012:key/abc",
+		LogGroupTags: map[string]string{"team": "web"},
+	}}
+
+	// Only a group with a longer name exists, so the group is created
+	var calls []string
+	clients := Clients{CloudWatchLogs: mockedCloudWatchLogsClient{
+		DescribeLogGroupsResp: cloudwatchlogs.DescribeLogGroupsOutput{
+			LogGroups: []*cloudwatchlogs.LogGroup{{LogGroupName: aws.String("/flecs/api-admin")}},
+		},
+		Calls: &calls,
+	}}
+
+	err := Definition{}.createLogGroup(ctx, clients, cfg, "/flecs/api", 30)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CreateLogGroup", "PutRetentionPolicy"}, calls)
+
+	// An existing group is updated with anything that is different
+	calls = nil
+	clients.CloudWatchLogs = mockedCloudWatchLogsClient{
+		DescribeLogGroupsResp: cloudwatchlogs.DescribeLogGroupsOutput{
+			LogGroups: []*cloudwatchlogs.LogGroup{{LogGroupName: aws.String("/flecs/api")}},
+		},
+		ListTagsLogGroupResp: cloudwatchlogs.ListTagsLogGroupOutput{Tags: aws.StringMap(map[string]string{"team": "api"})},
+		Calls:                &calls,
+	}
+
+	err = Definition{}.createLogGroup(ctx, clients, cfg, "/flecs/api", 30)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"TagLogGroup", "PutRetentionPolicy", "AssociateKmsKey"}, calls)
+
+	// Nothing is changed if the group is already configured
+	calls = nil
+	clients.CloudWatchLogs = mockedCloudWatchLogsClient{
+		DescribeLogGroupsResp: cloudwatchlogs.DescribeLogGroupsOutput{
+			LogGroups: []*cloudwatchlogs.LogGroup{{
+				LogGroupName:    aws.String("/flecs/api"),
+				RetentionInDays: aws.Int64(30),
+				KmsKeyId:        aws.String("arn:aws:kms:eu-west-1:123456789012:key/abc"),
+			}},
+		},
+		ListTagsLogGroupResp: cloudwatchlogs.ListTagsLogGroupOutput{Tags: aws.StringMap(map[string]string{"team": "web"})},
+		Calls:                &calls,
+	}
+
+	err = Definition{}.createLogGroup(ctx, clients, cfg, "/flecs/api", 30)
+	assert.Nil(t, err)
+	assert.Nil(t, calls)
+}
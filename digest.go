@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// dockerHubRegistry is the registry that Docker Hub images are pulled from,
+// and dockerHubAuthKey is where its credentials are saved by docker login
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+	dockerHubAuthKey  = "https://index.docker.io/v1/"
+)
+
+var ecrRegistryRe = regexp.MustCompile(`^(\d{12})\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// manifestMediaTypes are the manifest types we accept when looking up a
+// digest. Multi-platform images are pinned by their manifest list
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// ImageReference is an image split into its parts, such as
+// "nginx:1.19" or "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:abc"
+type ImageReference struct {
+	// Name is the image without a tag or digest, as it was written
+	Name       string
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseImageReference splits an image into its registry, repository and tag
+// or digest, using the same defaults as Docker
+func parseImageReference(image string) (ref ImageReference) {
+	ref.Name = image
+
+	if i := strings.Index(ref.Name, "@"); i >= 0 {
+		ref.Digest = ref.Name[i+1:]
+		ref.Name = ref.Name[:i]
+	}
+
+	// A tag comes after the last colon, unless that colon is part of a
+	// registry host and port
+	if i := strings.LastIndex(ref.Name, ":"); i > strings.LastIndex(ref.Name, "/") {
+		ref.Tag = ref.Name[i+1:]
+		ref.Name = ref.Name[:i]
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+
+	parts := strings.SplitN(ref.Name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry = parts[0]
+		ref.Repository = parts[1]
+	} else {
+		ref.Registry = dockerHubRegistry
+		ref.Repository = ref.Name
+	}
+
+	if ref.Registry == "docker.io" || ref.Registry == "index.docker.io" {
+		ref.Registry = dockerHubRegistry
+	}
+
+	if ref.Registry == dockerHubRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+
+	return ref
+}
+
+// Pinned returns the image referred to by digest
+func (ref ImageReference) Pinned(digest string) string {
+	return fmt.Sprintf("%s@%s", ref.Name, digest)
+}
+
+// pushedImageDigests returns the digests of images pushed by earlier docker
+// steps, by their image URI
+func (config Config) pushedImageDigests() (digests map[string]string) {
+	digests = make(map[string]string)
+
+	for _, outputs := range config.Outputs {
+		for name, uri := range outputs {
+			if !strings.HasSuffix(name, "image_uri") {
+				continue
+			}
+
+			digest := outputs[strings.TrimSuffix(name, "image_uri")+"image_digest"]
+			if digest != "" {
+				digests[uri] = digest
+			}
+		}
+	}
+
+	return digests
+}
+
+// pinImages returns the containers with each image referred to by digest.
+// Images pushed by earlier docker steps use the digest we already know
+// about, and any others are looked up in their registry
+func (d Definition) pinImages(ctx context.Context, cfg Config) (containers []Container, err error) {
+	pushed := cfg.pushedImageDigests()
+
+	for _, container := range d.Containers {
+		image, err := cfg.interpolate(container.Image)
+		if err != nil {
+			return containers, err
+		}
+
+		ref := parseImageReference(image)
+
+		digest := ref.Digest
+		if digest == "" {
+			digest = pushed[image]
+		}
+
+		if digest == "" {
+			digest, err = resolveImageDigest(ctx, cfg, container, ref)
+			if err != nil {
+				return containers, fmt.Errorf("cannot find digest for image %s: %s", image, err)
+			}
+		}
+
+		container.Image = ref.Pinned(digest)
+		Log.Infof("Pinned image %s to %s", image, container.Image)
+
+		containers = append(containers, container)
+	}
+
+	return containers, err
+}
+
+// resolveImageDigest looks up the digest of a tagged image, using the ECR
+// API for ECR images, and the registry API for anything else
+func resolveImageDigest(ctx context.Context, cfg Config, container Container, ref ImageReference) (digest string, err error) {
+	if match := ecrRegistryRe.FindStringSubmatch(ref.Registry); match != nil {
+		return resolveECRImageDigest(ctx, cfg, match[1], match[2], ref)
+	}
+
+	auth, err := cfg.registryAuth(ctx, container, ref)
+	if err != nil {
+		return digest, err
+	}
+
+	return resolveRegistryImageDigest(ctx, ref, auth)
+}
+
+// registryAuth returns the credentials to look up an image with. These are
+// the container's repository_credentials, then the credentials of a docker
+// step that pushes to the same registry, and then any saved by docker login
+func (cfg Config) registryAuth(ctx context.Context, container Container, ref ImageReference) (auth RegistryAuth, err error) {
+	if container.RepositoryCredentials != "" {
+		client := NewClient(cfg)
+		if parts := strings.Split(container.RepositoryCredentials, ":"); len(parts) > 3 && parts[3] != "" {
+			client.Region = parts[3]
+		}
+
+		clients, err := client.InitClients()
+		if err != nil {
+			return auth, err
+		}
+
+		return repositoryCredentialsAuth(ctx, clients, container.RepositoryCredentials, ref.Registry)
+	}
+
+	for _, step := range cfg.Options.Pipeline {
+		registry := step.Docker.Registry
+		if registry.URL != "" && parseImageReference(registry.URL+"/image").Registry == ref.Registry {
+			return registry.Auth(ctx)
+		}
+	}
+
+	return RegistryOptions{URL: ref.Registry}.Auth(ctx)
+}
+
+// repositoryCredentialsAuth reads credentials from a Secrets Manager secret,
+// in the format ECS uses for repository credentials
+func repositoryCredentialsAuth(ctx context.Context, clients Clients, secretARN, registry string) (auth RegistryAuth, err error) {
+	resp, err := clients.SecretsManager.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretARN),
+	})
+	if err != nil {
+		return auth, fmt.Errorf("cannot read repository credentials %s: %s", secretARN, err)
+	}
+
+	err = json.Unmarshal([]byte(aws.StringValue(resp.SecretString)), &auth)
+	if err != nil || auth.Username == "" || auth.Password == "" {
+		return auth, fmt.Errorf("repository credentials %s must contain a username and password", secretARN)
+	}
+
+	auth.ServerAddress = registry
+	return auth, nil
+}
+
+func resolveECRImageDigest(ctx context.Context, cfg Config, registryID, region string, ref ImageReference) (digest string, err error) {
+	client := NewClient(cfg)
+	client.Region = region
+
+	clients, err := client.InitClients()
+	if err != nil {
+		return digest, err
+	}
+
+	resp, err := clients.ECR.BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+		AcceptedMediaTypes: aws.StringSlice(manifestMediaTypes),
+		ImageIds: []*ecr.ImageIdentifier{
+			{ImageTag: aws.String(ref.Tag)},
+		},
+		RegistryId:     aws.String(registryID),
+		RepositoryName: aws.String(ref.Repository),
+	})
+	if err != nil {
+		return digest, err
+	}
+
+	if len(resp.Images) < 1 {
+		if len(resp.Failures) > 0 {
+			return digest, fmt.Errorf("%s", aws.StringValue(resp.Failures[0].FailureReason))
+		}
+
+		return digest, fmt.Errorf("image not found")
+	}
+
+	return aws.StringValue(resp.Images[0].ImageId.ImageDigest), err
+}
+
+// resolveRegistryImageDigest asks the registry for the manifest digest,
+// requesting a token with the credentials if the registry asks for one
+func resolveRegistryImageDigest(ctx context.Context, ref ImageReference, auth RegistryAuth) (digest string, err error) {
+	digest, err = registryManifestDigest(ctx, ref, auth)
+	if err == nil && digest == "" {
+		return digest, fmt.Errorf("image not found")
+	}
+
+	return digest, err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImageReference(t *testing.T) {
+	references := map[string]ImageReference{
+		"nginx": ImageReference{
+			Name:       "nginx",
+			Registry:   dockerHubRegistry,
+			Repository: "library/nginx",
+			Tag:        "latest",
+		},
+		"surminus/app:1.0": ImageReference{
+			Name:       "surminus/app",
+			Registry:   dockerHubRegistry,
+			Repository: "surminus/app",
+			Tag:        "1.0",
+		},
+		"localhost:5000/app": ImageReference{
+			Name:       "localhost:5000/app",
+			Registry:   "localhost:5000",
+			Repository: "app",
+			Tag:        "latest",
+		},
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/app:abc": ImageReference{
+			Name:       "123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/app",
+			Registry:   "123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+			Repository: "team/app",
+			Tag:        "abc",
+		},
+		"docker.io/surminus/app:1.0": ImageReference{
+			Name:       "docker.io/surminus/app",
+			Registry:   dockerHubRegistry,
+			Repository: "surminus/app",
+			Tag:        "1.0",
+		},
+		"ghcr.io/org/app@sha256:def": ImageReference{
+			Name:       "ghcr.io/org/app",
+			Registry:   "ghcr.io",
+			Repository: "org/app",
+			Digest:     "sha256:def",
+		},
+	}
+
+	for image, expected := range references {
+		assert.Equal(t, expected, parseImageReference(image), image)
+	}
+
+	assert.Equal(t, "localhost:5000/app@sha256:abc", parseImageReference("localhost:5000/app:v1").Pinned("sha256:abc"))
+}
+
+func TestPushedImageDigests(t *testing.T) {
+	cfg := Config{
+		Outputs: map[string]Outputs{
+			"build": Outputs{
+				"image_uri":    "registry/app:abc",
+				"image_digest": "sha256:app",
+			},
+			"tests": Outputs{
+				"exit_code": "0",
+			},
+		},
+	}
+
+	expected := map[string]string{
+		"registry/app:abc": "sha256:app",
+	}
+
+	assert.Equal(t, expected, cfg.pushedImageDigests())
+}
+
+func TestResolveRegistryImageDigest(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			assert.Equal(t, "repository:team/app:pull", r.URL.Query().Get("scope"))
+			fmt.Fprint(w, `{"token": "secret"}`)
+
+		case r.Header.Get("Authorization") != "Bearer secret":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:team/app:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+
+		case r.Method == http.MethodHead && r.URL.Path == "/v2/team/app/manifests/v1":
+			w.Header().Set("Docker-Content-Digest", "sha256:abc")
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	digest, err := resolveRegistryImageDigest(context.Background(), parseImageReference(registry+"/team/app:v1"), RegistryAuth{})
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:abc", digest)
+
+	_, err = resolveRegistryImageDigest(context.Background(), parseImageReference(registry+"/team/app:v2"), RegistryAuth{})
+	assert.NotNil(t, err)
+}
+
+func TestResolveImageDigestWithCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "deploy" || password != "hunter2" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Docker-Content-Digest", "sha256:abc")
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	ref := parseImageReference(registry + "/team/app:v1")
+
+	os.Setenv("FLECS_TEST_REGISTRY_USER", "deploy")
+	os.Setenv("FLECS_TEST_REGISTRY_PASSWORD", "hunter2")
+	defer os.Unsetenv("FLECS_TEST_REGISTRY_USER")
+	defer os.Unsetenv("FLECS_TEST_REGISTRY_PASSWORD")
+
+	// Credentials come from a docker step that pushes to the same registry
+	cfg := Config{Options: ConfigOptions{Pipeline: []Step{
+		{Docker: DockerStep{Registry: RegistryOptions{
+			URL:         registry,
+			UsernameEnv: "FLECS_TEST_REGISTRY_USER",
+			PasswordEnv: "FLECS_TEST_REGISTRY_PASSWORD",
+		}}},
+	}}}
+
+	digest, err := resolveImageDigest(context.Background(), cfg, Container{}, ref)
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:abc", digest)
+
+	// Without them the registry turns us away
+	_, err = resolveImageDigest(context.Background(), Config{}, Container{}, ref)
+	assert.NotNil(t, err)
+}
+
+func TestRepositoryCredentialsAuth(t *testing.T) {
+	arn := "arn:aws:secretsmanager:eu-west-1:123456789012:secret:registry-abc123"
+	clients := Clients{SecretsManager: mockedSecretsManagerClient{Secrets: map[string]string{
+		arn: `{"username": "deploy", "password": "hunter2"}`,
+	}}}
+
+	auth, err := repositoryCredentialsAuth(context.Background(), clients, arn, "ghcr.io")
+	assert.Nil(t, err)
+	assert.Equal(t, RegistryAuth{Username: "deploy", Password: "hunter2", ServerAddress: "ghcr.io"}, auth)
+
+	_, err = repositoryCredentialsAuth(context.Background(), clients, arn+"-missing", "ghcr.io")
+	assert.NotNil(t, err)
+}
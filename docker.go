@@ -1,13 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
+	"reflect"
 	"strings"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -16,113 +16,568 @@ import (
 )
 
 // DockerStep represents the docker step, that builds and pushes Docker
-// images. For simplicity we're just going to wrap Docker commands so it
-// just needs to be installed.
+// images. By default it wraps Docker commands, so Docker just needs to be
+// installed, but images can also be built with the Docker Engine API or
+// pushed from an OCI archive.
 type DockerStep struct {
 	Dockerfile string     `yaml:"dockerfile"`
-	Repository string     `yaml:"repository"`
-	Args       DockerArgs `yaml:"args"`
+	Repository Repository `yaml:"repository"`
+	OCIArchive string     `yaml:"oci_archive"`
+	Args       DockerArgs `yaml:",inline"`
+
+	// Builder is the backend used to build and push images: "cli" (the
+	// default), "engine" or "oci"
+	Builder string `yaml:"builder"`
+
+	// SkipIfExists skips building and pushing an image if the tag is
+	// already in the repository
+	SkipIfExists bool `yaml:"skip_if_exists"`
+
+	// Promote tags an image that has already been pushed, instead of
+	// building one
+	Promote DockerPromote `yaml:"promote"`
+
+	// Scan fails the step if the image scan finds vulnerabilities
+	Scan ScanOptions `yaml:"scan"`
+
+	// Registry pushes images to a registry other than ECR
+	Registry RegistryOptions `yaml:"registry"`
+
+	// Images builds several images in one step. Anything not set on an
+	// image is taken from the step
+	Images []DockerImage `yaml:"images"`
 }
 
 // DockerArgs is a defined list of different arguments to pass to Docker
-type DockerArgs struct{}
+type DockerArgs struct {
+	BuildArgs map[string]string `yaml:"build_args"`
+	CacheFrom []string          `yaml:"cache_from"`
+	Context   string            `yaml:"context"`
+	Labels    map[string]string `yaml:"labels"`
+	Platform  string            `yaml:"platform"`
+	Platforms []string          `yaml:"platforms"`
+	Secrets   []string          `yaml:"secrets"`
+	SSH       []string          `yaml:"ssh"`
+	Target    string            `yaml:"target"`
+}
 
-// Run runs the Docker step stage
-func (d DockerStep) Run(c Client, cfg Config) (err error) {
-	clients, err := c.InitClients()
+// DockerImage is one of the images built by a docker step
+type DockerImage struct {
+	Name       string     `yaml:"name"`
+	Dockerfile string     `yaml:"dockerfile"`
+	Repository Repository `yaml:"repository"`
+	OCIArchive string     `yaml:"oci_archive"`
+	Args       DockerArgs `yaml:",inline"`
+}
+
+// DockerPromote retags an existing image, so that an environment can deploy
+// exactly the image that was tested in another
+type DockerPromote struct {
+	// From is the tag of the existing image, which defaults to the tag
+	// being deployed
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+}
+
+// ImageBuilder builds images and pushes them to a registry
+type ImageBuilder interface {
+	// Login sets the credentials used to push to a registry
+	Login(ctx context.Context, auth RegistryAuth) error
+
+	// Build builds an image, tagged as imageName
+	Build(ctx context.Context, cfg Config, imageName string, image DockerImage) error
+
+	// Push pushes an image that has been built
+	Push(ctx context.Context, cfg Config, imageName string, image DockerImage) error
+}
+
+// imageBuilders are the backends that can be chosen with "builder"
+var imageBuilders = []string{"cli", "engine", "oci"}
+
+// newImageBuilder returns the backend with the given name
+func newImageBuilder(name string) (builder ImageBuilder, err error) {
+	switch name {
+	case "", "cli":
+		return cliBuilder{}, err
+	case "engine":
+		return newEngineBuilder()
+	case "oci":
+		return newOCIBuilder(), err
+	}
+
+	return builder, fmt.Errorf("unknown builder %s, must be one of %s", name, strings.Join(imageBuilders, ", "))
+}
+
+// images returns each image the step builds. A step without images builds
+// a single image from its own options
+func (d DockerStep) images(cfg Config) (images []DockerImage, err error) {
+	if len(d.Images) == 0 {
+		repository := d.Repository
+		if repository.Name == "" {
+			repository.Name = cfg.ProjectName
+		}
+
+		images = append(images, DockerImage{
+			Dockerfile: d.Dockerfile,
+			Repository: repository,
+			OCIArchive: d.OCIArchive,
+			Args:       d.Args,
+		})
+
+		return images, err
+	}
+
+	names := make(map[string]bool)
+	for _, image := range d.Images {
+		if image.Name == "" {
+			return images, fmt.Errorf("must specify name for each image")
+		}
+
+		if names[image.Name] {
+			return images, fmt.Errorf("image %s is specified more than once", image.Name)
+		}
+		names[image.Name] = true
+
+		if image.Dockerfile == "" {
+			image.Dockerfile = d.Dockerfile
+		}
+
+		if image.Repository.Name == "" {
+			image.Repository.Name = fmt.Sprintf("%s-%s", cfg.ProjectName, image.Name)
+		}
+
+		image.Repository = image.Repository.merge(d.Repository)
+		image.Args = image.Args.merge(d.Args)
+		images = append(images, image)
+	}
+
+	return images, err
+}
+
+// validate checks the options of the step
+func (d DockerStep) validate() (err error) {
+	if d.Builder != "" && !stringInSlice(d.Builder, imageBuilders) {
+		return fmt.Errorf("invalid builder %s, must be one of %s", d.Builder, strings.Join(imageBuilders, ", "))
+	}
+
+	err = d.Scan.validate()
 	if err != nil {
 		return err
 	}
 
-	repository := d.Repository
-	if repository == "" {
-		repository = cfg.ProjectName
+	err = d.Registry.validate()
+	if err != nil {
+		return err
+	}
+
+	// Anything that uses the ECR API can't be used with other registries
+	if d.Registry.URL != "" {
+		if len(d.Promote.To) > 0 {
+			return fmt.Errorf("promote can only be used with ECR")
+		}
+
+		if d.Scan.enabled() {
+			return fmt.Errorf("scan can only be used with ECR")
+		}
+	}
+
+	repositories := []Repository{d.Repository}
+	for _, image := range d.Images {
+		repositories = append(repositories, image.Repository)
+	}
+
+	for _, repository := range repositories {
+		err = repository.validate()
+		if err != nil {
+			return err
+		}
+
+		if d.Registry.URL != "" && !reflect.DeepEqual(repository, Repository{Name: repository.Name}) {
+			return fmt.Errorf("repository settings can only be used with ECR")
+		}
+	}
+
+	return err
+}
+
+// merge returns the arguments, using values from defaults for anything that
+// has not been set
+func (a DockerArgs) merge(defaults DockerArgs) DockerArgs {
+	if a.BuildArgs == nil {
+		a.BuildArgs = defaults.BuildArgs
+	}
+
+	if a.CacheFrom == nil {
+		a.CacheFrom = defaults.CacheFrom
+	}
+
+	if a.Context == "" {
+		a.Context = defaults.Context
+	}
+
+	if a.Labels == nil {
+		a.Labels = defaults.Labels
+	}
+
+	if a.Platform == "" {
+		a.Platform = defaults.Platform
+	}
+
+	if a.Platforms == nil {
+		a.Platforms = defaults.Platforms
+	}
+
+	if a.Secrets == nil {
+		a.Secrets = defaults.Secrets
+	}
+
+	if a.SSH == nil {
+		a.SSH = defaults.SSH
+	}
+
+	if a.Target == "" {
+		a.Target = defaults.Target
+	}
+
+	return a
+}
+
+// multiPlatform returns true if the image is built for several platforms,
+// which is done with buildx so that it can be pushed as a manifest list
+func (a DockerArgs) multiPlatform() bool {
+	return len(a.Platforms) > 0
+}
+
+// outputPrefix returns the prefix for outputs of the image. Steps that
+// build several images publish outputs such as <name>_image_uri
+func (i DockerImage) outputPrefix() string {
+	if i.Name == "" {
+		return ""
 	}
 
-	gci, err := clients.STS.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	return i.Name + "_"
+}
+
+// Run runs the Docker step stage. It publishes the pushed image as the
+// image_uri output, and its digest as image_digest
+func (d DockerStep) Run(ctx context.Context, c Client, cfg Config) (outputs Outputs, err error) {
+	outputs = make(Outputs)
+
+	clients, err := c.InitClients()
 	if err != nil {
-		return err
+		return outputs, err
 	}
 
-	registryURI := fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", aws.StringValue(gci.Account), cfg.Options.ECRRegion)
-	imageName := fmt.Sprintf("%s/%s", registryURI, repository)
-	imageNameWithTag := fmt.Sprintf("%s:%s", imageName, cfg.Tag)
+	images, err := d.images(cfg)
+	if err != nil {
+		return outputs, err
+	}
 
-	// Build image
-	err = buildImage(imageNameWithTag)
+	builder, err := newImageBuilder(d.Builder)
 	if err != nil {
-		return err
+		return outputs, err
 	}
 
-	// Check ECR repository exists and create if it doesn't exist
-	arn, err := d.createRepository(clients, repository)
+	registry, err := d.registry(ctx, clients, cfg)
 	if err != nil {
-		return err
+		return outputs, err
+	}
+
+	if len(d.Promote.To) > 0 {
+		for _, image := range images {
+			err = d.promoteImage(ctx, clients, registry.URI(), cfg, image, outputs)
+			if err != nil {
+				return outputs, err
+			}
+		}
+
+		return outputs, err
+	}
+
+	// Every image is scanned, including any that are skipped
+	scanned := images
+
+	if d.SkipIfExists {
+		images, err = d.skipExistingImages(ctx, registry, cfg, images, outputs)
+		if err != nil {
+			return outputs, err
+		}
+
+		if len(images) == 0 {
+			return outputs, d.scanImages(ctx, clients, scanned, outputs)
+		}
+	}
+
+	// Build every image before pushing any of them
+	for _, image := range images {
+		imageNameWithTag := fmt.Sprintf("%s/%s:%s", registry.URI(), image.Repository.Name, cfg.Tag)
+
+		err = builder.Build(ctx, cfg, imageNameWithTag, image)
+		if err != nil {
+			return outputs, err
+		}
 	}
-	Log.Infof("Using repository: %s", arn)
 
-	// Authenticate with Docker
 	Log.Info("Authenticating...")
-	err = d.loginToECR(clients, registryURI)
+	auth, err := registry.Auth(ctx)
 	if err != nil {
-		return err
+		return outputs, err
 	}
 
-	// Push image to ECR
-	err = pushImage(imageNameWithTag)
+	// Without credentials, we rely on the builder already being logged in
+	if auth.Username != "" {
+		err = builder.Login(ctx, auth)
+		if err != nil {
+			return outputs, err
+		}
+	} else {
+		Log.Warnf("No credentials found for %s", registry.URI())
+	}
+
+	for _, image := range images {
+		imageNameWithTag := fmt.Sprintf("%s/%s:%s", registry.URI(), image.Repository.Name, cfg.Tag)
+
+		err = registry.Prepare(ctx, image.Repository)
+		if err != nil {
+			return outputs, err
+		}
+
+		err = builder.Push(ctx, cfg, imageNameWithTag, image)
+		if err != nil {
+			return outputs, err
+		}
+
+		digest, err := registry.Digest(ctx, image.Repository.Name, cfg.Tag)
+		if err != nil {
+			return outputs, err
+		}
+
+		if digest == "" {
+			return outputs, fmt.Errorf("cannot find pushed image %s", imageNameWithTag)
+		}
+
+		image.setOutputs(outputs, imageNameWithTag, digest)
+	}
+
+	err = d.scanImages(ctx, clients, scanned, outputs)
+	return outputs, err
+}
+
+// registry returns where images are pushed, which is ECR unless another
+// registry is configured
+func (d DockerStep) registry(ctx context.Context, clients Clients, cfg Config) (registry imageRegistry, err error) {
+	if d.Registry.URL != "" {
+		return d.Registry, err
+	}
+
+	gci, err := clients.STS.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
 	if err != nil {
-		return err
+		return registry, err
 	}
 
-	return err
+	registry = ecrRegistry{
+		clients: clients,
+		uri:     fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", aws.StringValue(gci.Account), cfg.Options.ECRRegion),
+	}
+
+	return registry, err
 }
 
-func buildImage(imageName string) (err error) {
-	buildArgs := []string{
-		"build",
-		"--tag",
-		imageName,
-		".",
+// scanImages checks the scan of each pushed image, if scan is configured
+func (d DockerStep) scanImages(ctx context.Context, clients Clients, images []DockerImage, outputs Outputs) (err error) {
+	if !d.Scan.enabled() {
+		return err
+	}
+
+	for _, image := range images {
+		err = d.Scan.checkImage(ctx, clients, image.Repository.Name, outputs[image.outputPrefix()+"image_digest"])
+		if err != nil {
+			return err
+		}
 	}
 
-	err = runDockerCommand(buildArgs)
 	return err
 }
 
-func pushImage(imageName string) (err error) {
-	pushArgs := []string{
-		"push",
-		imageName,
+// setOutputs publishes the URI and digest of the image
+func (i DockerImage) setOutputs(outputs Outputs, uri, digest string) {
+	outputs[i.outputPrefix()+"image_uri"] = uri
+	outputs[i.outputPrefix()+"image_digest"] = digest
+}
+
+// skipExistingImages returns the images that have not already been pushed
+// with the tag. Images that have been pushed still publish their outputs
+func (d DockerStep) skipExistingImages(ctx context.Context, registry imageRegistry, cfg Config, images []DockerImage, outputs Outputs) (remaining []DockerImage, err error) {
+	for _, image := range images {
+		digest, err := registry.Digest(ctx, image.Repository.Name, cfg.Tag)
+		if err != nil {
+			return remaining, err
+		}
+
+		if digest == "" {
+			remaining = append(remaining, image)
+			continue
+		}
+
+		imageNameWithTag := fmt.Sprintf("%s/%s:%s", registry.URI(), image.Repository.Name, cfg.Tag)
+		Log.Infof("Image %s already exists, skipping build", imageNameWithTag)
+
+		image.setOutputs(outputs, imageNameWithTag, digest)
 	}
 
-	err = runDockerCommand(pushArgs)
-	return err
+	return remaining, err
 }
 
-func (d DockerStep) loginToECR(clients Clients, registry string) (err error) {
-	result, err := clients.ECR.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+// promoteImage adds the promoted tags to an existing image, by putting its
+// manifest again with each tag. The image URI output uses the first tag
+func (d DockerStep) promoteImage(ctx context.Context, clients Clients, registryURI string, cfg Config, image DockerImage, outputs Outputs) (err error) {
+	from := d.Promote.From
+	if from == "" {
+		from = cfg.Tag
+	}
+
+	resp, err := clients.ECR.BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+		AcceptedMediaTypes: aws.StringSlice(manifestMediaTypes),
+		ImageIds: []*ecr.ImageIdentifier{
+			{ImageTag: aws.String(from)},
+		},
+		RepositoryName: aws.String(image.Repository.Name),
+	})
 	if err != nil {
 		return err
 	}
 
-	if len(result.AuthorizationData) < 1 {
-		return fmt.Errorf("Unable to get authorization data")
+	if len(resp.Images) < 1 {
+		if len(resp.Failures) > 0 {
+			failure := resp.Failures[0]
+			return fmt.Errorf("cannot get image %s:%s to promote: %s: %s", image.Repository.Name, from, aws.StringValue(failure.FailureCode), aws.StringValue(failure.FailureReason))
+		}
+
+		return fmt.Errorf("cannot find image %s:%s to promote", image.Repository.Name, from)
 	}
 
-	base64token := aws.StringValue(result.AuthorizationData[0].AuthorizationToken)
-	decodedToken, err := base64.StdEncoding.DecodeString(base64token)
+	source := resp.Images[0]
+
+	// Check the scan before promoting, so that vulnerable images don't reach
+	// production
+	if d.Scan.enabled() {
+		err = d.Scan.checkImage(ctx, clients, image.Repository.Name, aws.StringValue(source.ImageId.ImageDigest))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range d.Promote.To {
+		Log.Infof("Promoting %s:%s to %s", image.Repository.Name, from, tag)
+
+		_, err = clients.ECR.PutImageWithContext(ctx, &ecr.PutImageInput{
+			ImageManifest:          source.ImageManifest,
+			ImageManifestMediaType: source.ImageManifestMediaType,
+			ImageTag:               aws.String(tag),
+			RepositoryName:         aws.String(image.Repository.Name),
+		})
+		if err != nil {
+			// The tag already refers to this image
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeImageAlreadyExistsException {
+				continue
+			}
+
+			return err
+		}
+	}
+
+	imageNameWithTag := fmt.Sprintf("%s/%s:%s", registryURI, image.Repository.Name, d.Promote.To[0])
+	image.setOutputs(outputs, imageNameWithTag, aws.StringValue(source.ImageId.ImageDigest))
+
+	return err
+}
+
+// imageRegistry is where the docker step pushes images
+type imageRegistry interface {
+	// URI is the registry part of image names
+	URI() string
+
+	// Auth returns the credentials to push images
+	Auth(ctx context.Context) (RegistryAuth, error)
+
+	// Prepare gets a repository ready to push to
+	Prepare(ctx context.Context, repository Repository) error
+
+	// Digest returns the digest of a tagged image, or nothing if it doesn't
+	// exist
+	Digest(ctx context.Context, repository, tag string) (string, error)
+}
+
+// ecrRegistry pushes images to ECR in the current account
+type ecrRegistry struct {
+	clients Clients
+	uri     string
+}
+
+// URI returns the ECR registry
+func (r ecrRegistry) URI() string {
+	return r.uri
+}
+
+// Auth returns credentials from an ECR authorization token
+func (r ecrRegistry) Auth(ctx context.Context) (RegistryAuth, error) {
+	return ecrAuth(ctx, r.clients, r.uri)
+}
+
+// Prepare creates the repository if it doesn't exist, and applies its
+// settings
+func (r ecrRegistry) Prepare(ctx context.Context, repository Repository) (err error) {
+	arn, err := createRepository(ctx, r.clients, repository)
 	if err != nil {
 		return err
 	}
 
-	token := strings.Split(string(decodedToken), ":")[1]
+	Log.Infof("Using repository: %s", arn)
+	return err
+}
 
+// Digest returns the digest that ECR reports for a tagged image
+func (r ecrRegistry) Digest(ctx context.Context, repository, tag string) (digest string, err error) {
+	resp, err := r.clients.ECR.DescribeImagesWithContext(ctx, &ecr.DescribeImagesInput{
+		RepositoryName: aws.String(repository),
+		ImageIds: []*ecr.ImageIdentifier{
+			{ImageTag: aws.String(tag)},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case ecr.ErrCodeImageNotFoundException, ecr.ErrCodeRepositoryNotFoundException:
+				return digest, nil
+			}
+		}
+
+		return digest, err
+	}
+
+	if len(resp.ImageDetails) > 0 {
+		digest = aws.StringValue(resp.ImageDetails[0].ImageDigest)
+	}
+
+	return digest, err
+}
+
+// cliBuilder builds and pushes images by running the docker CLI, which
+// needs to be installed. Logging in stores credentials in the Docker config
+type cliBuilder struct{}
+
+// Login logs in to the registry with docker login
+func (b cliBuilder) Login(ctx context.Context, auth RegistryAuth) (err error) {
 	args := []string{
 		"login",
 		"--username",
-		"AWS",
+		auth.Username,
 		"--password-stdin",
-		registry,
+	}
+
+	// docker login uses Docker Hub if no registry is given
+	if auth.ServerAddress != dockerHubRegistry {
+		args = append(args, auth.ServerAddress)
 	}
 
 	path, err := exec.LookPath("docker")
@@ -130,95 +585,179 @@ func (d DockerStep) loginToECR(clients Clients, registry string) (err error) {
 		return err
 	}
 
-	command := exec.Cmd{
-		Path:   path,
-		Args:   append([]string{path}, args...),
-		Stderr: os.Stderr,
+	command := exec.CommandContext(ctx, path, args...)
+	command.Stdin = strings.NewReader(auth.Password)
+	command.Stderr = os.Stderr
+
+	err = command.Run()
+	return err
+}
+
+// Build builds the image with docker build. Multi-platform images are
+// built when they are pushed
+func (b cliBuilder) Build(ctx context.Context, cfg Config, imageName string, image DockerImage) (err error) {
+	if image.Args.multiPlatform() {
+		return err
+	}
+
+	return buildImage(ctx, cfg, imageName, image)
+}
+
+// Push pushes the image with docker push, or builds and pushes it with
+// buildx if it is for several platforms
+func (b cliBuilder) Push(ctx context.Context, cfg Config, imageName string, image DockerImage) (err error) {
+	if image.Args.multiPlatform() {
+		return buildImage(ctx, cfg, imageName, image)
 	}
 
-	stdin, err := command.StdinPipe()
+	return pushImage(ctx, imageName)
+}
+
+func buildImage(ctx context.Context, cfg Config, imageName string, image DockerImage) (err error) {
+	buildArgs, err := buildCommandArgs(cfg, imageName, image)
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		defer stdin.Close()
-		_, err = io.WriteString(stdin, token)
-		if err != nil {
-			return
-		}
-	}()
+	// Secrets and SSH forwarding are only supported by BuildKit
+	var env []string
+	if len(image.Args.Secrets) > 0 || len(image.Args.SSH) > 0 {
+		env = append(env, "DOCKER_BUILDKIT=1")
+	}
 
-	err = command.Run()
+	err = runDockerCommand(ctx, buildArgs, env...)
 	return err
 }
 
-func runDockerCommand(args []string) (err error) {
-	path, err := exec.LookPath("docker")
-	if err != nil {
-		return err
+// buildCommandArgs returns the arguments for docker build
+func buildCommandArgs(cfg Config, imageName string, image DockerImage) (args []string, err error) {
+	if image.Args.Platform != "" && image.Args.multiPlatform() {
+		return args, fmt.Errorf("cannot set both platform and platforms")
+	}
+
+	args = []string{
+		"build",
+		"--tag",
+		imageName,
 	}
 
-	command := exec.Cmd{
-		Path:   path,
-		Args:   append([]string{path}, args...),
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+	// buildx can only build multi-platform images by pushing them, since
+	// they cannot be loaded into the local image store
+	if image.Args.multiPlatform() {
+		args = []string{
+			"buildx",
+			"build",
+			"--platform",
+			strings.Join(image.Args.Platforms, ","),
+			"--push",
+			"--tag",
+			imageName,
+		}
 	}
 
-	err = command.Run()
+	if image.Dockerfile != "" {
+		args = append(args, "--file", image.Dockerfile)
+	}
+
+	if image.Args.Target != "" {
+		args = append(args, "--target", image.Args.Target)
+	}
+
+	if image.Args.Platform != "" {
+		args = append(args, "--platform", image.Args.Platform)
+	}
+
+	buildArgs, err := cfg.interpolateMap(image.Args.BuildArgs)
 	if err != nil {
-		return err
+		return args, err
 	}
 
+	for _, name := range sortedKeys(buildArgs) {
+		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", name, buildArgs[name]))
+	}
+
+	for _, name := range sortedKeys(image.Args.Labels) {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", name, image.Args.Labels[name]))
+	}
+
+	for _, cache := range image.Args.CacheFrom {
+		args = append(args, "--cache-from", cache)
+	}
+
+	for _, secret := range image.Args.Secrets {
+		args = append(args, "--secret", secret)
+	}
+
+	for _, ssh := range image.Args.SSH {
+		args = append(args, "--ssh", ssh)
+	}
+
+	buildContext := image.Args.Context
+	if buildContext == "" {
+		buildContext = "."
+	}
+
+	args = append(args, buildContext)
+
+	return args, err
+}
+
+func pushImage(ctx context.Context, imageName string) (err error) {
+	pushArgs := []string{
+		"push",
+		imageName,
+	}
+
+	err = runDockerCommand(ctx, pushArgs)
 	return err
 }
 
-func (d DockerStep) createRepository(clients Clients, name string) (arn string, err error) {
-	arn, err = d.getRepositoryARN(clients, name)
+// ecrAuth returns the credentials for an ECR registry
+func ecrAuth(ctx context.Context, clients Clients, registry string) (auth RegistryAuth, err error) {
+	result, err := clients.ECR.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
 	if err != nil {
-		return arn, err
+		return auth, err
 	}
 
-	if arn == "" {
-		Log.Infof("Cannot find repository. Creating repository %s", name)
-
-		input := ecr.CreateRepositoryInput{
-			RepositoryName: aws.String(name),
-		}
+	if len(result.AuthorizationData) < 1 {
+		return auth, fmt.Errorf("Unable to get authorization data")
+	}
 
-		create, err := clients.ECR.CreateRepository(&input)
-		if err != nil {
-			return arn, err
-		}
+	base64token := aws.StringValue(result.AuthorizationData[0].AuthorizationToken)
+	decodedToken, err := base64.StdEncoding.DecodeString(base64token)
+	if err != nil {
+		return auth, err
+	}
 
-		arn = aws.StringValue(create.Repository.RepositoryArn)
+	credentials := strings.SplitN(string(decodedToken), ":", 2)
+	if len(credentials) != 2 {
+		return auth, fmt.Errorf("Unable to decode authorization token")
+	}
 
-		// Wait for a bit to ensure it's ready
-		time.Sleep(10 * time.Second)
+	auth = RegistryAuth{
+		Username:      credentials[0],
+		Password:      credentials[1],
+		ServerAddress: registry,
 	}
 
-	return arn, err
+	return auth, err
 }
 
-func (d DockerStep) getRepositoryARN(clients Clients, name string) (arn string, err error) {
-	resp, err := clients.ECR.DescribeRepositories(&ecr.DescribeRepositoriesInput{
-		RepositoryNames: aws.StringSlice([]string{name}),
-	})
+func runDockerCommand(ctx context.Context, args []string, env ...string) (err error) {
+	path, err := exec.LookPath("docker")
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() != ecr.ErrCodeRepositoryNotFoundException {
-				return arn, nil
-			}
-		} else {
-			return arn, err
-		}
+		return err
 	}
 
-	if len(resp.Repositories) < 1 {
-		return arn, fmt.Errorf("cannot find repository %s", name)
+	command := exec.CommandContext(ctx, path, args...)
+	command.Env = append(os.Environ(), env...)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+
+	err = command.Run()
+	if err != nil {
+		return err
 	}
 
-	arn = aws.StringValue(resp.Repositories[0].RepositoryArn)
-	return arn, err
+	return err
 }
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultDockerHost is the socket of the local Docker daemon
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// engineDockerfile is where a Dockerfile from outside the build context is
+// put in the context sent to the daemon
+const engineDockerfile = ".flecs.Dockerfile"
+
+// engineBuilder builds and pushes images with the Docker Engine API, so the
+// docker CLI is not needed. Registry credentials are kept in memory and
+// sent with each push, rather than being written to the Docker config
+type engineBuilder struct {
+	client  *http.Client
+	baseURL string
+	auth    map[string]RegistryAuth
+}
+
+// engineMessage is one of the JSON messages streamed by the Docker Engine
+// API while building or pushing
+type engineMessage struct {
+	Stream string `json:"stream"`
+	Status string `json:"status"`
+	ID     string `json:"id"`
+	Error  string `json:"error"`
+}
+
+// newEngineBuilder returns a builder that talks to the daemon set in
+// DOCKER_HOST, or the local socket by default
+func newEngineBuilder() (b *engineBuilder, err error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	b = &engineBuilder{auth: make(map[string]RegistryAuth)}
+
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		socket := strings.TrimPrefix(host, "unix://")
+
+		b.baseURL = "http://docker"
+		b.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+	case strings.HasPrefix(host, "tcp://"):
+		b.baseURL = "http://" + strings.TrimPrefix(host, "tcp://")
+		b.client = http.DefaultClient
+	default:
+		return b, fmt.Errorf("unsupported DOCKER_HOST %s", host)
+	}
+
+	return b, err
+}
+
+// Login keeps the credentials to send when pushing to the registry
+func (b *engineBuilder) Login(ctx context.Context, auth RegistryAuth) (err error) {
+	b.auth[auth.ServerAddress] = auth
+	return err
+}
+
+// Build sends the build context to the daemon and builds the image
+func (b *engineBuilder) Build(ctx context.Context, cfg Config, imageName string, image DockerImage) (err error) {
+	if image.Args.multiPlatform() {
+		return fmt.Errorf("the engine builder cannot build for several platforms, use the cli builder")
+	}
+
+	if len(image.Args.Secrets) > 0 || len(image.Args.SSH) > 0 {
+		return fmt.Errorf("the engine builder does not support secrets or ssh, use the cli builder")
+	}
+
+	buildContext := image.Args.Context
+	if buildContext == "" {
+		buildContext = "."
+	}
+
+	buildArgs, err := cfg.interpolateMap(image.Args.BuildArgs)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("t", imageName)
+
+	if image.Args.Target != "" {
+		query.Set("target", image.Args.Target)
+	}
+
+	if image.Args.Platform != "" {
+		query.Set("platform", image.Args.Platform)
+	}
+
+	for key, value := range map[string]interface{}{
+		"buildargs": buildArgs,
+		"labels":    image.Args.Labels,
+		"cachefrom": image.Args.CacheFrom,
+	} {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		query.Set(key, string(encoded))
+	}
+
+	dockerfile, err := engineDockerfilePath(buildContext, image.Dockerfile)
+	if err != nil {
+		return err
+	}
+	query.Set("dockerfile", dockerfile)
+
+	// Stream the build context to the daemon as it is archived
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeBuildContext(writer, buildContext, image.Dockerfile, dockerfile))
+	}()
+	defer reader.Close()
+
+	Log.Infof("Building image %s", imageName)
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-tar")
+
+	return b.post(ctx, "/build?"+query.Encode(), header, reader)
+}
+
+// Push pushes the image, with the credentials for its registry
+func (b *engineBuilder) Push(ctx context.Context, cfg Config, imageName string, image DockerImage) (err error) {
+	ref := parseImageReference(imageName)
+
+	encoded, err := json.Marshal(b.auth[ref.Registry])
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("X-Registry-Auth", base64.URLEncoding.EncodeToString(encoded))
+
+	query := url.Values{}
+	query.Set("tag", ref.Tag)
+
+	Log.Infof("Pushing image %s", imageName)
+
+	return b.post(ctx, fmt.Sprintf("/images/%s/push?%s", ref.Name, query.Encode()), header, nil)
+}
+
+// post sends a request to the daemon and shows the progress it streams
+// back, returning any error it reports
+func (b *engineBuilder) post(ctx context.Context, path string, header http.Header, body io.Reader) (err error) {
+	req, err := http.NewRequest(http.MethodPost, b.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header = header
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var message struct {
+			Message string `json:"message"`
+		}
+
+		data, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(data, &message) == nil && message.Message != "" {
+			return fmt.Errorf("docker engine returned %s: %s", resp.Status, message.Message)
+		}
+
+		return fmt.Errorf("docker engine returned %s", resp.Status)
+	}
+
+	return streamEngineProgress(resp.Body, os.Stdout)
+}
+
+// streamEngineProgress writes build output and push progress as it
+// arrives. Layers are only shown when their status changes, rather than
+// for every progress update
+func streamEngineProgress(body io.Reader, out io.Writer) (err error) {
+	decoder := json.NewDecoder(bufio.NewReader(body))
+	statuses := make(map[string]string)
+
+	for {
+		var message engineMessage
+
+		err = decoder.Decode(&message)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if message.Error != "" {
+			return fmt.Errorf("%s", strings.TrimSpace(message.Error))
+		}
+
+		switch {
+		case message.Stream != "":
+			fmt.Fprint(out, message.Stream)
+		case message.Status != "" && message.ID == "":
+			fmt.Fprintln(out, message.Status)
+		case message.Status != "" && statuses[message.ID] != message.Status:
+			statuses[message.ID] = message.Status
+			fmt.Fprintf(out, "%s: %s\n", message.ID, message.Status)
+		}
+	}
+}
+
+// engineDockerfilePath returns the path of the Dockerfile in the build
+// context. A Dockerfile outside the context is added to it
+func engineDockerfilePath(buildContext, dockerfile string) (string, error) {
+	if dockerfile == "" {
+		return "Dockerfile", nil
+	}
+
+	rel, err := filepath.Rel(buildContext, dockerfile)
+	if err != nil {
+		return "", err
+	}
+
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return engineDockerfile, nil
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// writeBuildContext writes the build context as a tar archive, leaving out
+// anything matched by .dockerignore
+func writeBuildContext(w io.Writer, buildContext, dockerfile, contextDockerfile string) (err error) {
+	ignore, err := readDockerignore(buildContext)
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewWriter(w)
+
+	err = filepath.Walk(buildContext, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(buildContext, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		// The daemon always needs the Dockerfile and .dockerignore
+		if rel != contextDockerfile && rel != ".dockerignore" && dockerIgnored(ignore, rel) {
+			if info.IsDir() && !dockerIgnoreHasExceptions(ignore) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		return addToArchive(archive, file, rel, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	if contextDockerfile == engineDockerfile {
+		info, err := os.Stat(dockerfile)
+		if err != nil {
+			return err
+		}
+
+		err = addToArchive(archive, dockerfile, engineDockerfile, info)
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func addToArchive(archive *tar.Writer, file, name string, info os.FileInfo) (err error) {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	err = archive.WriteHeader(header)
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(archive, f)
+	return err
+}
+
+// readDockerignore returns the patterns in the .dockerignore file of the
+// build context, if there is one
+func readDockerignore(buildContext string) (patterns []string, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(buildContext, ".dockerignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return patterns, nil
+		}
+
+		return patterns, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		exception := strings.HasPrefix(line, "!")
+		line = path.Clean(strings.TrimPrefix(strings.TrimPrefix(line, "!"), "/"))
+
+		if exception {
+			line = "!" + line
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	return patterns, err
+}
+
+// dockerIgnored returns true if a path is matched by the patterns. As with
+// Docker, the last matching pattern wins, and patterns starting with "!"
+// are exceptions
+func dockerIgnored(patterns []string, file string) (ignored bool) {
+	for _, pattern := range patterns {
+		exception := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		// A pattern matching a directory matches everything in it
+		for name := file; name != "."; name = path.Dir(name) {
+			if matchDockerIgnore(strings.Split(pattern, "/"), strings.Split(name, "/")) {
+				ignored = !exception
+				break
+			}
+		}
+	}
+
+	return ignored
+}
+
+// matchDockerIgnore matches a path against a pattern, a segment at a time.
+// A "**" segment matches any number of directories, including none
+func matchDockerIgnore(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchDockerIgnore(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	if matched, _ := path.Match(pattern[0], name[0]); !matched {
+		return false
+	}
+
+	return matchDockerIgnore(pattern[1:], name[1:])
+}
+
+func dockerIgnoreHasExceptions(patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			return true
+		}
+	}
+
+	return false
+}
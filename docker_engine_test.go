@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineBuilder(t *testing.T) {
+	var files []string
+	var query map[string]string
+	var auth RegistryAuth
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = make(map[string]string)
+		for key := range r.URL.Query() {
+			query[key] = r.URL.Query().Get(key)
+		}
+
+		switch {
+		case r.URL.Path == "/build":
+			archive := tar.NewReader(r.Body)
+			for {
+				header, err := archive.Next()
+				if err == io.EOF {
+					break
+				}
+				assert.Nil(t, err)
+
+				files = append(files, header.Name)
+			}
+
+			w.Write([]byte(`{"stream":"Step 1/1 : FROM scratch\n"}` + "\n" + `{"aux":{"ID":"sha256:abc"}}`))
+		case r.URL.Path == "/images/registry.example.com/app/push":
+			decoded, err := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+			assert.Nil(t, err)
+			assert.Nil(t, json.Unmarshal(decoded, &auth))
+
+			w.Write([]byte(`{"status":"Pushing","id":"abc"}` + "\n" + `{"error":"denied: not allowed"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "flecs-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"app/Dockerfile":    "FROM scratch",
+		"app/.dockerignore": "secrets\n*.log\n!keep.log",
+		"app/main.go":       "package main",
+		"app/secrets/key":   "secret",
+		"app/debug.log":     "debug",
+		"app/keep.log":      "keep",
+		"docker/Dockerfile": "FROM scratch",
+	} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	os.Setenv("DOCKER_HOST", strings.Replace(server.URL, "http://", "tcp://", 1))
+	defer os.Unsetenv("DOCKER_HOST")
+
+	builder, err := newImageBuilder("engine")
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	cfg := Config{Outputs: map[string]Outputs{"version": Outputs{"number": "42"}}}
+	image := DockerImage{
+		Dockerfile: filepath.Join(dir, "docker/Dockerfile"),
+		Args: DockerArgs{
+			BuildArgs: map[string]string{"VERSION": "{{ steps.version.number }}"},
+			Context:   filepath.Join(dir, "app"),
+			Target:    "release",
+		},
+	}
+
+	err = builder.Build(ctx, cfg, "registry.example.com/app:v1", image)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{".dockerignore", "Dockerfile", "keep.log", "main.go", engineDockerfile}, files)
+	assert.Equal(t, "registry.example.com/app:v1", query["t"])
+	assert.Equal(t, engineDockerfile, query["dockerfile"])
+	assert.Equal(t, "release", query["target"])
+	assert.Equal(t, `{"VERSION":"42"}`, query["buildargs"])
+
+	image.Args.Platforms = []string{"linux/amd64", "linux/arm64"}
+	err = builder.Build(ctx, cfg, "registry.example.com/app:v1", image)
+	assert.NotNil(t, err)
+
+	err = builder.Login(ctx, RegistryAuth{Username: "AWS", Password: "secret", ServerAddress: "registry.example.com"})
+	assert.Nil(t, err)
+
+	err = builder.Push(ctx, cfg, "registry.example.com/app:v1", image)
+	assert.EqualError(t, err, "denied: not allowed")
+	assert.Equal(t, "v1", query["tag"])
+	assert.Equal(t, RegistryAuth{Username: "AWS", Password: "secret", ServerAddress: "registry.example.com"}, auth)
+
+	err = builder.Push(ctx, cfg, "registry.example.com/other:v1", image)
+	assert.EqualError(t, err, "docker engine returned 404 Not Found: not found")
+}
+
+func TestStreamEngineProgress(t *testing.T) {
+	body := strings.NewReader(`{"status":"The push refers to repository [app]"}
+{"status":"Preparing","id":"abc"}
+{"status":"Pushing","id":"abc","progress":"[=>  ]"}
+{"status":"Pushing","id":"abc","progress":"[==> ]"}
+{"status":"Pushed","id":"abc"}
+`)
+
+	var out bytes.Buffer
+	err := streamEngineProgress(body, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "The push refers to repository [app]\nabc: Preparing\nabc: Pushing\nabc: Pushed\n", out.String())
+}
+
+func TestDockerIgnored(t *testing.T) {
+	patterns := []string{"*.log", "!keep.log", "tmp", "docs/*.md"}
+
+	assert.True(t, dockerIgnored(patterns, "debug.log"))
+	assert.False(t, dockerIgnored(patterns, "keep.log"))
+	assert.True(t, dockerIgnored(patterns, "tmp/cache/file"))
+	assert.True(t, dockerIgnored(patterns, "docs/README.md"))
+	assert.False(t, dockerIgnored(patterns, "README.md"))
+	assert.False(t, dockerIgnored(patterns, "src/debug.log"))
+
+	patterns = []string{"**/*.log", "node_modules/**", "src/**/test"}
+
+	assert.True(t, dockerIgnored(patterns, "debug.log"))
+	assert.True(t, dockerIgnored(patterns, "src/app/debug.log"))
+	assert.True(t, dockerIgnored(patterns, "node_modules/left-pad/index.js"))
+	assert.True(t, dockerIgnored(patterns, "src/test/app.go"))
+	assert.True(t, dockerIgnored(patterns, "src/app/test/app.go"))
+	assert.False(t, dockerIgnored(patterns, "src/app/main.go"))
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ociIndexMediaType is the media type of an OCI image index
+const ociIndexMediaType = "application/vnd.oci.image.index.v1+json"
+
+// ociBuilder pushes images that have already been built into an OCI image
+// layout, such as with "docker buildx build --output type=oci", directly to
+// the registry. It doesn't need a Docker daemon, so images can be built
+// with any tool that writes OCI images
+type ociBuilder struct {
+	auth map[string]RegistryAuth
+}
+
+// ociDescriptor refers to a blob or manifest by its digest
+type ociDescriptor struct {
+	MediaType string   `json:"mediaType"`
+	Digest    string   `json:"digest"`
+	Size      int64    `json:"size"`
+	URLs      []string `json:"urls,omitempty"`
+}
+
+// ociManifest contains the fields of an image manifest or index that refer
+// to other content
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    *ociDescriptor  `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+func newOCIBuilder() *ociBuilder {
+	return &ociBuilder{auth: make(map[string]RegistryAuth)}
+}
+
+// Login keeps the credentials to use when pushing to the registry
+func (b *ociBuilder) Login(ctx context.Context, auth RegistryAuth) (err error) {
+	b.auth[auth.ServerAddress] = auth
+	return err
+}
+
+// Build checks that the image has already been built, since the OCI
+// builder only pushes images
+func (b *ociBuilder) Build(ctx context.Context, cfg Config, imageName string, image DockerImage) (err error) {
+	if image.OCIArchive == "" {
+		return fmt.Errorf("must specify oci_archive for each image with the oci builder")
+	}
+
+	_, err = os.Stat(image.OCIArchive)
+	if err != nil {
+		return err
+	}
+
+	Log.Infof("Using OCI archive %s for %s", image.OCIArchive, imageName)
+	return err
+}
+
+// Push uploads the blobs and manifests in the OCI archive, and tags the
+// image
+func (b *ociBuilder) Push(ctx context.Context, cfg Config, imageName string, image DockerImage) (err error) {
+	ref := parseImageReference(imageName)
+
+	layout, cleanup, err := openOCILayout(image.OCIArchive)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	client := &registryClient{Registry: ref.Registry, Auth: b.auth[ref.Registry]}
+
+	Log.Infof("Pushing image %s", imageName)
+	return pushOCILayout(ctx, client, layout, ref.Repository, ref.Tag)
+}
+
+// openOCILayout returns the directory of an OCI image layout. Archives are
+// extracted to a temporary directory, which is removed by cleanup
+func openOCILayout(archive string) (layout string, cleanup func(), err error) {
+	cleanup = func() {}
+
+	info, err := os.Stat(archive)
+	if err != nil {
+		return layout, cleanup, err
+	}
+
+	if info.IsDir() {
+		return archive, cleanup, err
+	}
+
+	layout, err = ioutil.TempDir("", "flecs-oci")
+	if err != nil {
+		return layout, cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(layout) }
+
+	err = extractOCIArchive(archive, layout)
+	if err != nil {
+		cleanup()
+	}
+
+	return layout, cleanup, err
+}
+
+// extractOCIArchive extracts a tar archive, which may be compressed with
+// gzip
+func extractOCIArchive(archive, dir string) (err error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var reader io.Reader = bufio.NewReader(f)
+
+	magic, err := reader.(*bufio.Reader).Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		reader, err = gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+	}
+
+	archiveReader := tar.NewReader(reader)
+	for {
+		header, err := archiveReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path %s in OCI archive", header.Name)
+		}
+
+		target := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractOCIFile(archiveReader, target)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractOCIFile(r io.Reader, target string) (err error) {
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// pushOCILayout pushes the image in an OCI image layout with the given
+// tag. A layout with several images is pushed as an index of all of them
+func pushOCILayout(ctx context.Context, client *registryClient, layout, repository, tag string) (err error) {
+	data, err := ioutil.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return err
+	}
+
+	var index ociManifest
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return fmt.Errorf("invalid OCI index: %s", err)
+	}
+
+	switch len(index.Manifests) {
+	case 0:
+		return fmt.Errorf("OCI archive does not contain any images")
+	case 1:
+		return pushOCIManifest(ctx, client, layout, repository, index.Manifests[0], nil, tag)
+	}
+
+	desc := ociDescriptor{
+		MediaType: ociIndexMediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		Size:      int64(len(data)),
+	}
+
+	return pushOCIManifest(ctx, client, layout, repository, desc, data, tag)
+}
+
+// pushOCIManifest pushes everything a manifest refers to, and then the
+// manifest itself. The manifest is read from the layout unless data is set
+func pushOCIManifest(ctx context.Context, client *registryClient, layout, repository string, desc ociDescriptor, data []byte, reference string) (err error) {
+	if data == nil {
+		data, err = ioutil.ReadFile(ociBlobPath(layout, desc.Digest))
+		if err != nil {
+			return err
+		}
+	}
+
+	var manifest ociManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return fmt.Errorf("invalid OCI manifest %s: %s", desc.Digest, err)
+	}
+
+	for _, child := range manifest.Manifests {
+		err = pushOCIManifest(ctx, client, layout, repository, child, nil, child.Digest)
+		if err != nil {
+			return err
+		}
+	}
+
+	blobs := manifest.Layers
+	if manifest.Config != nil {
+		blobs = append([]ociDescriptor{*manifest.Config}, blobs...)
+	}
+
+	for _, blob := range blobs {
+		// Layers that are pulled from elsewhere are not in the layout
+		if len(blob.URLs) > 0 {
+			continue
+		}
+
+		err = pushOCIBlob(ctx, client, layout, repository, blob)
+		if err != nil {
+			return err
+		}
+	}
+
+	mediaType := desc.MediaType
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", mediaType)
+
+	resp, err := client.do(ctx, http.MethodPut, fmt.Sprintf("/v2/%s/manifests/%s", repository, reference), header, bytesBody(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("pushing manifest %s returned %s", desc.Digest, resp.Status)
+	}
+
+	return err
+}
+
+// pushOCIBlob uploads a blob, unless the registry already has it
+func pushOCIBlob(ctx context.Context, client *registryClient, layout, repository string, desc ociDescriptor) (err error) {
+	resp, err := client.do(ctx, http.MethodHead, fmt.Sprintf("/v2/%s/blobs/%s", repository, desc.Digest), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		Log.Infof("%s: Layer already exists", shortDigest(desc.Digest))
+		return err
+	}
+
+	resp, err = client.do(ctx, http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/", repository), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("starting upload of %s returned %s", desc.Digest, resp.Status)
+	}
+
+	if resp.Header.Get("Location") == "" {
+		return fmt.Errorf("registry did not return an upload location for %s", desc.Digest)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+
+	query := location.Query()
+	query.Set("digest", desc.Digest)
+	location.RawQuery = query.Encode()
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+
+	file := ociBlobPath(layout, desc.Digest)
+	resp, err = client.do(ctx, http.MethodPut, location.String(), header, func() (io.ReadCloser, int64, error) {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+
+		return f, info.Size(), nil
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("uploading %s returned %s", desc.Digest, resp.Status)
+	}
+
+	Log.Infof("%s: Pushed", shortDigest(desc.Digest))
+	return err
+}
+
+// ociBlobPath returns where a blob is stored in an OCI image layout
+func ociBlobPath(layout, digest string) string {
+	return filepath.Join(layout, "blobs", strings.Replace(digest, ":", string(filepath.Separator), 1))
+}
+
+// shortDigest returns the start of a digest, as Docker shows for layers
+func shortDigest(digest string) string {
+	hex := digest[strings.Index(digest, ":")+1:]
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+
+	return hex
+}
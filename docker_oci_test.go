@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRegistry is an in-memory registry that requires basic authentication
+type testRegistry struct {
+	sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	uploads   int
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.Lock()
+	defer reg.Unlock()
+
+	if user, pass, ok := r.BasicAuth(); !ok || user != "AWS" || pass != "secret" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/"):
+		if _, ok := reg.blobs[filepath.Base(r.URL.Path)]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+		w.Header().Set("Location", r.URL.Path+"upload-id?state=abc")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/"):
+		digest := r.URL.Query().Get("digest")
+		if r.URL.Query().Get("state") != "abc" || digest != fmt.Sprintf("sha256:%x", sha256.Sum256(body)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		reg.blobs[digest] = body
+		reg.uploads++
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/manifests/"):
+		manifest, ok := reg.manifests[strings.TrimPrefix(r.URL.Path, "/v2/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(manifest)))
+	case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+		reg.manifests[strings.TrimPrefix(r.URL.Path, "/v2/")] = body
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// writeTestOCILayout writes an OCI image layout with one image, and returns
+// the digest of its manifest
+func writeTestOCILayout(t *testing.T, dir string) string {
+	blob := func(data string) string {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+
+		err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755)
+		assert.Nil(t, err)
+
+		err = ioutil.WriteFile(ociBlobPath(dir, digest), []byte(data), 0644)
+		assert.Nil(t, err)
+
+		return digest
+	}
+
+	config := blob(`{"architecture":"amd64","os":"linux"}`)
+	layer := blob("layer")
+	manifest := blob(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":%q},"layers":[{"digest":%q}]}`, config, layer))
+
+	index := fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q}]}`, manifest)
+	err := ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte(index), 0644)
+	assert.Nil(t, err)
+
+	return manifest
+}
+
+func TestOCIBuilderPush(t *testing.T) {
+	reg := &testRegistry{blobs: make(map[string][]byte), manifests: make(map[string][]byte)}
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	dir, err := ioutil.TempDir("", "flecs-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	layout := filepath.Join(dir, "layout")
+	manifest := writeTestOCILayout(t, layout)
+
+	builder := newOCIBuilder()
+	ctx := context.Background()
+	image := DockerImage{OCIArchive: layout}
+
+	// Pushing without credentials fails
+	err = builder.Push(ctx, Config{}, registry+"/app:v1", image)
+	assert.NotNil(t, err)
+
+	err = builder.Login(ctx, RegistryAuth{Username: "AWS", Password: "secret", ServerAddress: registry})
+	assert.Nil(t, err)
+
+	err = builder.Build(ctx, Config{}, registry+"/app:v1", image)
+	assert.Nil(t, err)
+
+	err = builder.Push(ctx, Config{}, registry+"/app:v1", image)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, reg.uploads)
+	assert.Equal(t, []byte("layer"), reg.blobs[fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("layer")))])
+
+	pushed, err := ioutil.ReadFile(ociBlobPath(layout, manifest))
+	assert.Nil(t, err)
+	assert.Equal(t, pushed, reg.manifests["app/manifests/v1"])
+
+	// Push the same image from an archive, which doesn't upload the blobs
+	// again
+	archive := filepath.Join(dir, "image.tar")
+	writeTestTar(t, layout, archive)
+
+	image.OCIArchive = archive
+	err = builder.Push(ctx, Config{}, registry+"/app:v2", image)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, reg.uploads)
+	assert.Equal(t, pushed, reg.manifests["app/manifests/v2"])
+
+	err = builder.Build(ctx, Config{}, registry+"/app:v1", DockerImage{})
+	assert.NotNil(t, err)
+}
+
+func writeTestTar(t *testing.T, dir, archive string) {
+	f, err := os.Create(archive)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	w := tar.NewWriter(f)
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, file)
+		return addToArchive(w, file, filepath.ToSlash(rel), info)
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+}
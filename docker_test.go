@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerStepImages(t *testing.T) {
+	cfg := Config{ProjectName: "app"}
+
+	images, err := DockerStep{}.images(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []DockerImage{DockerImage{Repository: Repository{Name: "app"}}}, images)
+
+	step := DockerStep{
+		Dockerfile: "Dockerfile",
+		Args: DockerArgs{
+			Context:   "services",
+			BuildArgs: map[string]string{"VERSION": "1"},
+		},
+		Images: []DockerImage{
+			DockerImage{Name: "web"},
+			DockerImage{
+				Name:       "nginx",
+				Dockerfile: "nginx/Dockerfile",
+				Repository: Repository{Name: "shared/nginx"},
+				Args:       DockerArgs{Context: "nginx"},
+			},
+		},
+	}
+
+	images, err = step.images(cfg)
+	assert.Nil(t, err)
+
+	expected := []DockerImage{
+		DockerImage{
+			Name:       "web",
+			Dockerfile: "Dockerfile",
+			Repository: Repository{Name: "app-web"},
+			Args: DockerArgs{
+				Context:   "services",
+				BuildArgs: map[string]string{"VERSION": "1"},
+			},
+		},
+		DockerImage{
+			Name:       "nginx",
+			Dockerfile: "nginx/Dockerfile",
+			Repository: Repository{Name: "shared/nginx"},
+			Args: DockerArgs{
+				Context:   "nginx",
+				BuildArgs: map[string]string{"VERSION": "1"},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, images)
+
+	step.Images = append(step.Images, DockerImage{Name: "web"})
+	_, err = step.images(cfg)
+	assert.NotNil(t, err)
+
+	step.Images = []DockerImage{DockerImage{}}
+	_, err = step.images(cfg)
+	assert.NotNil(t, err)
+}
+
+func TestBuildCommandArgs(t *testing.T) {
+	cfg := Config{
+		Outputs: map[string]Outputs{
+			"version": Outputs{"number": "42"},
+		},
+	}
+
+	image := DockerImage{
+		Dockerfile: "docker/Dockerfile",
+		Args: DockerArgs{
+			BuildArgs: map[string]string{
+				"VERSION": "{{ steps.version.number }}",
+				"ENV":     "production",
+			},
+			CacheFrom: []string{"app:latest"},
+			Context:   "app",
+			Labels:    map[string]string{"team": "web"},
+			Platform:  "linux/amd64",
+			Secrets:   []string{"id=npm,src=.npmrc"},
+			SSH:       []string{"default"},
+			Target:    "release",
+		},
+	}
+
+	args, err := buildCommandArgs(cfg, "app:abc", image)
+	assert.Nil(t, err)
+
+	expected := []string{
+		"build",
+		"--tag", "app:abc",
+		"--file", "docker/Dockerfile",
+		"--target", "release",
+		"--platform", "linux/amd64",
+		"--build-arg", "ENV=production",
+		"--build-arg", "VERSION=42",
+		"--label", "team=web",
+		"--cache-from", "app:latest",
+		"--secret", "id=npm,src=.npmrc",
+		"--ssh", "default",
+		"app",
+	}
+
+	assert.Equal(t, expected, args)
+
+	args, err = buildCommandArgs(cfg, "app:abc", DockerImage{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"build", "--tag", "app:abc", "."}, args)
+}
+
+func TestBuildCommandArgsMultiPlatform(t *testing.T) {
+	image := DockerImage{
+		Args: DockerArgs{
+			Platforms: []string{"linux/amd64", "linux/arm64"},
+		},
+	}
+
+	args, err := buildCommandArgs(Config{}, "app:abc", image)
+	assert.Nil(t, err)
+
+	expected := []string{
+		"buildx", "build",
+		"--platform", "linux/amd64,linux/arm64",
+		"--push",
+		"--tag", "app:abc",
+		".",
+	}
+
+	assert.Equal(t, expected, args)
+
+	image.Args.Platform = "linux/amd64"
+	_, err = buildCommandArgs(Config{}, "app:abc", image)
+	assert.NotNil(t, err)
+}
+
+func TestSkipExistingImages(t *testing.T) {
+	clients := Clients{
+		ECR: mockedECRClient{
+			DescribeImagesResp: ecr.DescribeImagesOutput{
+				ImageDetails: []*ecr.ImageDetail{
+					{ImageDigest: aws.String("sha256:abc")},
+				},
+			},
+		},
+	}
+
+	cfg := Config{Tag: "v1"}
+	images := []DockerImage{{Name: "web", Repository: Repository{Name: "app-web"}}}
+	outputs := make(Outputs)
+
+	remaining, err := DockerStep{}.skipExistingImages(context.Background(), ecrRegistry{clients: clients, uri: "registry"}, cfg, images, outputs)
+	assert.Nil(t, err)
+	assert.Empty(t, remaining)
+	assert.Equal(t, Outputs{"web_image_uri": "registry/app-web:v1", "web_image_digest": "sha256:abc"}, outputs)
+
+	clients.ECR = mockedECRClient{
+		DescribeImagesErr: awserr.New(ecr.ErrCodeImageNotFoundException, "not found", nil),
+	}
+
+	remaining, err = DockerStep{}.skipExistingImages(context.Background(), ecrRegistry{clients: clients, uri: "registry"}, cfg, images, make(Outputs))
+	assert.Nil(t, err)
+	assert.Equal(t, images, remaining)
+}
+
+func TestPromoteImage(t *testing.T) {
+	var puts []*ecr.PutImageInput
+
+	clients := Clients{
+		ECR: mockedECRClient{
+			BatchGetImageResp: ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{
+					{
+						ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String("sha256:abc"), ImageTag: aws.String("v1")},
+						ImageManifest:          aws.String("{}"),
+						ImageManifestMediaType: aws.String("application/vnd.oci.image.manifest.v1+json"),
+					},
+				},
+			},
+			PutImageInputs: &puts,
+		},
+	}
+
+	step := DockerStep{Promote: DockerPromote{To: []string{"production", "stable"}}}
+	outputs := make(Outputs)
+
+	err := step.promoteImage(context.Background(), clients, "registry", Config{Tag: "v1"}, DockerImage{Repository: Repository{Name: "app"}}, outputs)
+	assert.Nil(t, err)
+	assert.Equal(t, Outputs{"image_uri": "registry/app:production", "image_digest": "sha256:abc"}, outputs)
+
+	assert.Len(t, puts, 2)
+	assert.Equal(t, "production", aws.StringValue(puts[0].ImageTag))
+	assert.Equal(t, "stable", aws.StringValue(puts[1].ImageTag))
+	assert.Equal(t, "{}", aws.StringValue(puts[0].ImageManifest))
+
+	clients.ECR = mockedECRClient{}
+	err = step.promoteImage(context.Background(), clients, "registry", Config{Tag: "v2"}, DockerImage{Repository: Repository{Name: "app"}}, outputs)
+	assert.EqualError(t, err, "cannot find image app:v2 to promote")
+
+	// Failures explain why the image couldn't be fetched
+	clients.ECR = mockedECRClient{BatchGetImageResp: ecr.BatchGetImageOutput{
+		Failures: []*ecr.ImageFailure{
+			{FailureCode: aws.String("UnsupportedImageType"), FailureReason: aws.String("The image manifest media type is not supported")},
+		},
+	}}
+	err = step.promoteImage(context.Background(), clients, "registry", Config{Tag: "v2"}, DockerImage{Repository: Repository{Name: "app"}}, outputs)
+	assert.EqualError(t, err, "cannot get image app:v2 to promote: UnsupportedImageType: The image manifest media type is not supported")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// envFileKey matches the names that can be set in an environment file
+var envFileKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// isS3EnvironmentFile returns true if the environment file is the ARN of an
+// object in S3, which ECS loads when the task starts
+func isS3EnvironmentFile(file string) bool {
+	return strings.HasPrefix(file, "arn:") && strings.Contains(file, ":s3:::")
+}
+
+// parseEnvFile parses the contents of a dotenv file. Lines are KEY=VALUE,
+// optionally starting with "export". Values can be quoted with single quotes
+// to be taken literally, or double quotes to expand \n, \t, \" and \\.
+// Unquoted values end at a " #" comment
+func parseEnvFile(data string) (vars map[string]string, err error) {
+	vars = make(map[string]string)
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return vars, fmt.Errorf("line %d: expected KEY=VALUE", number)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		if !envFileKey.MatchString(key) {
+			return vars, fmt.Errorf("line %d: invalid name %q", number, key)
+		}
+
+		value, err := parseEnvFileValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return vars, fmt.Errorf("line %d: %s", number, err)
+		}
+
+		vars[key] = value
+	}
+
+	return vars, scanner.Err()
+}
+
+// parseEnvFileValue unquotes a value from an environment file
+func parseEnvFileValue(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+
+	quote := value[0]
+	if quote != '"' && quote != '\'' {
+		if index := strings.Index(value, " #"); index >= 0 {
+			value = value[:index]
+		}
+
+		return strings.TrimSpace(value), nil
+	}
+
+	// Find the closing quote, skipping escaped quotes in double quotes
+	end := -1
+	for i := 1; i < len(value); i++ {
+		if quote == '"' && value[i] == '\\' {
+			i++
+			continue
+		}
+
+		if value[i] == quote {
+			end = i
+			break
+		}
+	}
+
+	if end < 0 {
+		return value, fmt.Errorf("unterminated quoted value")
+	}
+
+	rest := strings.TrimSpace(value[end+1:])
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return value, fmt.Errorf("unexpected %q after quoted value", rest)
+	}
+
+	value = value[1:end]
+	if quote == '\'' {
+		return value, nil
+	}
+
+	return strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`).Replace(value), nil
+}
+
+// loadEnvironmentFiles reads the local environment files in order, so that
+// later files override earlier ones. Files in S3 are left for ECS to load
+func loadEnvironmentFiles(files []string) (vars map[string]string, err error) {
+	vars = make(map[string]string)
+
+	for _, file := range files {
+		if isS3EnvironmentFile(file) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return vars, err
+		}
+
+		fileVars, err := parseEnvFile(string(data))
+		if err != nil {
+			return vars, fmt.Errorf("environment file %s: %s", file, err)
+		}
+
+		for key, value := range fileVars {
+			vars[key] = value
+		}
+	}
+
+	return vars, err
+}
+
+// s3EnvironmentFiles returns the environment files that ECS loads from S3
+func (cfg Config) s3EnvironmentFiles() (files []*ecs.EnvironmentFile) {
+	for _, file := range cfg.Options.EnvironmentFiles {
+		if isS3EnvironmentFile(file) {
+			files = append(files, &ecs.EnvironmentFile{
+				Type:  aws.String(ecs.EnvironmentFileTypeS3),
+				Value: aws.String(file),
+			})
+		}
+	}
+
+	return files
+}
+
+// validateRequiredVariables checks that each required variable is
+// set to something, either as an environment variable or a secret. Variables
+// in S3 environment files can't be checked, so they can't be required
+func (cfg Config) validateRequiredVariables() (err error) {
+	var missing []string
+	for _, name := range cfg.Options.RequiredVariables {
+		if cfg.Options.EnvironmentVariables[name] != "" {
+			continue
+		}
+
+		if _, ok := cfg.Options.Secrets[name]; ok {
+			continue
+		}
+
+		missing = append(missing, name)
+	}
+
+	if len(missing) > 0 {
+		environment := "the default environment"
+		if cfg.EnvironmentName != "" {
+			environment = fmt.Sprintf("environment %s", cfg.EnvironmentName)
+		}
+
+		return fmt.Errorf("required environment variables missing or empty for %s: %s", environment, strings.Join(missing, ", "))
+	}
+
+	return err
+}
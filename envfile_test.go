@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	vars, err := parseEnvFile(`# Production settings
+RAILS_ENV=production
+export PORT=3000
+
+DATABASE_URL = postgres://db/shop # the primary
+GREETING="hello\nworld" # comment
+LITERAL='hello\nworld'
+QUOTED="say \"hi\""
+HASH=abc#def
+EMPTY=
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"RAILS_ENV":    "production",
+		"PORT":         "3000",
+		"DATABASE_URL": "postgres://db/shop",
+		"GREETING":     "hello\nworld",
+		"LITERAL":      `hello\nworld`,
+		"QUOTED":       `say "hi"`,
+		"HASH":         "abc#def",
+		"EMPTY":        "",
+	}, vars)
+
+	_, err = parseEnvFile("RAILS_ENV")
+	assert.EqualError(t, err, "line 1: expected KEY=VALUE")
+
+	_, err = parseEnvFile("\nRAILS ENV=production")
+	assert.EqualError(t, err, `line 2: invalid name "RAILS ENV"`)
+
+	_, err = parseEnvFile(`GREETING="hello`)
+	assert.EqualError(t, err, "line 1: unterminated quoted value")
+
+	_, err = parseEnvFile(`GREETING="hello" world`)
+	assert.NotNil(t, err)
+}
+
+func TestLoadEnvironmentFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flecs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".env"), []byte("RAILS_ENV=development\nPORT=3000\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".env.production"), []byte("RAILS_ENV=production\n"), 0644))
+
+	vars, err := loadEnvironmentFiles([]string{
+		filepath.Join(dir, ".env"),
+		"arn:aws:s3:::shop-config/production.env",
+		filepath.Join(dir, ".env.production"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"RAILS_ENV": "production", "PORT": "3000"}, vars)
+
+	_, err = loadEnvironmentFiles([]string{filepath.Join(dir, ".env.staging")})
+	assert.NotNil(t, err)
+}
+
+func TestS3EnvironmentFiles(t *testing.T) {
+	cfg := Config{Options: ConfigOptions{EnvironmentFiles: []string{".env", "arn:aws:s3:::shop-config/production.env"}}}
+
+	assert.Equal(t, []*ecs.EnvironmentFile{
+		{Type: aws.String("s3"), Value: aws.String("arn:aws:s3:::shop-config/production.env")},
+	}, cfg.s3EnvironmentFiles())
+
+	objects, buckets := cfg.environmentFileARNs()
+	assert.Equal(t, []string{"arn:aws:s3:::shop-config/production.env"}, objects)
+	assert.Equal(t, []string{"arn:aws:s3:::shop-config"}, buckets)
+}
+
+func TestValidateRequiredVariables(t *testing.T) {
+	cfg := Config{
+		EnvironmentName: "production",
+		Options: ConfigOptions{
+			EnvironmentVariables: map[string]string{"RAILS_ENV": "production", "HOST": ""},
+			Secrets:              map[string]string{"DATABASE_URL": ""},
+			RequiredVariables:    []string{"RAILS_ENV", "DATABASE_URL"},
+		},
+	}
+
+	assert.Nil(t, cfg.validateRequiredVariables())
+
+	cfg.Options.RequiredVariables = append(cfg.Options.RequiredVariables, "HOST", "PORT")
+	assert.EqualError(t, cfg.validateRequiredVariables(), "required environment variables missing or empty for environment production: HOST, PORT")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// currentBranch returns the name of the branch checked out in the working
+// directory, or an empty string if HEAD is detached
+func currentBranch() (branch string, err error) {
+	r, err := git.PlainOpen(".")
+	if err != nil {
+		return branch, err
+	}
+
+	ref, err := r.Head()
+	if err != nil {
+		return branch, err
+	}
+
+	if ref.Name().IsBranch() {
+		branch = ref.Name().Short()
+	}
+
+	return branch, err
+}
+
+// changedFilesSince returns the paths of files that have changed between a
+// revision and HEAD
+func changedFilesSince(revision string) (files []string, err error) {
+	r, err := git.PlainOpen(".")
+	if err != nil {
+		return files, err
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		return files, err
+	}
+
+	headCommit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return files, err
+	}
+
+	hash, err := r.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return files, err
+	}
+
+	sinceCommit, err := r.CommitObject(*hash)
+	if err != nil {
+		return files, err
+	}
+
+	headTree, err := headCommit.Tree()
+	if err != nil {
+		return files, err
+	}
+
+	sinceTree, err := sinceCommit.Tree()
+	if err != nil {
+		return files, err
+	}
+
+	changes, err := object.DiffTree(sinceTree, headTree)
+	if err != nil {
+		return files, err
+	}
+
+	files = []string{}
+	for _, change := range changes {
+		if change.From.Name != "" {
+			files = append(files, change.From.Name)
+		}
+
+		if change.To.Name != "" && change.To.Name != change.From.Name {
+			files = append(files, change.To.Name)
+		}
+	}
+
+	return files, err
+}
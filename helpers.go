@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 )
@@ -16,3 +20,57 @@ func CheckError(err error) {
 		os.Exit(1)
 	}
 }
+
+// SignalContext returns a context that is cancelled when flecs receives an
+// interrupt or termination signal, so that whatever is running can stop
+// gracefully. A second signal exits straight away
+func SignalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		Log.Warnf("Received %s, stopping. Send again to exit immediately", sig)
+		cancel()
+
+		<-signals
+		os.Exit(130)
+	}()
+
+	return ctx, cancel
+}
+
+// sortedKeys returns the keys of a map in order, so that anything generated
+// from it is consistent
+func sortedKeys(m map[string]string) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// stringInSlice returns true if the slice contains the string
+func stringInSlice(s string, slice []string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// int64InSlice returns true if the slice contains the number
+func int64InSlice(i int64, slice []int64) bool {
+	for _, item := range slice {
+		if item == i {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+const (
+	// ecsTasksAssumeRolePolicy allows ECS tasks to assume a role
+	ecsTasksAssumeRolePolicy = `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Sid": "",
+      "Effect": "Allow",
+      "Principal": {
+        "Service": "ecs-tasks.amazonaws.com"
+      },
+      "Action": "sts:AssumeRole"
+    }
+  ]
+}`
+
+	// taskRolePolicyName is the name of the inline policy flecs manages on
+	// task roles
+	taskRolePolicyName = "flecs"
+
+	// executionRolePolicyName is the name of the inline policy that allows
+	// the execution role to read secrets and environment files
+	executionRolePolicyName = "flecs-secrets"
+
+	ecsTaskExecutionRolePolicy = "arn:aws:iam::aws:policy/service-role/AmazonECSTaskExecutionRolePolicy"
+
+	// maxRoleNameLength is the longest name IAM allows for a role
+	maxRoleNameLength = 64
+)
+
+// IAMRole configures the task role that flecs manages for a definition
+type IAMRole struct {
+	ManagedPolicies     []string          `yaml:"managed_policies"`
+	Statements          []PolicyStatement `yaml:"statements"`
+	PermissionsBoundary string            `yaml:"permissions_boundary"`
+	Tags                map[string]string `yaml:"tags"`
+}
+
+// PolicyStatement is a statement in an IAM policy. The effect is Allow unless
+// set otherwise
+type PolicyStatement struct {
+	Sid       string                           `yaml:"sid" json:"Sid,omitempty"`
+	Effect    string                           `yaml:"effect" json:"Effect"`
+	Action    stringList                       `yaml:"action" json:"Action"`
+	Resource  stringList                       `yaml:"resource" json:"Resource"`
+	Condition map[string]map[string]stringList `yaml:"condition" json:"Condition,omitempty"`
+}
+
+// stringList can be configured as either a single string or a list
+type stringList []string
+
+// UnmarshalYAML parses either a string or a list of strings
+func (s *stringList) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var value string
+	if unmarshal(&value) == nil {
+		*s = stringList{value}
+		return err
+	}
+
+	var values []string
+	err = unmarshal(&values)
+	if err != nil {
+		return err
+	}
+
+	*s = values
+	return err
+}
+
+// executeCommandStatement allows the SSM agent in a task to open the
+// channels that aws ecs execute-command uses
+var executeCommandStatement = PolicyStatement{
+	Sid:    "ExecuteCommand",
+	Effect: "Allow",
+	Action: stringList{
+		"ssmmessages:CreateControlChannel",
+		"ssmmessages:CreateDataChannel",
+		"ssmmessages:OpenControlChannel",
+		"ssmmessages:OpenDataChannel",
+	},
+	Resource: stringList{"*"},
+}
+
+// executeCommandEnabled returns true if any service using the definition
+// enables execute command
+func (cfg Config) executeCommandEnabled(definition string) bool {
+	for _, service := range cfg.Services {
+		if service.Definition == definition && service.EnableExecuteCommand {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enabled returns true if flecs should manage the task role
+func (r IAMRole) enabled() bool {
+	return len(r.ManagedPolicies) > 0 || len(r.Statements) > 0 || r.PermissionsBoundary != "" || len(r.Tags) > 0
+}
+
+// validate checks the role configuration
+func (r IAMRole) validate() (err error) {
+	for _, policy := range r.ManagedPolicies {
+		if !strings.HasPrefix(policy, "arn:") {
+			return fmt.Errorf("managed policy %s must be an ARN", policy)
+		}
+	}
+
+	if r.PermissionsBoundary != "" && !strings.HasPrefix(r.PermissionsBoundary, "arn:") {
+		return fmt.Errorf("permissions_boundary must be an ARN")
+	}
+
+	for i, statement := range r.Statements {
+		if statement.Effect != "" && statement.Effect != "Allow" && statement.Effect != "Deny" {
+			return fmt.Errorf("invalid effect %s in statement %d, must be Allow or Deny", statement.Effect, i)
+		}
+
+		if len(statement.Action) == 0 || len(statement.Resource) == 0 {
+			return fmt.Errorf("must specify action and resource in statement %d", i)
+		}
+	}
+
+	return err
+}
+
+// policyDocument returns the inline policy for the statements
+func (r IAMRole) policyDocument() (document string, err error) {
+	var statements []PolicyStatement
+	for _, statement := range r.Statements {
+		if statement.Effect == "" {
+			statement.Effect = "Allow"
+		}
+
+		statements = append(statements, statement)
+	}
+
+	policy := map[string]interface{}{
+		"Version":   "2012-10-17",
+		"Statement": statements,
+	}
+
+	data, err := json.Marshal(policy)
+	return string(data), err
+}
+
+// taskRoleName returns the name of the task role flecs manages for the
+// definition, which is unique to the project, definition and environment
+func (cfg Config) taskRoleName(definition string) string {
+	parts := []string{"flecs", cfg.ProjectName, definition}
+	if cfg.EnvironmentName != "" {
+		parts = append(parts, cfg.EnvironmentName)
+	}
+
+	return shortenRoleName(strings.Join(parts, "-"))
+}
+
+// shortenRoleName fits a role name within the IAM limit. Long names are cut
+// short and end with a hash of the full name, so that names which only
+// differ at the end, such as the environment, still get their own role
+func shortenRoleName(name string) string {
+	if len(name) <= maxRoleNameLength {
+		return name
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:8]
+	return name[:maxRoleNameLength-len(hash)-1] + "-" + hash
+}
+
+// executionRoleName returns the name of the execution role flecs manages,
+// which is unique to the project and environment
+func (cfg Config) executionRoleName() string {
+	parts := []string{"flecs", cfg.ProjectName}
+	if cfg.EnvironmentName != "" {
+		parts = append(parts, cfg.EnvironmentName)
+	}
+
+	return shortenRoleName(strings.Join(append(parts, "execution"), "-"))
+}
+
+// secretARNs returns the ARNs of the SSM parameters and Secrets Manager
+// secrets that tasks read when they start: the configured secrets, registry
+// credentials and log driver secrets
+func (cfg Config) secretARNs(accountID string) (parameters, secrets []string) {
+	var values []string
+	resolved := cfg.resolveSecrets(accountID)
+	for _, name := range sortedKeys(resolved) {
+		value := resolved[name]
+
+		// Secrets Manager adds a random suffix to the ARN of the secrets
+		// that flecs manages, which only have a partial ARN here
+		if cfg.Options.Secrets[name] == "" && cfg.Options.SecretsStore == secretsStoreSecretsManager {
+			value += "-??????"
+		}
+
+		values = append(values, value)
+	}
+
+	var names []string
+	for name := range cfg.Definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		definition := cfg.Definitions[name]
+		for _, container := range definition.Containers {
+			if container.RepositoryCredentials != "" {
+				values = append(values, container.RepositoryCredentials)
+			}
+
+			for _, key := range sortedKeys(container.Logging.SecretOptions) {
+				values = append(values, container.Logging.SecretOptions[key])
+			}
+		}
+
+		for _, key := range sortedKeys(definition.Logging.SecretOptions) {
+			values = append(values, definition.Logging.SecretOptions[key])
+		}
+	}
+
+	for _, value := range values {
+		switch {
+		case strings.HasPrefix(value, "arn:") && strings.Contains(value, ":secretsmanager:"):
+			// Secrets can refer to a JSON key, stage or version after the
+			// ARN of the secret
+			parts := strings.Split(value, ":")
+			if len(parts) > 7 {
+				value = strings.Join(parts[:7], ":")
+			}
+
+			if !stringInSlice(value, secrets) {
+				secrets = append(secrets, value)
+			}
+		case strings.HasPrefix(value, "arn:"):
+			if !stringInSlice(value, parameters) {
+				parameters = append(parameters, value)
+			}
+		default:
+			// Parameters in the same region can be referred to by name
+			arn := fmt.Sprintf("arn:aws:ssm:%s:%s:parameter/%s", cfg.Options.Region, accountID, strings.TrimPrefix(value, "/"))
+			if !stringInSlice(arn, parameters) {
+				parameters = append(parameters, arn)
+			}
+		}
+	}
+
+	return parameters, secrets
+}
+
+// executionRolePolicy returns the inline policy that allows the execution
+// role to read exactly the secrets and S3 environment files in the
+// configuration, or an empty string if there are none
+func (cfg Config) executionRolePolicy(accountID string) (document string, err error) {
+	parameters, secrets := cfg.secretARNs(accountID)
+
+	var role IAMRole
+	var services []string
+	if len(parameters) > 0 {
+		role.Statements = append(role.Statements, PolicyStatement{
+			Action:   stringList{"ssm:GetParameters"},
+			Resource: parameters,
+		})
+		services = append(services, fmt.Sprintf("ssm.%s.amazonaws.com", cfg.Options.Region))
+	}
+
+	if len(secrets) > 0 {
+		role.Statements = append(role.Statements, PolicyStatement{
+			Action:   stringList{"secretsmanager:GetSecretValue"},
+			Resource: secrets,
+		})
+		services = append(services, fmt.Sprintf("secretsmanager.%s.amazonaws.com", cfg.Options.Region))
+	}
+
+	// Secrets can be encrypted with customer managed keys, which can only
+	// be used to decrypt them through SSM and Secrets Manager
+	if len(services) > 0 {
+		role.Statements = append(role.Statements, PolicyStatement{
+			Action:    stringList{"kms:Decrypt"},
+			Resource:  stringList{"*"},
+			Condition: map[string]map[string]stringList{"StringEquals": {"kms:ViaService": services}},
+		})
+	}
+
+	objects, buckets := cfg.environmentFileARNs()
+	if len(objects) > 0 {
+		role.Statements = append(role.Statements, PolicyStatement{
+			Action:   stringList{"s3:GetObject"},
+			Resource: objects,
+		}, PolicyStatement{
+			Action:   stringList{"s3:GetBucketLocation"},
+			Resource: buckets,
+		})
+	}
+
+	if len(role.Statements) == 0 {
+		return document, err
+	}
+
+	return role.policyDocument()
+}
+
+// environmentFileARNs returns the S3 objects of the environment files, and
+// the buckets they are in
+func (cfg Config) environmentFileARNs() (objects, buckets []string) {
+	for _, file := range cfg.Options.EnvironmentFiles {
+		if !isS3EnvironmentFile(file) {
+			continue
+		}
+
+		objects = append(objects, file)
+
+		bucket := strings.SplitN(file, "/", 2)[0]
+		if !stringInSlice(bucket, buckets) {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	return objects, buckets
+}
+
+// createExecutionRole creates the execution role for the project and
+// environment if it doesn't exist, and updates its policy to read the
+// configured secrets and environment files. It returns the ARN of the role
+func createExecutionRole(ctx context.Context, c Clients, cfg Config, accountID string) (roleArn string, err error) {
+	roleName := cfg.executionRoleName()
+
+	role, err := getRole(ctx, c, roleName)
+	if err != nil {
+		return roleArn, err
+	}
+
+	if role == nil {
+		resp, err := c.IAM.CreateRoleWithContext(ctx, &iam.CreateRoleInput{
+			AssumeRolePolicyDocument: aws.String(ecsTasksAssumeRolePolicy),
+			Description:              aws.String("Execution role managed by flecs"),
+			RoleName:                 aws.String(roleName),
+		})
+		if err != nil {
+			return roleArn, err
+		}
+
+		Log.Infof("Created role %s", roleName)
+		role = resp.Role
+	}
+
+	attached, err := attachedRolePolicies(ctx, c, roleName)
+	if err != nil {
+		return roleArn, err
+	}
+
+	if !stringInSlice(ecsTaskExecutionRolePolicy, attached) {
+		_, err = c.IAM.AttachRolePolicyWithContext(ctx, &iam.AttachRolePolicyInput{
+			PolicyArn: aws.String(ecsTaskExecutionRolePolicy),
+			RoleName:  aws.String(roleName),
+		})
+		if err != nil {
+			return roleArn, err
+		}
+	}
+
+	document, err := cfg.executionRolePolicy(accountID)
+	if err != nil {
+		return roleArn, err
+	}
+
+	if document == "" {
+		err = deleteRolePolicy(ctx, c, roleName, executionRolePolicyName)
+	} else {
+		err = putRolePolicy(ctx, c, roleName, executionRolePolicyName, document)
+	}
+
+	return aws.StringValue(role.Arn), err
+}
+
+// createTaskRole creates the task role if it doesn't exist, and updates it to
+// match the configuration. It returns the ARN of the role
+func (r IAMRole) createTaskRole(ctx context.Context, c Clients, roleName string) (roleArn string, err error) {
+	role, err := getRole(ctx, c, roleName)
+	if err != nil {
+		return roleArn, err
+	}
+
+	if role == nil {
+		input := iam.CreateRoleInput{
+			AssumeRolePolicyDocument: aws.String(ecsTasksAssumeRolePolicy),
+			Description:              aws.String("Task role managed by flecs"),
+			RoleName:                 aws.String(roleName),
+		}
+
+		if r.PermissionsBoundary != "" {
+			input.SetPermissionsBoundary(r.PermissionsBoundary)
+		}
+
+		for _, key := range sortedKeys(r.Tags) {
+			input.Tags = append(input.Tags, &iam.Tag{Key: aws.String(key), Value: aws.String(r.Tags[key])})
+		}
+
+		resp, err := c.IAM.CreateRoleWithContext(ctx, &input)
+		if err != nil {
+			return roleArn, err
+		}
+
+		Log.Infof("Created role %s", roleName)
+		role = resp.Role
+	} else {
+		err = r.update(ctx, c, role)
+		if err != nil {
+			return roleArn, err
+		}
+	}
+
+	err = r.applyPolicies(ctx, c, roleName)
+	if err != nil {
+		return roleArn, err
+	}
+
+	return aws.StringValue(role.Arn), err
+}
+
+// update changes the permissions boundary and tags of an existing role
+func (r IAMRole) update(ctx context.Context, c Clients, role *iam.Role) (err error) {
+	var boundary string
+	if role.PermissionsBoundary != nil {
+		boundary = aws.StringValue(role.PermissionsBoundary.PermissionsBoundaryArn)
+	}
+
+	if r.PermissionsBoundary != boundary {
+		if r.PermissionsBoundary == "" {
+			_, err = c.IAM.DeleteRolePermissionsBoundaryWithContext(ctx, &iam.DeleteRolePermissionsBoundaryInput{
+				RoleName: role.RoleName,
+			})
+		} else {
+			_, err = c.IAM.PutRolePermissionsBoundaryWithContext(ctx, &iam.PutRolePermissionsBoundaryInput{
+				PermissionsBoundary: aws.String(r.PermissionsBoundary),
+				RoleName:            role.RoleName,
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		Log.Infof("Updated permissions boundary of role %s", aws.StringValue(role.RoleName))
+	}
+
+	existing := make(map[string]string)
+	for _, tag := range role.Tags {
+		existing[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	var tags []*iam.Tag
+	for _, key := range sortedKeys(r.Tags) {
+		if value, ok := existing[key]; !ok || value != r.Tags[key] {
+			tags = append(tags, &iam.Tag{Key: aws.String(key), Value: aws.String(r.Tags[key])})
+		}
+	}
+
+	if len(tags) > 0 {
+		_, err = c.IAM.TagRoleWithContext(ctx, &iam.TagRoleInput{
+			RoleName: role.RoleName,
+			Tags:     tags,
+		})
+		if err != nil {
+			return err
+		}
+
+		Log.Infof("Tagged role %s", aws.StringValue(role.RoleName))
+	}
+
+	return err
+}
+
+// applyPolicies attaches the managed policies and puts the inline policy,
+// removing any that are no longer configured
+func (r IAMRole) applyPolicies(ctx context.Context, c Clients, roleName string) (err error) {
+	attached, err := attachedRolePolicies(ctx, c, roleName)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range r.ManagedPolicies {
+		if stringInSlice(policy, attached) {
+			continue
+		}
+
+		_, err = c.IAM.AttachRolePolicyWithContext(ctx, &iam.AttachRolePolicyInput{
+			PolicyArn: aws.String(policy),
+			RoleName:  aws.String(roleName),
+		})
+		if err != nil {
+			return err
+		}
+
+		Log.Infof("Attached policy %s to role %s", policy, roleName)
+	}
+
+	for _, policy := range attached {
+		if stringInSlice(policy, r.ManagedPolicies) {
+			continue
+		}
+
+		_, err = c.IAM.DetachRolePolicyWithContext(ctx, &iam.DetachRolePolicyInput{
+			PolicyArn: aws.String(policy),
+			RoleName:  aws.String(roleName),
+		})
+		if err != nil {
+			return err
+		}
+
+		Log.Infof("Detached policy %s from role %s", policy, roleName)
+	}
+
+	if len(r.Statements) == 0 {
+		return deleteRolePolicy(ctx, c, roleName, taskRolePolicyName)
+	}
+
+	document, err := r.policyDocument()
+	if err != nil {
+		return err
+	}
+
+	return putRolePolicy(ctx, c, roleName, taskRolePolicyName, document)
+}
+
+// getRole returns the role, or nil if it doesn't exist
+func getRole(ctx context.Context, c Clients, roleName string) (role *iam.Role, err error) {
+	resp, err := c.IAM.GetRoleWithContext(ctx, &iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+		return role, nil
+	}
+
+	if err != nil {
+		return role, err
+	}
+
+	return resp.Role, err
+}
+
+// attachedRolePolicies returns the ARNs of the managed policies attached to
+// the role
+func attachedRolePolicies(ctx context.Context, c Clients, roleName string) (policies []string, err error) {
+	err = c.IAM.ListAttachedRolePoliciesPagesWithContext(ctx, &iam.ListAttachedRolePoliciesInput{
+		RoleName: aws.String(roleName),
+	}, func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+		for _, policy := range page.AttachedPolicies {
+			policies = append(policies, aws.StringValue(policy.PolicyArn))
+		}
+
+		return true
+	})
+
+	return policies, err
+}
+
+// putRolePolicy sets an inline policy on the role if it has changed
+func putRolePolicy(ctx context.Context, c Clients, roleName, policyName, document string) (err error) {
+	resp, err := c.IAM.GetRolePolicyWithContext(ctx, &iam.GetRolePolicyInput{
+		PolicyName: aws.String(policyName),
+		RoleName:   aws.String(roleName),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+		err = nil
+	} else if err != nil {
+		return err
+	} else {
+		// IAM returns the policy document URL encoded
+		existing, err := url.QueryUnescape(aws.StringValue(resp.PolicyDocument))
+		if err == nil && equalJSON(existing, document) {
+			return err
+		}
+	}
+
+	_, err = c.IAM.PutRolePolicyWithContext(ctx, &iam.PutRolePolicyInput{
+		PolicyDocument: aws.String(document),
+		PolicyName:     aws.String(policyName),
+		RoleName:       aws.String(roleName),
+	})
+	if err != nil {
+		return err
+	}
+
+	Log.Infof("Updated policy %s on role %s", policyName, roleName)
+	return err
+}
+
+// deleteRolePolicy removes an inline policy from the role if it exists
+func deleteRolePolicy(ctx context.Context, c Clients, roleName, policyName string) (err error) {
+	_, err = c.IAM.DeleteRolePolicyWithContext(ctx, &iam.DeleteRolePolicyInput{
+		PolicyName: aws.String(policyName),
+		RoleName:   aws.String(roleName),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+		return nil
+	}
+
+	return err
+}
+
+// deleteRole removes the policies from the role and deletes it
+func deleteRole(ctx context.Context, c Clients, roleName string) (err error) {
+	role, err := getRole(ctx, c, roleName)
+	if err != nil || role == nil {
+		return err
+	}
+
+	attached, err := attachedRolePolicies(ctx, c, roleName)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range attached {
+		_, err = c.IAM.DetachRolePolicyWithContext(ctx, &iam.DetachRolePolicyInput{
+			PolicyArn: aws.String(policy),
+			RoleName:  aws.String(roleName),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var inline []string
+	err = c.IAM.ListRolePoliciesPagesWithContext(ctx, &iam.ListRolePoliciesInput{
+		RoleName: aws.String(roleName),
+	}, func(page *iam.ListRolePoliciesOutput, lastPage bool) bool {
+		inline = append(inline, aws.StringValueSlice(page.PolicyNames)...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range inline {
+		err = deleteRolePolicy(ctx, c, roleName, policy)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = c.IAM.DeleteRoleWithContext(ctx, &iam.DeleteRoleInput{RoleName: aws.String(roleName)})
+	return err
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestIAMRolePolicyDocument(t *testing.T) {
+	var role IAMRole
+	err := yaml.Unmarshal([]byte(`
+statements:
+  - action: s3:GetObject
+    resource:
+      - arn:aws:s3:::media/*
+    condition:
+      StringEquals:
+        aws:SourceVpc: vpc-1
+  - effect: Deny
+    action: [s3:DeleteObject]
+    resource: "*"
+`), &role)
+	assert.Nil(t, err)
+	assert.Nil(t, role.validate())
+
+	document, err := role.policyDocument()
+	assert.Nil(t, err)
+	assert.True(t, equalJSON(`{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Effect": "Allow",
+      "Action": ["s3:GetObject"],
+      "Resource": ["arn:aws:s3:::media/*"],
+      "Condition": {"StringEquals": {"aws:SourceVpc": ["vpc-1"]}}
+    },
+    {
+      "Effect": "Deny",
+      "Action": ["s3:DeleteObject"],
+      "Resource": ["*"]
+    }
+  ]
+}`, document), document)
+
+	assert.NotNil(t, IAMRole{ManagedPolicies: []string{"AmazonS3ReadOnlyAccess"}}.validate())
+	assert.NotNil(t, IAMRole{Statements: []PolicyStatement{{Effect: "Maybe", Action: stringList{"s3:*"}, Resource: stringList{"*"}}}}.validate())
+	assert.NotNil(t, IAMRole{Statements: []PolicyStatement{{Action: stringList{"s3:*"}}}}.validate())
+}
+
+func TestTaskRoleName(t *testing.T) {
+	cfg := Config{ProjectName: "shop"}
+	assert.Equal(t, "flecs-shop-web", cfg.taskRoleName("web"))
+
+	cfg.EnvironmentName = "production"
+	assert.Equal(t, "flecs-shop-web-production", cfg.taskRoleName("web"))
+
+	cfg.ProjectName = strings.Repeat("a", 70)
+	assert.Len(t, cfg.taskRoleName("web"), maxRoleNameLength)
+
+	// Long names keep a hash of the environment, so each has its own role
+	staging := cfg
+	staging.EnvironmentName = "staging"
+	assert.NotEqual(t, cfg.taskRoleName("web"), staging.taskRoleName("web"))
+	assert.Len(t, staging.taskRoleName("web"), maxRoleNameLength)
+}
+
+func TestExecuteCommandEnabled(t *testing.T) {
+	cfg := Config{Services: map[string]Service{
+		"web":    {Definition: "web", EnableExecuteCommand: true},
+		"worker": {Definition: "worker"},
+	}}
+
+	assert.True(t, cfg.executeCommandEnabled("web"))
+	assert.False(t, cfg.executeCommandEnabled("worker"))
+}
+
+func TestCreateTaskRole(t *testing.T) {
+	ctx := context.Background()
+	role := IAMRole{
+		ManagedPolicies: []string{"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess"},
+		Statements:      []PolicyStatement{{Action: stringList{"sqs:SendMessage"}, Resource: stringList{"*"}}},
+		Tags:            map[string]string{"team": "web"},
+	}
+
+	document, err := role.policyDocument()
+	assert.Nil(t, err)
+
+	// A new role is created with the policies
+	var calls []string
+	clients := Clients{IAM: mockedIAMClient{
+		GetRolePolicyErr: awserr.New(iam.ErrCodeNoSuchEntityException, "not found", nil),
+		Calls:            &calls,
+	}}
+
+	arn, err := role.createTaskRole(ctx, clients, "flecs-shop-web")
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/flecs-shop-web", arn)
+	assert.Equal(t, []string{"CreateRole", "AttachRolePolicy", "PutRolePolicy"}, calls)
+
+	// An existing role has old policies removed, and is left alone if
+	// nothing else changed
+	calls = nil
+	clients.IAM = mockedIAMClient{
+		Role: &iam.Role{
+			Arn:      aws.String("arn:aws:iam::123456789012:role/flecs-shop-web"),
+			RoleName: aws.String("flecs-shop-web"),
+			Tags:     []*iam.Tag{{Key: aws.String("team"), Value: aws.String("web")}},
+		},
+		AttachedPolicies:  []string{"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess", "arn:aws:iam::aws:policy/AdministratorAccess"},
+		GetRolePolicyResp: iam.GetRolePolicyOutput{PolicyDocument: aws.String(url.QueryEscape(document))},
+		Calls:             &calls,
+	}
+
+	_, err = role.createTaskRole(ctx, clients, "flecs-shop-web")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DetachRolePolicy"}, calls)
+
+	// Deleting the role removes its policies first
+	calls = nil
+	clients.IAM = mockedIAMClient{
+		Role:             &iam.Role{RoleName: aws.String("flecs-shop-web")},
+		AttachedPolicies: []string{"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess"},
+		InlinePolicies:   []string{"flecs"},
+		Calls:            &calls,
+	}
+
+	err = deleteRole(ctx, clients, "flecs-shop-web")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DetachRolePolicy", "DeleteRolePolicy", "DeleteRole"}, calls)
+}
+
+func TestExecutionRolePolicy(t *testing.T) {
+	cfg := Config{
+		ProjectName: "shop",
+		Options: ConfigOptions{
+			Region: "eu-west-1",
+			Secrets: map[string]string{
+				"DB_PASSWORD": "/shop/db-password",
+				"API_KEY":     "arn:aws:secretsmanager:eu-west-1:123456789012:secret:api-AbCdEf:key::",
+				"TOKEN":       "arn:aws:ssm:eu-west-1:123456789012:parameter/shop/token",
+			},
+		},
+		Definitions: map[string]Definition{
+			"web": {Containers: []Container{
+				{Name: "web", RepositoryCredentials: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:registry-AbCdEf"},
+			}},
+		},
+	}
+
+	assert.Equal(t, "flecs-shop-execution", cfg.executionRoleName())
+
+	// Environments of long projects don't share a role, or they would
+	// replace each other's secrets policy
+	long := Config{ProjectName: strings.Repeat("a", 64), EnvironmentName: "production-" + strings.Repeat("b", 64)}
+	other := long
+	other.EnvironmentName = "production-" + strings.Repeat("b", 63) + "c"
+	assert.Len(t, long.executionRoleName(), maxRoleNameLength)
+	assert.Len(t, other.executionRoleName(), maxRoleNameLength)
+	assert.NotEqual(t, long.executionRoleName(), other.executionRoleName())
+
+	document, err := cfg.executionRolePolicy("123456789012")
+	assert.Nil(t, err)
+	assert.True(t, equalJSON(`{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Effect": "Allow",
+      "Action": ["ssm:GetParameters"],
+      "Resource": [
+        "arn:aws:ssm:eu-west-1:123456789012:parameter/shop/db-password",
+        "arn:aws:ssm:eu-west-1:123456789012:parameter/shop/token"
+      ]
+    },
+    {
+      "Effect": "Allow",
+      "Action": ["secretsmanager:GetSecretValue"],
+      "Resource": [
+        "arn:aws:secretsmanager:eu-west-1:123456789012:secret:api-AbCdEf",
+        "arn:aws:secretsmanager:eu-west-1:123456789012:secret:registry-AbCdEf"
+      ]
+    },
+    {
+      "Effect": "Allow",
+      "Action": ["kms:Decrypt"],
+      "Resource": ["*"],
+      "Condition": {"StringEquals": {"kms:ViaService": ["ssm.eu-west-1.amazonaws.com", "secretsmanager.eu-west-1.amazonaws.com"]}}
+    }
+  ]
+}`, document), document)
+
+	document, err = Config{}.executionRolePolicy("123456789012")
+	assert.Nil(t, err)
+	assert.Equal(t, "", document)
+
+	// Environment files in S3 don't need KMS
+	document, err = Config{Options: ConfigOptions{EnvironmentFiles: []string{"arn:aws:s3:::shop-config/production.env"}}}.executionRolePolicy("123456789012")
+	assert.Nil(t, err)
+	assert.True(t, equalJSON(`{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Effect": "Allow",
+      "Action": ["s3:GetObject"],
+      "Resource": ["arn:aws:s3:::shop-config/production.env"]
+    },
+    {
+      "Effect": "Allow",
+      "Action": ["s3:GetBucketLocation"],
+      "Resource": ["arn:aws:s3:::shop-config"]
+    }
+  ]
+}`, document), document)
+}
+
+func TestCreateExecutionRole(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{
+		ProjectName:     "shop",
+		EnvironmentName: "production",
+		Options:         ConfigOptions{Region: "eu-west-1", Secrets: map[string]string{"DB_PASSWORD": "db-password"}},
+	}
+
+	var calls, documents []string
+	clients := Clients{IAM: mockedIAMClient{
+		GetRolePolicyErr:       awserr.New(iam.ErrCodeNoSuchEntityException, "not found", nil),
+		PutRolePolicyDocuments: &documents,
+		Calls:                  &calls,
+	}}
+
+	arn, err := createExecutionRole(ctx, clients, cfg, "123456789012")
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/flecs-shop-production-execution", arn)
+	assert.Equal(t, []string{"CreateRole", "AttachRolePolicy", "PutRolePolicy"}, calls)
+	assert.Contains(t, documents[0], "arn:aws:ssm:eu-west-1:123456789012:parameter/db-password")
+
+	// The policy is removed when there are no secrets
+	calls = nil
+	cfg.Options.Secrets = nil
+	clients.IAM = mockedIAMClient{
+		Role:             &iam.Role{Arn: aws.String(arn), RoleName: aws.String("flecs-shop-production-execution")},
+		AttachedPolicies: []string{ecsTaskExecutionRolePolicy},
+		Calls:            &calls,
+	}
+
+	_, err = createExecutionRole(ctx, clients, cfg, "123456789012")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DeleteRolePolicy"}, calls)
+}
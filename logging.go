@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+	// logDriverNone turns off logging for a container
+	logDriverNone = "none"
+
+	// logRouterName is the name of the fluent-bit container added to route
+	// logs sent with awsfirelens
+	logRouterName = "log_router"
+
+	defaultLogRouterImage = "public.ecr.aws/aws-observability/aws-for-fluent-bit:stable"
+)
+
+// logDrivers are the log drivers that can be configured
+var logDrivers = []string{ecs.LogDriverAwslogs, ecs.LogDriverAwsfirelens, ecs.LogDriverSplunk, logDriverNone}
+
+// logRetentionDays are the retention periods CloudWatch Logs accepts
+var logRetentionDays = []int64{1, 3, 5, 7, 14, 30, 60, 90, 120, 150, 180, 365, 400, 545, 731, 1096, 1827, 2192, 2557, 2922, 3288, 3653}
+
+// Logging configures where a container sends its logs. The driver is awslogs
+// unless set otherwise
+type Logging struct {
+	Driver        string            `yaml:"driver"`
+	Options       map[string]string `yaml:"options"`
+	SecretOptions map[string]string `yaml:"secret_options"`
+
+	// These options only apply to awslogs
+	RetentionDays    int64  `yaml:"retention_days"`
+	MultilinePattern string `yaml:"multiline_pattern"`
+	DatetimeFormat   string `yaml:"datetime_format"`
+
+	// LogRouter configures the fluent-bit container used by awsfirelens
+	LogRouter LogRouter `yaml:"log_router"`
+}
+
+// LogRouter configures the fluent-bit sidecar that routes logs for
+// containers using awsfirelens
+type LogRouter struct {
+	Image string `yaml:"image"`
+
+	// ConfigFile is an extra fluent-bit configuration file, either the ARN
+	// of an object in S3 or a path in the image
+	ConfigFile string            `yaml:"config_file"`
+	Options    map[string]string `yaml:"options"`
+}
+
+// driver returns the log driver, which defaults to awslogs
+func (l Logging) driver() string {
+	if l.Driver == "" {
+		return ecs.LogDriverAwslogs
+	}
+
+	return l.Driver
+}
+
+// validate checks the logging configuration
+func (l Logging) validate() (err error) {
+	driver := l.driver()
+	if !stringInSlice(driver, logDrivers) {
+		return fmt.Errorf("invalid log driver %s, must be one of %s", driver, strings.Join(logDrivers, ", "))
+	}
+
+	if driver != ecs.LogDriverAwslogs && (l.RetentionDays != 0 || l.MultilinePattern != "" || l.DatetimeFormat != "") {
+		return fmt.Errorf("retention_days, multiline_pattern and datetime_format can only be used with awslogs")
+	}
+
+	if l.RetentionDays != 0 && !int64InSlice(l.RetentionDays, logRetentionDays) {
+		return fmt.Errorf("invalid log retention_days %d", l.RetentionDays)
+	}
+
+	if driver != ecs.LogDriverAwsfirelens && !reflect.DeepEqual(l.LogRouter, LogRouter{}) {
+		return fmt.Errorf("log_router can only be used with awsfirelens")
+	}
+
+	if driver == ecs.LogDriverSplunk && l.Options["splunk-url"] == "" {
+		return fmt.Errorf("must specify splunk-url option for splunk")
+	}
+
+	return err
+}
+
+// awslogsOptions returns the options for the awslogs driver, which send logs
+// to the project's log group unless overridden
+func (l Logging) awslogsOptions(cfg Config, logStreamPrefix, logGroupName string) map[string]string {
+	options := map[string]string{
+		"awslogs-region":        cfg.Options.Region,
+		"awslogs-stream-prefix": logStreamPrefix,
+		"awslogs-group":         logGroupName,
+	}
+
+	if l.MultilinePattern != "" {
+		options["awslogs-multiline-pattern"] = l.MultilinePattern
+	}
+
+	if l.DatetimeFormat != "" {
+		options["awslogs-datetime-format"] = l.DatetimeFormat
+	}
+
+	for key, value := range l.Options {
+		options[key] = value
+	}
+
+	return options
+}
+
+// logConfiguration returns the log configuration for a container, or nil if
+// logging is turned off
+func (l Logging) logConfiguration(cfg Config, logStreamPrefix, logGroupName string) *ecs.LogConfiguration {
+	driver := l.driver()
+	if driver == logDriverNone {
+		return nil
+	}
+
+	config := ecs.LogConfiguration{LogDriver: aws.String(driver)}
+
+	if driver == ecs.LogDriverAwslogs {
+		config.SetOptions(aws.StringMap(l.awslogsOptions(cfg, logStreamPrefix, logGroupName)))
+	} else if len(l.Options) > 0 {
+		config.SetOptions(aws.StringMap(l.Options))
+	}
+
+	for _, name := range sortedKeys(l.SecretOptions) {
+		config.SecretOptions = append(config.SecretOptions, &ecs.Secret{
+			Name:      aws.String(name),
+			ValueFrom: aws.String(l.SecretOptions[name]),
+		})
+	}
+
+	return &config
+}
+
+// containerLogging returns the logging configuration of a container, which
+// is the definition's unless the container sets its own. The log router
+// always logs to awslogs
+func (d Definition) containerLogging(name string) Logging {
+	for _, container := range d.Containers {
+		if container.Name != name {
+			continue
+		}
+
+		if !reflect.DeepEqual(container.Logging, Logging{}) {
+			return container.Logging
+		}
+
+		return d.Logging
+	}
+
+	return Logging{}
+}
+
+// usesLogDriver returns true if any container logs with the driver
+func (d Definition) usesLogDriver(driver string) bool {
+	for _, container := range d.Containers {
+		if d.containerLogging(container.Name).driver() == driver {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateLogging checks the logging configuration of the definition and of
+// each container
+func (d Definition) validateLogging() (err error) {
+	err = d.Logging.validate()
+	if err != nil {
+		return err
+	}
+
+	for _, container := range d.Containers {
+		err = container.Logging.validate()
+		if err != nil {
+			return fmt.Errorf("container %s: %s", container.Name, err)
+		}
+
+		if !reflect.DeepEqual(container.Logging.LogRouter, LogRouter{}) {
+			return fmt.Errorf("container %s: log_router can only be set on the definition", container.Name)
+		}
+	}
+
+	if d.usesLogDriver(ecs.LogDriverAwsfirelens) {
+		for _, container := range d.Containers {
+			if container.Name == logRouterName {
+				return fmt.Errorf("cannot name a container %s when using awsfirelens", logRouterName)
+			}
+		}
+	}
+
+	return err
+}
+
+// logRetention returns the retention to set on each log group that awslogs
+// sends logs to, or 0 to leave it alone
+func (d Definition) logRetention(cfg Config, logGroupName string) map[string]int64 {
+	groups := make(map[string]int64)
+
+	if d.usesLogDriver(ecs.LogDriverAwsfirelens) {
+		groups[logGroupName] = 0
+	}
+
+	for _, container := range d.Containers {
+		logging := d.containerLogging(container.Name)
+		if logging.driver() != ecs.LogDriverAwslogs {
+			continue
+		}
+
+		group := logging.awslogsOptions(cfg, "", logGroupName)["awslogs-group"]
+		if logging.RetentionDays != 0 || groups[group] == 0 {
+			groups[group] = logging.RetentionDays
+		}
+	}
+
+	// Use the retention from the configuration for any group that doesn't
+	// set its own
+	for group, retentionDays := range groups {
+		if retentionDays == 0 {
+			groups[group] = cfg.Options.LogRetentionDays
+		}
+	}
+
+	return groups
+}
+
+// logRouterDefinition returns the fluent-bit container that routes logs for
+// containers using awsfirelens
+func (d Definition) logRouterDefinition(cfg Config, logStreamPrefix, logGroupName string) *ecs.ContainerDefinition {
+	router := d.Logging.LogRouter
+
+	image := router.Image
+	if image == "" {
+		image = defaultLogRouterImage
+	}
+
+	options := make(map[string]string)
+	for key, value := range router.Options {
+		options[key] = value
+	}
+
+	if router.ConfigFile != "" {
+		options["config-file-type"] = "file"
+		if strings.HasPrefix(router.ConfigFile, "arn:") {
+			options["config-file-type"] = "s3"
+		}
+
+		options["config-file-value"] = router.ConfigFile
+	}
+
+	firelens := ecs.FirelensConfiguration{Type: aws.String(ecs.FirelensConfigurationTypeFluentbit)}
+	if len(options) > 0 {
+		firelens.SetOptions(aws.StringMap(options))
+	}
+
+	return &ecs.ContainerDefinition{
+		Essential:             aws.Bool(true),
+		FirelensConfiguration: &firelens,
+		Image:                 aws.String(image),
+		LogConfiguration:      Logging{}.logConfiguration(cfg, logStreamPrefix, logGroupName),
+		Name:                  aws.String(logRouterName),
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggingValidate(t *testing.T) {
+	assert.Nil(t, Logging{}.validate())
+	assert.Nil(t, Logging{RetentionDays: 30, MultilinePattern: "^INFO"}.validate())
+	assert.Nil(t, Logging{Driver: "awsfirelens", LogRouter: LogRouter{ConfigFile: "/fluent-bit/etc/extra.conf"}}.validate())
+	assert.Nil(t, Logging{Driver: "splunk", Options: map[string]string{"splunk-url": "https://splunk"}}.validate())
+	assert.Nil(t, Logging{Driver: "none"}.validate())
+
+	assert.NotNil(t, Logging{Driver: "syslog"}.validate())
+	assert.NotNil(t, Logging{RetentionDays: 10}.validate())
+	assert.NotNil(t, Logging{Driver: "none", RetentionDays: 30}.validate())
+	assert.NotNil(t, Logging{LogRouter: LogRouter{Image: "fluent-bit"}}.validate())
+	assert.NotNil(t, Logging{Driver: "splunk"}.validate())
+}
+
+func TestLoggingLogConfiguration(t *testing.T) {
+	cfg := Config{Options: ConfigOptions{Region: "eu-west-1"}}
+
+	assert.Equal(t, &ecs.LogConfiguration{
+		LogDriver: aws.String("awslogs"),
+		Options: aws.StringMap(map[string]string{
+			"awslogs-region":            "eu-west-1",
+			"awslogs-stream-prefix":     "web",
+			"awslogs-group":             "flecs",
+			"awslogs-datetime-format":   "%Y-%m-%d",
+			"awslogs-multiline-pattern": "^INFO",
+		}),
+	}, Logging{MultilinePattern: "^INFO", DatetimeFormat: "%Y-%m-%d"}.logConfiguration(cfg, "web", "flecs"))
+
+	assert.Equal(t, &ecs.LogConfiguration{
+		LogDriver:     aws.String("splunk"),
+		Options:       aws.StringMap(map[string]string{"splunk-url": "https://splunk"}),
+		SecretOptions: []*ecs.Secret{{Name: aws.String("splunk-token"), ValueFrom: aws.String("arn:aws:ssm:eu-west-1:1:parameter/splunk")}},
+	}, Logging{
+		Driver:        "splunk",
+		Options:       map[string]string{"splunk-url": "https://splunk"},
+		SecretOptions: map[string]string{"splunk-token": "arn:aws:ssm:eu-west-1:1:parameter/splunk"},
+	}.logConfiguration(cfg, "web", "flecs"))
+
+	assert.Nil(t, Logging{Driver: "none"}.logConfiguration(cfg, "web", "flecs"))
+}
+
+func TestDefinitionFireLens(t *testing.T) {
+	definition := Definition{
+		Logging: Logging{
+			Driver:    "awsfirelens",
+			Options:   map[string]string{"Name": "forward", "Host": "fluent-bit.internal"},
+			LogRouter: LogRouter{ConfigFile: "arn:aws:s3:::config/extra.conf"},
+		},
+		Containers: []Container{
+			{Name: "web", Image: "web", Essential: true},
+			{Name: "worker", Image: "worker", Logging: Logging{RetentionDays: 7}},
+			{Name: "cron", Image: "cron", Logging: Logging{Driver: "none"}},
+		},
+	}
+
+	assert.Nil(t, definition.validateLogging())
+
+	def, err := definition.generateContainerDefinitions(Config{}, "web", "flecs")
+	assert.Nil(t, err)
+	assert.Len(t, def, 4)
+
+	assert.Equal(t, "awsfirelens", aws.StringValue(def[0].LogConfiguration.LogDriver))
+	assert.Equal(t, "forward", aws.StringValue(def[0].LogConfiguration.Options["Name"]))
+	assert.Equal(t, "awslogs", aws.StringValue(def[1].LogConfiguration.LogDriver))
+	assert.Nil(t, def[2].LogConfiguration)
+
+	router := def[3]
+	assert.Equal(t, logRouterName, aws.StringValue(router.Name))
+	assert.Equal(t, defaultLogRouterImage, aws.StringValue(router.Image))
+	assert.Equal(t, "fluentbit", aws.StringValue(router.FirelensConfiguration.Type))
+	assert.Equal(t, aws.StringMap(map[string]string{
+		"config-file-type":  "s3",
+		"config-file-value": "arn:aws:s3:::config/extra.conf",
+	}), router.FirelensConfiguration.Options)
+	assert.Equal(t, "awslogs", aws.StringValue(router.LogConfiguration.LogDriver))
+
+	assert.Equal(t, map[string]int64{"flecs": 7}, definition.logRetention(Config{}, "flecs"))
+
+	definition.Containers[1].Logging = Logging{}
+	assert.Equal(t, map[string]int64{"flecs": 14}, definition.logRetention(Config{Options: ConfigOptions{LogRetentionDays: 14}}, "flecs"))
+
+	definition.Containers[1].Logging = Logging{Driver: "none"}
+	definition.Logging = Logging{Driver: "none"}
+	assert.Equal(t, map[string]int64{}, definition.logRetention(Config{}, "flecs"))
+
+	definition.Containers[0].Name = logRouterName
+	definition.Containers[0].Logging = Logging{Driver: "awsfirelens"}
+	assert.NotNil(t, definition.validateLogging())
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
 )
 
 // GetSecurityGroupIDs returns the IDs of security groups filtered by the
 // security group name
-func (c Clients) GetSecurityGroupIDs(names []string) (ids []string, err error) {
+func (c Clients) GetSecurityGroupIDs(ctx context.Context, names []string) (ids []string, err error) {
 	input := ec2.DescribeSecurityGroupsInput{
 		Filters: []*ec2.Filter{
 			{
@@ -18,7 +23,7 @@ func (c Clients) GetSecurityGroupIDs(names []string) (ids []string, err error) {
 		},
 	}
 
-	result, err := c.EC2.DescribeSecurityGroups(&input)
+	result, err := c.EC2.DescribeSecurityGroupsWithContext(ctx, &input)
 	if err != nil {
 		return ids, err
 	}
@@ -30,8 +35,52 @@ func (c Clients) GetSecurityGroupIDs(names []string) (ids []string, err error) {
 	return ids, err
 }
 
+// GetTargetGroupARNs returns the ARNs of target groups by their name
+func (c Clients) GetTargetGroupARNs(ctx context.Context, names []string) (arns map[string]string, err error) {
+	arns = make(map[string]string)
+
+	input := elbv2.DescribeTargetGroupsInput{
+		Names: aws.StringSlice(names),
+	}
+
+	err = c.ELBV2.DescribeTargetGroupsPagesWithContext(ctx, &input, func(page *elbv2.DescribeTargetGroupsOutput, lastPage bool) bool {
+		for _, g := range page.TargetGroups {
+			arns[aws.StringValue(g.TargetGroupName)] = aws.StringValue(g.TargetGroupArn)
+		}
+
+		return true
+	})
+
+	// The error doesn't say which target group is missing, so look for each
+	// in turn to find out
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == elbv2.ErrCodeTargetGroupNotFoundException {
+		if len(names) == 1 {
+			return arns, fmt.Errorf("cannot find target group %s", names[0])
+		}
+
+		for _, name := range names {
+			_, lookupErr := c.GetTargetGroupARNs(ctx, []string{name})
+			if lookupErr != nil {
+				return arns, lookupErr
+			}
+		}
+	}
+
+	if err != nil {
+		return arns, err
+	}
+
+	for _, name := range names {
+		if _, ok := arns[name]; !ok {
+			return arns, fmt.Errorf("cannot find target group %s", name)
+		}
+	}
+
+	return arns, err
+}
+
 // GetSubnetIDs returns the IDs of subnets given by their name
-func (c Clients) GetSubnetIDs(names []string) (ids []string, err error) {
+func (c Clients) GetSubnetIDs(ctx context.Context, names []string) (ids []string, err error) {
 	input := ec2.DescribeSubnetsInput{
 		Filters: []*ec2.Filter{
 			{
@@ -41,7 +90,7 @@ func (c Clients) GetSubnetIDs(names []string) (ids []string, err error) {
 		},
 	}
 
-	result, err := c.EC2.DescribeSubnets(&input)
+	result, err := c.EC2.DescribeSubnetsWithContext(ctx, &input)
 	if err != nil {
 		return ids, err
 	}
@@ -53,8 +102,8 @@ func (c Clients) GetSubnetIDs(names []string) (ids []string, err error) {
 	return ids, err
 }
 
-func (c Clients) GetDefaultSubnetIDs() (ids []string, err error) {
-	result, err := c.EC2.DescribeSubnets(&ec2.DescribeSubnetsInput{
+func (c Clients) GetDefaultSubnetIDs(ctx context.Context) (ids []string, err error) {
+	result, err := c.EC2.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{
 		Filters: []*ec2.Filter{
 			{
 				Name:   aws.String("default-for-az"),
@@ -73,9 +122,9 @@ func (c Clients) GetDefaultSubnetIDs() (ids []string, err error) {
 	return ids, err
 }
 
-func (c Clients) NetworkConfiguration(cfg Config) (out ecs.NetworkConfiguration, err error) {
+func (c Clients) NetworkConfiguration(ctx context.Context, cfg Config) (out ecs.NetworkConfiguration, err error) {
 	// Get security group IDs
-	securityGroupIDs, err := c.GetSecurityGroupIDs(cfg.Options.SecurityGroupNames)
+	securityGroupIDs, err := c.GetSecurityGroupIDs(ctx, cfg.Options.SecurityGroupNames)
 	if err != nil {
 		return out, err
 	}
@@ -83,14 +132,14 @@ func (c Clients) NetworkConfiguration(cfg Config) (out ecs.NetworkConfiguration,
 	assignPublicIP := cfg.Options.AssignPublicIP
 
 	// Get subnet IDs
-	subnetIDs, err := c.GetSubnetIDs(cfg.Options.SubnetNames)
+	subnetIDs, err := c.GetSubnetIDs(ctx, cfg.Options.SubnetNames)
 	if err != nil {
 		return out, err
 	}
 
 	// Use default VPC subnets if no subnets configured
 	if len(subnetIDs) == 0 {
-		subnetIDs, err = c.GetDefaultSubnetIDs()
+		subnetIDs, err = c.GetDefaultSubnetIDs(ctx)
 		if err != nil {
 			return out, err
 		}
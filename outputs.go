@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Outputs are named values published by a step, which later steps can refer
+// to with {{ steps.<step name>.<output> }}
+type Outputs map[string]string
+
+var (
+	stepOutputRe = regexp.MustCompile(`{{\s*steps\.([\w-]+)\.(\w+)\s*}}`)
+	setOutputRe  = regexp.MustCompile(`^::set-output name=(\w+)::(.*)$`)
+)
+
+// interpolate replaces references to step outputs. It is an error to refer
+// to an output that does not exist
+func (config Config) interpolate(value string) (result string, err error) {
+	result = stepOutputRe.ReplaceAllStringFunc(value, func(match string) string {
+		parts := stepOutputRe.FindStringSubmatch(match)
+		step, name := parts[1], parts[2]
+
+		output, ok := config.Outputs[step][name]
+		if !ok && err == nil {
+			err = fmt.Errorf("cannot find output %s from step %s", name, step)
+		}
+
+		return output
+	})
+
+	return result, err
+}
+
+// interpolateMap replaces references to step outputs in each value
+func (config Config) interpolateMap(values map[string]string) (result map[string]string, err error) {
+	result = make(map[string]string, len(values))
+	for key, value := range values {
+		result[key], err = config.interpolate(value)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, err
+}
+
+// parseSetOutputs finds outputs written by a script, as lines in the form:
+//
+//	::set-output name=<name>::<value>
+func parseSetOutputs(stdout string) (outputs Outputs) {
+	outputs = make(Outputs)
+
+	scanner := bufio.NewScanner(strings.NewReader(stdout))
+	for scanner.Scan() {
+		match := setOutputRe.FindStringSubmatch(strings.TrimRight(scanner.Text(), "\r"))
+		if match != nil {
+			outputs[match[1]] = match[2]
+		}
+	}
+
+	return outputs
+}
+
+// log shows the outputs published by a step
+func (o Outputs) log() {
+	for _, name := range sortedKeys(o) {
+		Log.Infof("Output %s: %s", name, o[name])
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	cfg := Config{
+		Outputs: map[string]Outputs{
+			"build": Outputs{
+				"image_uri":    "123.dkr.ecr.eu-west-1.amazonaws.com/app:abc",
+				"image_digest": "sha256:def",
+			},
+		},
+	}
+
+	result, err := cfg.interpolate("{{ steps.build.image_uri }}")
+	assert.Nil(t, err)
+	assert.Equal(t, "123.dkr.ecr.eu-west-1.amazonaws.com/app:abc", result)
+
+	result, err = cfg.interpolate("app@{{steps.build.image_digest}}")
+	assert.Nil(t, err)
+	assert.Equal(t, "app@sha256:def", result)
+
+	result, err = cfg.interpolate("no references")
+	assert.Nil(t, err)
+	assert.Equal(t, "no references", result)
+
+	_, err = cfg.interpolate("{{ steps.build.task_arn }}")
+	assert.NotNil(t, err)
+
+	_, err = cfg.interpolate("{{ steps.test.image_uri }}")
+	assert.NotNil(t, err)
+}
+
+func TestParseSetOutputs(t *testing.T) {
+	stdout := `Running migrations
+::set-output name=version::42
+::set-output name=message::done: all good
+  ::set-output name=ignored::indented
+`
+
+	expected := Outputs{
+		"version": "42",
+		"message": "done: all good",
+	}
+
+	assert.Equal(t, expected, parseSetOutputs(stdout))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultStateFile is where the progress of the pipeline is saved
+const defaultStateFile = ".flecs/state.yaml"
+
+// FilterPipeline marks steps to be skipped. Steps are referred to by their
+// name, or by their number in the pipeline starting from 1. Steps before
+// from are skipped, and if only is set, any steps not in it are skipped
+func FilterPipeline(pipeline []Step, from string, only, skip []string) (filtered []Step, err error) {
+	filtered = make([]Step, len(pipeline))
+	copy(filtered, pipeline)
+
+	fromIndex := 0
+	if from != "" {
+		fromIndex, err = findStep(filtered, from)
+		if err != nil {
+			return filtered, err
+		}
+	}
+
+	onlyIndexes := make(map[int]bool)
+	for _, ref := range only {
+		index, err := findStep(filtered, ref)
+		if err != nil {
+			return filtered, err
+		}
+
+		onlyIndexes[index] = true
+	}
+
+	skipIndexes := make(map[int]bool)
+	for _, ref := range skip {
+		index, err := findStep(filtered, ref)
+		if err != nil {
+			return filtered, err
+		}
+
+		skipIndexes[index] = true
+	}
+
+	for i := range filtered {
+		if i < fromIndex || skipIndexes[i] {
+			filtered[i].skip = true
+		}
+
+		if len(onlyIndexes) > 0 && !onlyIndexes[i] {
+			filtered[i].skip = true
+		}
+	}
+
+	return filtered, err
+}
+
+// findStep returns the index of the step referred to by name or number
+func findStep(pipeline []Step, ref string) (index int, err error) {
+	if number, err := strconv.Atoi(ref); err == nil {
+		if number < 1 || number > len(pipeline) {
+			return index, fmt.Errorf("step %d does not exist, pipeline has %d steps", number, len(pipeline))
+		}
+
+		return number - 1, nil
+	}
+
+	for i, step := range pipeline {
+		if step.Name == ref {
+			return i, nil
+		}
+	}
+
+	return index, fmt.Errorf("cannot find step called %s", ref)
+}
+
+// PipelineState records how far a pipeline got for an environment, so that
+// it can be resumed. Completed steps are kept by number, since running part
+// of the pipeline can complete steps out of order
+type PipelineState struct {
+	Tag               string    `yaml:"tag"`
+	CompletedSteps    []int     `yaml:"completed_steps"`
+	LastCompletedStep int       `yaml:"last_completed_step"`
+	LastCompletedName string    `yaml:"last_completed_name"`
+	LastDeployedTag   string    `yaml:"last_deployed_tag"`
+	UpdatedAt         time.Time `yaml:"updated_at"`
+}
+
+// completed returns true if the step with the given number has completed
+func (state PipelineState) completed(number int) bool {
+	for _, n := range state.CompletedSteps {
+		if n == number {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stateKey returns the key used to save state for the configured project
+// and environment
+func (config Config) stateKey() string {
+	if config.EnvironmentName == "" {
+		return config.ProjectName
+	}
+
+	return fmt.Sprintf("%s/%s", config.ProjectName, config.EnvironmentName)
+}
+
+// readStateFile returns the state for every project and environment
+func readStateFile(path string) (states map[string]PipelineState, err error) {
+	states = make(map[string]PipelineState)
+
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return states, nil
+		}
+
+		return states, err
+	}
+
+	err = yaml.Unmarshal(file, &states)
+	return states, err
+}
+
+// LoadState returns the saved state for the configured environment
+func (config Config) LoadState() (state PipelineState, err error) {
+	states, err := readStateFile(config.StateFile)
+	if err != nil {
+		return state, err
+	}
+
+	return states[config.stateKey()], err
+}
+
+// saveState records that a step has completed. Steps that were skipped by
+// when, or failed and were allowed to continue, also count as completed
+func (config Config) saveState(index int, step Step) (err error) {
+	if config.StateFile == "" {
+		return err
+	}
+
+	states, err := readStateFile(config.StateFile)
+	if err != nil {
+		return err
+	}
+
+	state := states[config.stateKey()]
+	if state.Tag != config.Tag {
+		state.CompletedSteps = nil
+	}
+
+	state.Tag = config.Tag
+	if !state.completed(index + 1) {
+		state.CompletedSteps = append(state.CompletedSteps, index+1)
+		sort.Ints(state.CompletedSteps)
+	}
+
+	state.LastCompletedStep = index + 1
+	state.LastCompletedName = step.Name
+	state.UpdatedAt = time.Now().UTC()
+
+	// Only completing every step of the pipeline for a tag counts as a
+	// deploy, since changed() compares against it to decide what can be
+	// skipped. The steps may have been completed over several runs
+	if len(state.CompletedSteps) >= len(config.Options.Pipeline) {
+		state.LastDeployedTag = config.Tag
+	}
+
+	states[config.stateKey()] = state
+
+	out, err := yaml.Marshal(states)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(config.StateFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(config.StateFile, out, 0644)
+}
+
+// ResumeFrom returns the first step that has not completed, using the saved
+// state. The pipeline can only be resumed for the same tag
+func (config Config) ResumeFrom() (from string, err error) {
+	state, err := config.LoadState()
+	if err != nil {
+		return from, err
+	}
+
+	if state.Tag == "" {
+		return from, fmt.Errorf("no saved state found to resume from in %s", config.StateFile)
+	}
+
+	if state.Tag != config.Tag {
+		return from, fmt.Errorf("saved state is for tag %s, not %s", state.Tag, config.Tag)
+	}
+
+	for i := range config.Options.Pipeline {
+		if !state.completed(i + 1) {
+			return strconv.Itoa(i + 1), err
+		}
+	}
+
+	return from, fmt.Errorf("pipeline already completed for tag %s", config.Tag)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testPipeline = []Step{
+	Step{Name: "build", Type: "docker"},
+	Step{Name: "migrate", Type: "task"},
+	Step{Name: "seed", Type: "task"},
+	Step{Name: "web", Type: "service"},
+}
+
+func skipped(pipeline []Step) (result []bool) {
+	for _, step := range pipeline {
+		result = append(result, step.skip)
+	}
+
+	return result
+}
+
+func TestFilterPipeline(t *testing.T) {
+	filtered, err := FilterPipeline(testPipeline, "", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{false, false, false, false}, skipped(filtered))
+
+	filtered, err = FilterPipeline(testPipeline, "3", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, true, false, false}, skipped(filtered))
+
+	filtered, err = FilterPipeline(testPipeline, "migrate", nil, []string{"seed"})
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, false, true, false}, skipped(filtered))
+
+	filtered, err = FilterPipeline(testPipeline, "", []string{"build", "4"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{false, true, true, false}, skipped(filtered))
+
+	// The original pipeline should not be changed
+	assert.Equal(t, []bool{false, false, false, false}, skipped(testPipeline))
+
+	_, err = FilterPipeline(testPipeline, "5", nil, nil)
+	assert.NotNil(t, err)
+
+	_, err = FilterPipeline(testPipeline, "", []string{"deploy"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestPipelineState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flecs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		Options:         ConfigOptions{Pipeline: testPipeline},
+		EnvironmentName: "staging",
+		ProjectName:     "test",
+		StateFile:       filepath.Join(dir, "state.yaml"),
+		Tag:             "abc123",
+	}
+
+	_, err = cfg.ResumeFrom()
+	assert.NotNil(t, err)
+
+	for i, step := range testPipeline[:2] {
+		err = cfg.saveState(i, step)
+		assert.Nil(t, err)
+	}
+
+	from, err := cfg.ResumeFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, "3", from)
+
+	// Another tag cannot resume
+	other := cfg
+	other.Tag = "def456"
+	_, err = other.ResumeFrom()
+	assert.NotNil(t, err)
+
+	// Another environment has its own state
+	other = cfg
+	other.EnvironmentName = "production"
+	_, err = other.ResumeFrom()
+	assert.NotNil(t, err)
+
+	err = cfg.saveState(2, testPipeline[2])
+	assert.Nil(t, err)
+
+	state, err := cfg.LoadState()
+	assert.Nil(t, err)
+	assert.Equal(t, "", state.LastDeployedTag)
+
+	err = cfg.saveState(3, testPipeline[3])
+	assert.Nil(t, err)
+
+	state, err = cfg.LoadState()
+	assert.Nil(t, err)
+	assert.Equal(t, "abc123", state.LastDeployedTag)
+
+	_, err = cfg.ResumeFrom()
+	assert.NotNil(t, err)
+
+	// Running part of the pipeline is not a deploy
+	other = cfg
+	other.Tag = "def456"
+	other.Options.Pipeline, err = FilterPipeline(testPipeline, "", []string{"4"}, nil)
+	assert.Nil(t, err)
+
+	err = other.saveState(3, other.Options.Pipeline[3])
+	assert.Nil(t, err)
+
+	state, err = other.LoadState()
+	assert.Nil(t, err)
+	assert.Equal(t, "def456", state.Tag)
+	assert.Equal(t, "abc123", state.LastDeployedTag)
+
+	// Resuming after running part of the pipeline starts from the first
+	// step that hasn't completed
+	from, err = other.ResumeFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, "1", from)
+
+	other.Options.Pipeline, err = FilterPipeline(testPipeline, from, nil, nil)
+	assert.Nil(t, err)
+
+	for i, step := range other.Options.Pipeline[:3] {
+		err = other.saveState(i, step)
+		assert.Nil(t, err)
+	}
+
+	// Completing every step over several runs is a deploy
+	state, err = other.LoadState()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4}, state.CompletedSteps)
+	assert.Equal(t, "def456", state.LastDeployedTag)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+var (
+	wwwAuthenticateRe  = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	registryHTTPClient = http.DefaultClient
+)
+
+// RegistryAuth contains the credentials for a registry. It is encoded in
+// the same way as the Docker Engine API expects
+type RegistryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// RegistryOptions configures pushing images to a registry other than ECR,
+// such as Docker Hub, GHCR or a local registry
+type RegistryOptions struct {
+	// URL is the registry host, such as ghcr.io or localhost:5000
+	URL string `yaml:"url"`
+
+	// UsernameEnv and PasswordEnv are the environment variables that
+	// contain the credentials. If they are not set, credentials are read
+	// from the Docker config
+	UsernameEnv string `yaml:"username_env"`
+	PasswordEnv string `yaml:"password_env"`
+
+	// DockerConfig is the Docker config file to read credentials from,
+	// which defaults to ~/.docker/config.json
+	DockerConfig string `yaml:"docker_config"`
+}
+
+// dockerConfigFile contains the credentials saved by docker login
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// validate checks the registry options
+func (r RegistryOptions) validate() (err error) {
+	if r.URL == "" {
+		if r.UsernameEnv != "" || r.PasswordEnv != "" || r.DockerConfig != "" {
+			return fmt.Errorf("must specify registry url")
+		}
+
+		return err
+	}
+
+	if strings.Contains(r.URL, "://") || strings.Contains(r.URL, "/") {
+		return fmt.Errorf("registry url must be a host, such as ghcr.io, not %s", r.URL)
+	}
+
+	if (r.UsernameEnv == "") != (r.PasswordEnv == "") {
+		return fmt.Errorf("must specify both username_env and password_env")
+	}
+
+	return err
+}
+
+// URI returns the registry
+func (r RegistryOptions) URI() string {
+	return r.URL
+}
+
+// Auth returns the credentials for the registry, from environment variables
+// or the Docker config. It returns no credentials if none are found
+func (r RegistryOptions) Auth(ctx context.Context) (auth RegistryAuth, err error) {
+	auth.ServerAddress = parseImageReference(r.URL + "/image").Registry
+
+	if r.UsernameEnv != "" {
+		auth.Username = os.Getenv(r.UsernameEnv)
+		auth.Password = os.Getenv(r.PasswordEnv)
+
+		if auth.Username == "" || auth.Password == "" {
+			return auth, fmt.Errorf("must set %s and %s to push to %s", r.UsernameEnv, r.PasswordEnv, r.URL)
+		}
+
+		return auth, err
+	}
+
+	path := r.DockerConfig
+	if path == "" {
+		path, err = defaultDockerConfig()
+		if err != nil {
+			return auth, err
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && r.DockerConfig == "" {
+			return auth, nil
+		}
+
+		return auth, err
+	}
+
+	var config dockerConfigFile
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return auth, fmt.Errorf("invalid Docker config %s: %s", path, err)
+	}
+
+	keys := []string{r.URL, "https://" + r.URL}
+	if auth.ServerAddress == dockerHubRegistry {
+		keys = append(keys, dockerHubAuthKey)
+	}
+
+	for _, key := range keys {
+		entry, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+
+		auth.Username, auth.Password = entry.Username, entry.Password
+
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return auth, fmt.Errorf("invalid credentials for %s in %s", key, path)
+			}
+
+			credentials := strings.SplitN(string(decoded), ":", 2)
+			if len(credentials) == 2 {
+				auth.Username, auth.Password = credentials[0], credentials[1]
+			}
+		}
+
+		return auth, err
+	}
+
+	return auth, err
+}
+
+// Prepare does nothing, since repositories are only created in ECR
+func (r RegistryOptions) Prepare(ctx context.Context, repository Repository) error {
+	return nil
+}
+
+// Digest asks the registry for the digest of a tagged image
+func (r RegistryOptions) Digest(ctx context.Context, repository, tag string) (digest string, err error) {
+	auth, err := r.Auth(ctx)
+	if err != nil {
+		return digest, err
+	}
+
+	ref := parseImageReference(fmt.Sprintf("%s/%s:%s", r.URL, repository, tag))
+	return registryManifestDigest(ctx, ref, auth)
+}
+
+// defaultDockerConfig returns the path of the Docker config file
+func defaultDockerConfig() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+// registryManifestDigest returns the digest of an image, or nothing if the
+// registry doesn't have it
+func registryManifestDigest(ctx context.Context, ref ImageReference, auth RegistryAuth) (digest string, err error) {
+	client := registryClient{Registry: ref.Registry, Auth: auth}
+
+	header := http.Header{}
+	header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+
+	resp, err := client.do(ctx, http.MethodHead, fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, ref.Tag), header, nil)
+	if err != nil {
+		return digest, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return digest, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return digest, fmt.Errorf("registry returned %s", resp.Status)
+	}
+
+	digest = resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return digest, fmt.Errorf("registry did not return a digest")
+	}
+
+	return digest, err
+}
+
+// registryClient makes requests with the Docker Registry HTTP API. It
+// authenticates when the registry asks it to, with credentials if it has
+// them and anonymously otherwise
+type registryClient struct {
+	Registry string
+	Auth     RegistryAuth
+
+	authorization string
+}
+
+// registryBody returns the body of a request and its length. It is a
+// function so that the body can be sent again after authenticating
+type registryBody func() (body io.ReadCloser, length int64, err error)
+
+// bytesBody returns a request body that sends data
+func bytesBody(data []byte) registryBody {
+	return func() (io.ReadCloser, int64, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+}
+
+// url returns the full URL of a path in the registry. Paths that are
+// already URLs, such as upload locations, are resolved against the registry
+func (r *registryClient) url(path string) (string, error) {
+	base, err := url.Parse(registryBaseURL(r.Registry) + "/")
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
+
+// do sends a request to the registry, authenticating and trying again if
+// the registry returns 401
+func (r *registryClient) do(ctx context.Context, method, path string, header http.Header, body registryBody) (resp *http.Response, err error) {
+	resp, err = r.send(ctx, method, path, header, body)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	err = r.authenticate(ctx, resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return resp, err
+	}
+
+	return r.send(ctx, method, path, header, body)
+}
+
+func (r *registryClient) send(ctx context.Context, method, path string, header http.Header, body registryBody) (resp *http.Response, err error) {
+	u, err := r.url(path)
+	if err != nil {
+		return resp, err
+	}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return resp, err
+	}
+
+	req = req.WithContext(ctx)
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if r.authorization != "" {
+		req.Header.Set("Authorization", r.authorization)
+	}
+
+	if body != nil {
+		req.Body, req.ContentLength, err = body()
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	return registryHTTPClient.Do(req)
+}
+
+// authenticate responds to the challenge in a WWW-Authenticate header
+func (r *registryClient) authenticate(ctx context.Context, challenge string) (err error) {
+	if strings.HasPrefix(challenge, "Basic ") {
+		if r.Auth.Username == "" {
+			return fmt.Errorf("registry %s requires credentials", r.Registry)
+		}
+
+		credentials := base64.StdEncoding.EncodeToString([]byte(r.Auth.Username + ":" + r.Auth.Password))
+		r.authorization = "Basic " + credentials
+		return err
+	}
+
+	token, err := registryToken(ctx, challenge, r.Auth)
+	if err != nil {
+		return err
+	}
+
+	r.authorization = "Bearer " + token
+	return err
+}
+
+// registryBaseURL returns the URL of a registry. Local registries are
+// expected to use plain HTTP
+func registryBaseURL(registry string) string {
+	host := strings.Split(registry, ":")[0]
+	if host == "localhost" || host == "127.0.0.1" {
+		return "http://" + registry
+	}
+
+	return "https://" + registry
+}
+
+// registryToken requests a bearer token from the realm given in a
+// WWW-Authenticate header. The token is anonymous unless credentials are
+// given
+func registryToken(ctx context.Context, challenge string, auth RegistryAuth) (token string, err error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return token, fmt.Errorf("unsupported registry authentication %q", challenge)
+	}
+
+	params := make(map[string]string)
+	for _, match := range wwwAuthenticateRe.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+
+	req, err := http.NewRequest(http.MethodGet, params["realm"], nil)
+	if err != nil {
+		return token, err
+	}
+
+	query := req.URL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	req.URL.RawQuery = query.Encode()
+
+	if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := registryHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return token, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return token, fmt.Errorf("registry token request returned %s", resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return token, err
+	}
+
+	token = body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+
+	return token, err
+}
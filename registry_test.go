@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryOptionsAuth(t *testing.T) {
+	ctx := context.Background()
+
+	os.Setenv("FLECS_TEST_USERNAME", "user")
+	os.Setenv("FLECS_TEST_PASSWORD", "pass")
+	defer os.Unsetenv("FLECS_TEST_USERNAME")
+	defer os.Unsetenv("FLECS_TEST_PASSWORD")
+
+	registry := RegistryOptions{URL: "ghcr.io", UsernameEnv: "FLECS_TEST_USERNAME", PasswordEnv: "FLECS_TEST_PASSWORD"}
+	auth, err := registry.Auth(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, RegistryAuth{Username: "user", Password: "pass", ServerAddress: "ghcr.io"}, auth)
+
+	registry.PasswordEnv = "FLECS_TEST_MISSING"
+	_, err = registry.Auth(ctx)
+	assert.NotNil(t, err)
+
+	dir, err := ioutil.TempDir("", "flecs-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(config, []byte(`{
+  "auths": {
+    "artifactory.example.com": {"auth": "YXJ0OnNlY3JldA=="},
+    "https://index.docker.io/v1/": {"username": "hub", "password": "token"}
+  }
+}`), 0644)
+	assert.Nil(t, err)
+
+	auth, err = RegistryOptions{URL: "artifactory.example.com", DockerConfig: config}.Auth(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, RegistryAuth{Username: "art", Password: "secret", ServerAddress: "artifactory.example.com"}, auth)
+
+	auth, err = RegistryOptions{URL: "docker.io", DockerConfig: config}.Auth(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, RegistryAuth{Username: "hub", Password: "token", ServerAddress: dockerHubRegistry}, auth)
+
+	auth, err = RegistryOptions{URL: "localhost:5000", DockerConfig: config}.Auth(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "", auth.Username)
+}
+
+func TestRegistryOptionsValidate(t *testing.T) {
+	assert.Nil(t, RegistryOptions{}.validate())
+	assert.Nil(t, RegistryOptions{URL: "localhost:5000"}.validate())
+	assert.NotNil(t, RegistryOptions{UsernameEnv: "USER", PasswordEnv: "PASS"}.validate())
+	assert.NotNil(t, RegistryOptions{URL: "https://ghcr.io"}.validate())
+	assert.NotNil(t, RegistryOptions{URL: "ghcr.io", UsernameEnv: "USER"}.validate())
+}
+
+func TestRegistryOptionsDigest(t *testing.T) {
+	reg := &testRegistry{blobs: make(map[string][]byte), manifests: make(map[string][]byte)}
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	manifest := []byte(`{"schemaVersion":2}`)
+	reg.manifests["app/manifests/v1"] = manifest
+
+	os.Setenv("FLECS_TEST_USERNAME", "AWS")
+	os.Setenv("FLECS_TEST_PASSWORD", "secret")
+	defer os.Unsetenv("FLECS_TEST_USERNAME")
+	defer os.Unsetenv("FLECS_TEST_PASSWORD")
+
+	registry := RegistryOptions{
+		URL:         strings.TrimPrefix(server.URL, "http://"),
+		UsernameEnv: "FLECS_TEST_USERNAME",
+		PasswordEnv: "FLECS_TEST_PASSWORD",
+	}
+
+	digest, err := registry.Digest(context.Background(), "app", "v1")
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("sha256:%x", sha256.Sum256(manifest)), digest)
+
+	digest, err = registry.Digest(context.Background(), "app", "v2")
+	assert.Nil(t, err)
+	assert.Equal(t, "", digest)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+var awsAccountIDRe = regexp.MustCompile(`^\d{12}$`)
+
+// Repository is the ECR repository that images are pushed to. It can be
+// written as just the name of the repository, or as a map of settings which
+// are applied every time the image is pushed
+type Repository struct {
+	Name string `yaml:"name"`
+
+	// ImageTagMutability is either MUTABLE or IMMUTABLE
+	ImageTagMutability string `yaml:"image_tag_mutability"`
+
+	ScanOnPush *bool `yaml:"scan_on_push"`
+
+	// Encryption can only be set when the repository is created
+	Encryption RepositoryEncryption `yaml:"encryption"`
+
+	// Lifecycle rules expire images, in order of priority
+	Lifecycle []LifecycleRule `yaml:"lifecycle"`
+
+	// PullAccounts are other AWS accounts allowed to pull images
+	PullAccounts []string `yaml:"pull_accounts"`
+
+	Tags map[string]string `yaml:"tags"`
+}
+
+// RepositoryEncryption configures how images are encrypted at rest
+type RepositoryEncryption struct {
+	// Type is either AES256 or KMS
+	Type   string `yaml:"type"`
+	KMSKey string `yaml:"kms_key"`
+}
+
+// LifecycleRule expires images that match it. Either Keep or
+// ExpireAfterDays must be set
+type LifecycleRule struct {
+	Description string `yaml:"description"`
+
+	// TagStatus is "tagged", "untagged" or "any" (the default). Tagged
+	// rules need tag prefixes or patterns
+	TagStatus   string   `yaml:"tag_status"`
+	TagPrefixes []string `yaml:"tag_prefixes"`
+	TagPatterns []string `yaml:"tag_patterns"`
+
+	// Keep expires all but the most recent images
+	Keep int `yaml:"keep"`
+
+	// ExpireAfterDays expires images pushed more than this many days ago
+	ExpireAfterDays int `yaml:"expire_after_days"`
+}
+
+// UnmarshalYAML allows a repository to be just a name
+func (r *Repository) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var name string
+	if err = unmarshal(&name); err == nil {
+		*r = Repository{Name: name}
+		return err
+	}
+
+	type repository Repository
+	return unmarshal((*repository)(r))
+}
+
+// merge returns the repository, using settings from defaults for anything
+// that has not been set. The name is never merged
+func (r Repository) merge(defaults Repository) Repository {
+	if r.ImageTagMutability == "" {
+		r.ImageTagMutability = defaults.ImageTagMutability
+	}
+
+	if r.ScanOnPush == nil {
+		r.ScanOnPush = defaults.ScanOnPush
+	}
+
+	if r.Encryption.Type == "" {
+		r.Encryption = defaults.Encryption
+	}
+
+	if r.Lifecycle == nil {
+		r.Lifecycle = defaults.Lifecycle
+	}
+
+	if r.PullAccounts == nil {
+		r.PullAccounts = defaults.PullAccounts
+	}
+
+	if r.Tags == nil {
+		r.Tags = defaults.Tags
+	}
+
+	return r
+}
+
+// validate checks the repository settings
+func (r Repository) validate() (err error) {
+	if r.ImageTagMutability != "" && !stringInSlice(r.ImageTagMutability, ecr.ImageTagMutability_Values()) {
+		return fmt.Errorf("invalid image_tag_mutability %s, must be one of %s", r.ImageTagMutability, strings.Join(ecr.ImageTagMutability_Values(), ", "))
+	}
+
+	if r.Encryption.Type != "" && !stringInSlice(r.Encryption.Type, ecr.EncryptionType_Values()) {
+		return fmt.Errorf("invalid encryption type %s, must be one of %s", r.Encryption.Type, strings.Join(ecr.EncryptionType_Values(), ", "))
+	}
+
+	if r.Encryption.KMSKey != "" && r.Encryption.Type != ecr.EncryptionTypeKms {
+		return fmt.Errorf("kms_key can only be set with encryption type %s", ecr.EncryptionTypeKms)
+	}
+
+	for i, rule := range r.Lifecycle {
+		err = rule.validate()
+		if err != nil {
+			return fmt.Errorf("invalid lifecycle rule %d: %s", i, err)
+		}
+
+		// ECR evaluates rules in order, and needs the rule that matches any
+		// image to come last
+		if (rule.TagStatus == "" || rule.TagStatus == "any") && i != len(r.Lifecycle)-1 {
+			return fmt.Errorf("invalid lifecycle rule %d: a rule with tag_status any must be the last rule", i)
+		}
+	}
+
+	for _, account := range r.PullAccounts {
+		if !awsAccountIDRe.MatchString(account) && !strings.HasPrefix(account, "arn:") {
+			return fmt.Errorf("invalid pull account %s, must be an account ID or ARN", account)
+		}
+	}
+
+	return err
+}
+
+func (l LifecycleRule) validate() (err error) {
+	switch l.TagStatus {
+	case "", "any", "untagged":
+	case "tagged":
+		if len(l.TagPrefixes) == 0 && len(l.TagPatterns) == 0 {
+			return fmt.Errorf("tagged rules must set tag_prefixes or tag_patterns")
+		}
+	default:
+		return fmt.Errorf("tag_status must be tagged, untagged or any")
+	}
+
+	if (l.Keep > 0) == (l.ExpireAfterDays > 0) {
+		return fmt.Errorf("must set one of keep or expire_after_days")
+	}
+
+	return err
+}
+
+// lifecyclePolicy returns the lifecycle policy document for the rules
+func (r Repository) lifecyclePolicy() (string, error) {
+	type selection struct {
+		TagStatus      string   `json:"tagStatus"`
+		TagPrefixList  []string `json:"tagPrefixList,omitempty"`
+		TagPatternList []string `json:"tagPatternList,omitempty"`
+		CountType      string   `json:"countType"`
+		CountUnit      string   `json:"countUnit,omitempty"`
+		CountNumber    int      `json:"countNumber"`
+	}
+
+	type rule struct {
+		RulePriority int               `json:"rulePriority"`
+		Description  string            `json:"description,omitempty"`
+		Selection    selection         `json:"selection"`
+		Action       map[string]string `json:"action"`
+	}
+
+	var policy struct {
+		Rules []rule `json:"rules"`
+	}
+
+	for i, l := range r.Lifecycle {
+		s := selection{
+			TagStatus:      l.TagStatus,
+			TagPrefixList:  l.TagPrefixes,
+			TagPatternList: l.TagPatterns,
+			CountType:      "imageCountMoreThan",
+			CountNumber:    l.Keep,
+		}
+
+		if s.TagStatus == "" {
+			s.TagStatus = "any"
+		}
+
+		if l.ExpireAfterDays > 0 {
+			s.CountType = "sinceImagePushed"
+			s.CountUnit = "days"
+			s.CountNumber = l.ExpireAfterDays
+		}
+
+		policy.Rules = append(policy.Rules, rule{
+			RulePriority: i + 1,
+			Description:  l.Description,
+			Selection:    s,
+			Action:       map[string]string{"type": "expire"},
+		})
+	}
+
+	out, err := json.Marshal(policy)
+	return string(out), err
+}
+
+// pullAccountsSid identifies the statement flecs manages in the repository
+// policy
+const pullAccountsSid = "FlecsPullAccounts"
+
+// repositoryPolicy returns the current policy with a statement that allows
+// the pull accounts to pull images. Statements added outside flecs are kept,
+// and the flecs statement replaces any earlier version of itself
+func (r Repository) repositoryPolicy(current string) (string, error) {
+	var principals []string
+	for _, account := range r.PullAccounts {
+		if awsAccountIDRe.MatchString(account) {
+			account = fmt.Sprintf("arn:aws:iam::%s:root", account)
+		}
+
+		principals = append(principals, account)
+	}
+
+	statement := map[string]interface{}{
+		"Sid":       pullAccountsSid,
+		"Effect":    "Allow",
+		"Principal": map[string][]string{"AWS": principals},
+		"Action": []string{
+			"ecr:BatchCheckLayerAvailability",
+			"ecr:BatchGetImage",
+			"ecr:GetDownloadUrlForLayer",
+		},
+	}
+
+	policy := map[string]interface{}{"Version": "2012-10-17"}
+	if current != "" {
+		err := json.Unmarshal([]byte(current), &policy)
+		if err != nil {
+			return "", fmt.Errorf("cannot read repository policy of %s: %s", r.Name, err)
+		}
+	}
+
+	// A policy with one statement may have it on its own instead of in a list
+	var existing []interface{}
+	switch value := policy["Statement"].(type) {
+	case []interface{}:
+		existing = value
+	case map[string]interface{}:
+		existing = []interface{}{value}
+	}
+
+	var statements []interface{}
+	added := false
+	for _, s := range existing {
+		if sid, _ := s.(map[string]interface{})["Sid"].(string); sid == pullAccountsSid {
+			if !added {
+				statements = append(statements, statement)
+				added = true
+			}
+
+			continue
+		}
+
+		statements = append(statements, s)
+	}
+
+	if !added {
+		statements = append(statements, statement)
+	}
+
+	policy["Statement"] = statements
+
+	out, err := json.Marshal(policy)
+	return string(out), err
+}
+
+// createRepository creates the repository if it doesn't exist, and then
+// makes sure it has the configured settings. Settings that are not
+// configured are left alone
+func createRepository(ctx context.Context, clients Clients, repository Repository) (arn string, err error) {
+	existing, err := describeRepository(ctx, clients, repository.Name)
+	if err != nil {
+		return arn, err
+	}
+
+	if existing == nil {
+		Log.Infof("Cannot find repository. Creating repository %s", repository.Name)
+
+		input := ecr.CreateRepositoryInput{
+			RepositoryName: aws.String(repository.Name),
+		}
+
+		if repository.ImageTagMutability != "" {
+			input.ImageTagMutability = aws.String(repository.ImageTagMutability)
+		}
+
+		if repository.ScanOnPush != nil {
+			input.ImageScanningConfiguration = &ecr.ImageScanningConfiguration{
+				ScanOnPush: repository.ScanOnPush,
+			}
+		}
+
+		if repository.Encryption.Type != "" {
+			input.EncryptionConfiguration = &ecr.EncryptionConfiguration{
+				EncryptionType: aws.String(repository.Encryption.Type),
+			}
+
+			if repository.Encryption.KMSKey != "" {
+				input.EncryptionConfiguration.KmsKey = aws.String(repository.Encryption.KMSKey)
+			}
+		}
+
+		for _, key := range sortedKeys(repository.Tags) {
+			input.Tags = append(input.Tags, &ecr.Tag{
+				Key:   aws.String(key),
+				Value: aws.String(repository.Tags[key]),
+			})
+		}
+
+		create, err := clients.ECR.CreateRepositoryWithContext(ctx, &input)
+		if err != nil {
+			return arn, err
+		}
+
+		arn = aws.StringValue(create.Repository.RepositoryArn)
+
+		// Wait for a bit to ensure it's ready
+		err = aws.SleepWithContext(ctx, 10*time.Second)
+		if err != nil {
+			return arn, err
+		}
+	} else {
+		arn = aws.StringValue(existing.RepositoryArn)
+
+		err = repository.update(ctx, clients, existing)
+		if err != nil {
+			return arn, err
+		}
+	}
+
+	err = repository.applyPolicies(ctx, clients)
+	return arn, err
+}
+
+// update changes the settings of an existing repository that differ from
+// the configuration
+func (r Repository) update(ctx context.Context, clients Clients, existing *ecr.Repository) (err error) {
+	if r.ImageTagMutability != "" && r.ImageTagMutability != aws.StringValue(existing.ImageTagMutability) {
+		Log.Infof("Setting image tag mutability of %s to %s", r.Name, r.ImageTagMutability)
+
+		_, err = clients.ECR.PutImageTagMutabilityWithContext(ctx, &ecr.PutImageTagMutabilityInput{
+			ImageTagMutability: aws.String(r.ImageTagMutability),
+			RepositoryName:     aws.String(r.Name),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	scanOnPush := existing.ImageScanningConfiguration != nil && aws.BoolValue(existing.ImageScanningConfiguration.ScanOnPush)
+	if r.ScanOnPush != nil && *r.ScanOnPush != scanOnPush {
+		Log.Infof("Setting scan on push of %s to %t", r.Name, *r.ScanOnPush)
+
+		_, err = clients.ECR.PutImageScanningConfigurationWithContext(ctx, &ecr.PutImageScanningConfigurationInput{
+			ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: r.ScanOnPush},
+			RepositoryName:             aws.String(r.Name),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Encryption.Type != "" && existing.EncryptionConfiguration != nil &&
+		r.Encryption.Type != aws.StringValue(existing.EncryptionConfiguration.EncryptionType) {
+		Log.Warnf("Repository %s uses %s encryption, which cannot be changed once it has been created", r.Name, aws.StringValue(existing.EncryptionConfiguration.EncryptionType))
+	}
+
+	if len(r.Tags) > 0 {
+		input := ecr.TagResourceInput{ResourceArn: existing.RepositoryArn}
+		for _, key := range sortedKeys(r.Tags) {
+			input.Tags = append(input.Tags, &ecr.Tag{
+				Key:   aws.String(key),
+				Value: aws.String(r.Tags[key]),
+			})
+		}
+
+		_, err = clients.ECR.TagResourceWithContext(ctx, &input)
+		if err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// applyPolicies sets the lifecycle and repository policies, if they differ
+// from what the repository already has
+func (r Repository) applyPolicies(ctx context.Context, clients Clients) (err error) {
+	if len(r.Lifecycle) > 0 {
+		policy, err := r.lifecyclePolicy()
+		if err != nil {
+			return err
+		}
+
+		current := ""
+		resp, err := clients.ECR.GetLifecyclePolicyWithContext(ctx, &ecr.GetLifecyclePolicyInput{
+			RepositoryName: aws.String(r.Name),
+		})
+		if err == nil {
+			current = aws.StringValue(resp.LifecyclePolicyText)
+		} else if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != ecr.ErrCodeLifecyclePolicyNotFoundException {
+			return err
+		}
+
+		if !equalJSON(policy, current) {
+			Log.Infof("Setting lifecycle policy of %s", r.Name)
+
+			_, err = clients.ECR.PutLifecyclePolicyWithContext(ctx, &ecr.PutLifecyclePolicyInput{
+				LifecyclePolicyText: aws.String(policy),
+				RepositoryName:      aws.String(r.Name),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(r.PullAccounts) > 0 {
+		current := ""
+		resp, err := clients.ECR.GetRepositoryPolicyWithContext(ctx, &ecr.GetRepositoryPolicyInput{
+			RepositoryName: aws.String(r.Name),
+		})
+		if err == nil {
+			current = aws.StringValue(resp.PolicyText)
+		} else if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != ecr.ErrCodeRepositoryPolicyNotFoundException {
+			return err
+		}
+
+		policy, err := r.repositoryPolicy(current)
+		if err != nil {
+			return err
+		}
+
+		if !equalJSON(policy, current) {
+			Log.Infof("Setting repository policy of %s", r.Name)
+
+			_, err = clients.ECR.SetRepositoryPolicyWithContext(ctx, &ecr.SetRepositoryPolicyInput{
+				PolicyText:     aws.String(policy),
+				RepositoryName: aws.String(r.Name),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return err
+}
+
+// describeRepository returns the repository, or nil if it doesn't exist
+func describeRepository(ctx context.Context, clients Clients, name string) (repository *ecr.Repository, err error) {
+	resp, err := clients.ECR.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RepositoryNames: aws.StringSlice([]string{name}),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeRepositoryNotFoundException {
+			return repository, nil
+		}
+
+		return repository, err
+	}
+
+	if len(resp.Repositories) < 1 {
+		return repository, err
+	}
+
+	return resp.Repositories[0], err
+}
+
+// equalJSON returns true if two JSON documents have the same content
+func equalJSON(a, b string) bool {
+	var decodedA, decodedB interface{}
+
+	if json.Unmarshal([]byte(a), &decodedA) != nil || json.Unmarshal([]byte(b), &decodedB) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(decodedA, decodedB)
+}
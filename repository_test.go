@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRepositoryUnmarshalYAML(t *testing.T) {
+	var step DockerStep
+
+	err := yaml.Unmarshal([]byte("repository: app"), &step)
+	assert.Nil(t, err)
+	assert.Equal(t, Repository{Name: "app"}, step.Repository)
+
+	err = yaml.Unmarshal([]byte(`
+repository:
+  name: app
+  image_tag_mutability: IMMUTABLE
+  scan_on_push: true
+  pull_accounts:
+    - "111111111111"
+`), &step)
+	assert.Nil(t, err)
+	assert.Equal(t, Repository{
+		Name:               "app",
+		ImageTagMutability: "IMMUTABLE",
+		ScanOnPush:         aws.Bool(true),
+		PullAccounts:       []string{"111111111111"},
+	}, step.Repository)
+}
+
+func TestRepositoryValidate(t *testing.T) {
+	assert.Nil(t, Repository{
+		ImageTagMutability: "IMMUTABLE",
+		Encryption:         RepositoryEncryption{Type: "KMS", KMSKey: "alias/ecr"},
+		Lifecycle: []LifecycleRule{
+			{TagStatus: "tagged", TagPrefixes: []string{"v"}, Keep: 50},
+			{TagStatus: "untagged", ExpireAfterDays: 7},
+		},
+		PullAccounts: []string{"111111111111", "arn:aws:iam::222222222222:role/deploy"},
+	}.validate())
+
+	assert.NotNil(t, Repository{ImageTagMutability: "SOMETIMES"}.validate())
+	assert.NotNil(t, Repository{Encryption: RepositoryEncryption{Type: "AES256", KMSKey: "alias/ecr"}}.validate())
+	assert.NotNil(t, Repository{Lifecycle: []LifecycleRule{{TagStatus: "tagged", Keep: 50}}}.validate())
+	assert.NotNil(t, Repository{Lifecycle: []LifecycleRule{{Keep: 50, ExpireAfterDays: 7}}}.validate())
+	assert.NotNil(t, Repository{Lifecycle: []LifecycleRule{{}}}.validate())
+
+	// A rule that matches any image must come last
+	assert.Nil(t, Repository{Lifecycle: []LifecycleRule{{TagStatus: "untagged", Keep: 1}, {Keep: 50}}}.validate())
+	assert.NotNil(t, Repository{Lifecycle: []LifecycleRule{{TagStatus: "any", Keep: 50}, {TagStatus: "untagged", Keep: 1}}}.validate())
+	assert.NotNil(t, Repository{PullAccounts: []string{"1234"}}.validate())
+}
+
+func TestRepositoryLifecyclePolicy(t *testing.T) {
+	repository := Repository{
+		Lifecycle: []LifecycleRule{
+			{Description: "keep releases", TagStatus: "tagged", TagPatterns: []string{"v*"}, Keep: 50},
+			{TagStatus: "untagged", ExpireAfterDays: 7},
+		},
+	}
+
+	policy, err := repository.lifecyclePolicy()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"rules": [
+		{"rulePriority": 1, "description": "keep releases", "action": {"type": "expire"},
+		 "selection": {"tagStatus": "tagged", "tagPatternList": ["v*"], "countType": "imageCountMoreThan", "countNumber": 50}},
+		{"rulePriority": 2, "action": {"type": "expire"},
+		 "selection": {"tagStatus": "untagged", "countType": "sinceImagePushed", "countUnit": "days", "countNumber": 7}}
+	]}`, policy)
+}
+
+func TestRepositoryPolicy(t *testing.T) {
+	repository := Repository{Name: "app", PullAccounts: []string{"111111111111"}}
+
+	pullAccounts := `{
+		"Sid": "FlecsPullAccounts",
+		"Effect": "Allow",
+		"Principal": {"AWS": ["arn:aws:iam::111111111111:root"]},
+		"Action": ["ecr:BatchCheckLayerAvailability", "ecr:BatchGetImage", "ecr:GetDownloadUrlForLayer"]
+	}`
+
+	policy, err := repository.repositoryPolicy("")
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"Version": "2012-10-17", "Statement": [`+pullAccounts+`]}`, policy)
+
+	// Statements added outside flecs are kept, and ours is replaced
+	current := `{
+		"Version": "2008-10-17",
+		"Statement": [
+			{"Sid": "CodeBuild", "Effect": "Allow", "Principal": {"Service": "codebuild.amazonaws.com"}, "Action": "ecr:BatchGetImage"},
+			{"Sid": "FlecsPullAccounts", "Effect": "Allow", "Principal": {"AWS": "arn:aws:iam::222222222222:root"}, "Action": "ecr:BatchGetImage"}
+		]
+	}`
+
+	policy, err = repository.repositoryPolicy(current)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"Version": "2008-10-17",
+		"Statement": [
+			{"Sid": "CodeBuild", "Effect": "Allow", "Principal": {"Service": "codebuild.amazonaws.com"}, "Action": "ecr:BatchGetImage"},
+			`+pullAccounts+`
+		]
+	}`, policy)
+
+	// Applying it again changes nothing
+	again, err := repository.repositoryPolicy(policy)
+	assert.Nil(t, err)
+	assert.JSONEq(t, policy, again)
+
+	_, err = repository.repositoryPolicy("not json")
+	assert.NotNil(t, err)
+}
+
+func TestCreateRepositoryUpdatesSettings(t *testing.T) {
+	repository := Repository{
+		Name:               "app",
+		ImageTagMutability: "IMMUTABLE",
+		ScanOnPush:         aws.Bool(true),
+		Lifecycle:          []LifecycleRule{{TagStatus: "untagged", ExpireAfterDays: 7}},
+		PullAccounts:       []string{"111111111111"},
+	}
+
+	policy, err := repository.lifecyclePolicy()
+	assert.Nil(t, err)
+
+	var calls []string
+	clients := Clients{
+		ECR: mockedECRClient{
+			DescribeRepositoriesResp: ecr.DescribeRepositoriesOutput{
+				Repositories: []*ecr.Repository{
+					{
+						RepositoryArn:              aws.String("arn:aws:ecr:eu-west-1:123456789012:repository/app"),
+						ImageTagMutability:         aws.String("MUTABLE"),
+						ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(true)},
+					},
+				},
+			},
+			GetLifecyclePolicyResp: ecr.GetLifecyclePolicyOutput{LifecyclePolicyText: aws.String(policy)},
+			GetRepositoryPolicyErr: awserr.New(ecr.ErrCodeRepositoryPolicyNotFoundException, "not found", nil),
+			Calls:                  &calls,
+		},
+	}
+
+	arn, err := createRepository(context.Background(), clients, repository)
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:ecr:eu-west-1:123456789012:repository/app", arn)
+
+	// Only the settings that differ are changed
+	assert.Equal(t, []string{"PutImageTagMutability", "SetRepositoryPolicy"}, calls)
+}
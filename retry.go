@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	defaultRetryDelay = 5 * time.Second
+	maxRetryDelay     = 5 * time.Minute
+)
+
+// RetryOptions configures retrying a step when it fails
+type RetryOptions struct {
+	// Retries is the number of times to retry after the first attempt
+	Retries int `yaml:"retries"`
+
+	// RetryDelay is the delay before the first retry, which doubles with
+	// each following retry
+	RetryDelay Duration `yaml:"retry_delay"`
+
+	// RetryOn limits retries to errors matching an AWS error code, an exit
+	// code, or part of the error message. All errors are retried if empty
+	RetryOn []string `yaml:"retry_on"`
+}
+
+// retry runs the function until it succeeds, the retries are used up, or it
+// returns an error that should not be retried
+func (r RetryOptions) retry(ctx context.Context, run func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = run()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		if attempt > r.Retries || !r.shouldRetry(err) {
+			return err
+		}
+
+		delay := r.delay(attempt)
+		Log.Warnf("Failed: %s", err)
+		Log.Infof("Retrying in %s (%d/%d)", delay, attempt, r.Retries)
+
+		sleepErr := aws.SleepWithContext(ctx, delay)
+		if sleepErr != nil {
+			return err
+		}
+	}
+}
+
+// delay returns the exponential backoff for the given retry attempt
+func (r RetryOptions) delay(attempt int) time.Duration {
+	delay := time.Duration(r.RetryDelay)
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+
+	return delay
+}
+
+// shouldRetry returns true if the error matches any of the retry_on matchers
+func (r RetryOptions) shouldRetry(err error) bool {
+	if len(r.RetryOn) == 0 {
+		return true
+	}
+
+	var code string
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		code = aerr.Code()
+	}
+
+	exitCode, hasExitCode := errorExitCode(err)
+
+	for _, matcher := range r.RetryOn {
+		// Numbers only ever match exit codes
+		if _, numErr := strconv.Atoi(matcher); numErr == nil {
+			if hasExitCode && matcher == strconv.Itoa(exitCode) {
+				return true
+			}
+
+			continue
+		}
+
+		if code != "" && matcher == code {
+			return true
+		}
+
+		if strings.Contains(err.Error(), matcher) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errorExitCode returns the exit code of a failed command or container
+func errorExitCode(err error) (code int, ok bool) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), true
+	}
+
+	var containerErr ContainerError
+	if errors.As(err, &containerErr) {
+		return int(containerErr.ExitCode), true
+	}
+
+	return code, false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestRetryDelay(t *testing.T) {
+	r := RetryOptions{RetryDelay: Duration(time.Second)}
+
+	assert.Equal(t, time.Second, r.delay(1))
+	assert.Equal(t, 2*time.Second, r.delay(2))
+	assert.Equal(t, 8*time.Second, r.delay(4))
+	assert.Equal(t, maxRetryDelay, r.delay(20))
+
+	assert.Equal(t, defaultRetryDelay, RetryOptions{}.delay(1))
+}
+
+func TestRetryShouldRetry(t *testing.T) {
+	assert.True(t, RetryOptions{}.shouldRetry(fmt.Errorf("anything")))
+
+	r := RetryOptions{
+		RetryOn: []string{"ThrottlingException", "137", "RESOURCE:"},
+	}
+
+	assert.True(t, r.shouldRetry(awserr.New("ThrottlingException", "Rate exceeded", nil)))
+	assert.False(t, r.shouldRetry(awserr.New("AccessDeniedException", "Denied", nil)))
+	assert.True(t, r.shouldRetry(ContainerError{Container: "app", ExitCode: 137}))
+	assert.False(t, r.shouldRetry(ContainerError{Container: "app", ExitCode: 1}))
+	assert.True(t, r.shouldRetry(fmt.Errorf("==> task / RESOURCE:FARGATE / capacity <==")))
+	assert.False(t, r.shouldRetry(fmt.Errorf("failed after 137 seconds")))
+}
+
+func TestRetry(t *testing.T) {
+	r := RetryOptions{
+		Retries:    2,
+		RetryDelay: Duration(time.Millisecond),
+	}
+
+	attempts := 0
+	err = r.retry(context.Background(), func() error {
+		attempts++
+		return fmt.Errorf("failed")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = r.retry(context.Background(), func() error {
+		attempts++
+		if attempts < 2 {
+			return fmt.Errorf("failed")
+		}
+
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	r.RetryOn = []string{"ThrottlingException"}
+	attempts = 0
+	err = r.retry(context.Background(), func() error {
+		attempts++
+		return fmt.Errorf("failed")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, attempts)
+}
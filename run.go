@@ -1,71 +1,255 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"time"
 )
 
-// Deploy runs through the pipeline and performs each task
-func (config Config) Deploy() (err error) {
+// Step statuses used when summarising the pipeline
+const (
+	stepStatusCompleted   = "completed"
+	stepStatusFailed      = "failed"
+	stepStatusInterrupted = "interrupted"
+	stepStatusNotRun      = "not run"
+	stepStatusSkipped     = "skipped"
+)
+
+// cleanupTimeout limits how long a step that always runs can take after the
+// pipeline is interrupted, unless the step sets its own timeout
+const cleanupTimeout = 10 * time.Minute
+
+// Deploy runs through the pipeline and performs each task. If a step fails
+// or the context is cancelled, only steps marked as always are run after it,
+// and a summary of the pipeline is shown
+func (config Config) Deploy(ctx context.Context) (err error) {
+	statuses := make([]string, len(config.Options.Pipeline))
+	for i := range statuses {
+		statuses[i] = stepStatusNotRun
+	}
+
+	defer func() {
+		if err != nil {
+			config.logSummary(statuses)
+		}
+	}()
+
+	if config.Outputs == nil {
+		config.Outputs = make(map[string]Outputs)
+	}
+
+	w := config.whenContext()
+
 	for i, step := range config.Options.Pipeline {
-		switch step.Type {
-		case "task":
-			Log.Infof("[step %d] ==> task", i+1)
-			if step.Name != "" {
-				Log.Info("Name: ", step.Name)
+		if step.skip {
+			Log.Infof("[step %d] ==> %s (skipped)", i+1, step.Type)
+			statuses[i] = stepStatusSkipped
+			w.Results[step.Name] = stepResultSkipped
+			continue
+		}
+
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
+		// Once the pipeline has failed only steps that always run continue.
+		// If we were interrupted they get a fresh context so they can clean
+		// up, with a deadline so that they can't hang forever
+		stepCtx, cancel := ctx, context.CancelFunc(func() {})
+		if err != nil {
+			if !step.Always {
+				continue
 			}
 
-			client := Client{Region: config.Options.Region}
-			_, err = step.Task.Run(client, config)
-			if err != nil {
-				return err
+			if ctx.Err() != nil {
+				timeout := cleanupTimeout
+				if step.Wait.Timeout > 0 {
+					timeout = time.Duration(step.Wait.Timeout)
+				}
+
+				stepCtx, cancel = context.WithTimeout(context.Background(), timeout)
 			}
+		}
+
+		run, whenErr := evalWhen(step.When, w)
+		if whenErr != nil {
+			cancel()
+			return fmt.Errorf("[step %d] failed to evaluate when: %s", i+1, whenErr)
+		}
+
+		if !run {
+			cancel()
+			Log.Infof("[step %d] ==> %s (skipped by when)", i+1, step.Type)
+			statuses[i] = stepStatusSkipped
+			w.Results[step.Name] = stepResultSkipped
 
-		case "service":
-			Log.Infof("[step %d] ==> service", i+1)
+			if err == nil {
+				err = config.saveState(i, step)
+			}
+
+			continue
+		}
+
+		Log.Infof("[step %d] ==> %s", i+1, step.Type)
+		if step.Name != "" {
+			Log.Infof("Name: %s", step.Name)
+		}
+
+		stepErr := step.Retry.retry(stepCtx, func() (err error) {
+			outputs, err := config.runStep(stepCtx, step)
+
+			// Outputs are kept even if the step fails, since later steps
+			// may want to know why
 			if step.Name != "" {
-				Log.Info("Name: ", step.Name)
+				config.Outputs[step.Name] = outputs
 			}
+			outputs.log()
 
-			client := Client{Region: config.Options.Region}
-			_, err = step.Service.Run(client, config)
-			if err != nil {
-				return err
+			return err
+		})
+		interrupted := stepCtx.Err() != nil
+		cancel()
+
+		if stepErr != nil {
+			statuses[i] = stepStatusFailed
+			w.Results[step.Name] = stepResultFailure
+
+			if interrupted {
+				statuses[i] = stepStatusInterrupted
 			}
 
-		case "script":
-			Log.Infof("[step %d] ==> script", i+1)
-			if step.Name != "" {
-				Log.Info("Name: ", step.Name)
+			if step.OnFailure == "continue" && !interrupted {
+				Log.Warnf("[step %d] failed, continuing: %s", i+1, stepErr)
+
+				if err == nil {
+					err = config.saveState(i, step)
+				}
+
+				continue
+			}
+
+			if err == nil {
+				err = stepErr
+			} else {
+				Log.Errorf("[step %d] failed: %s", i+1, stepErr)
+			}
+
+			continue
+		}
+
+		statuses[i] = stepStatusCompleted
+		w.Results[step.Name] = stepResultSuccess
+
+		// Only record progress while the pipeline is succeeding, so that
+		// cleanup steps don't move the resume point
+		if err == nil {
+			err = config.saveState(i, step)
+		}
+	}
+
+	return err
+}
+
+// whenContext returns the context used to evaluate when expressions
+func (config Config) whenContext() *whenContext {
+	return &whenContext{
+		Environment: config.EnvironmentName,
+		ProjectName: config.ProjectName,
+		Tag:         config.Tag,
+		Results:     make(map[string]string),
+		Outputs:     config.Outputs,
+
+		Branch: currentBranch,
+		Changed: func() (files []string, err error) {
+			// A revision given explicitly must exist
+			if config.ChangedSince != "" {
+				files, err = changedFilesSince(config.ChangedSince)
+				if err != nil {
+					return files, fmt.Errorf("cannot find files changed since %s: %s", config.ChangedSince, err)
+				}
+
+				return files, err
 			}
 
-			_, err = step.Script.Run()
+			state, err := config.LoadState()
 			if err != nil {
-				return err
+				return files, err
 			}
 
-		case "docker":
-			Log.Infof("[step %d] ==> docker", i+1)
-			if step.Name != "" {
-				Log.Infof("Name: %s", step.Name)
+			// Without a previous deploy, everything has changed
+			if state.LastDeployedTag == "" {
+				Log.Info("No previous deploy to compare with, assuming everything changed")
+				return files, err
 			}
 
-			client := Client{Region: config.Options.Region}
-			err = step.Docker.Run(client, config)
+			files, err = changedFilesSince(state.LastDeployedTag)
 			if err != nil {
-				return err
+				Log.Warnf("Cannot find files changed since %s, assuming everything changed: %s", state.LastDeployedTag, err)
+				return nil, nil
 			}
-		default:
-			Log.Fatal("Invalid configuration")
+
+			return files, err
+		},
+	}
+}
+
+// runStep runs a single step of the pipeline, and returns its outputs
+func (config Config) runStep(ctx context.Context, step Step) (outputs Outputs, err error) {
+	client := NewClient(config)
+
+	// Service and task steps pass their wait options to whatever they wait
+	// for, but other steps just stop when they reach the timeout
+	if step.Wait.Timeout > 0 && (step.Type == "script" || step.Type == "docker") {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(step.Wait.Timeout))
+		defer cancel()
+	}
+
+	switch step.Type {
+	case "task":
+		var taskArn string
+		taskArn, err = step.Task.Run(ctx, client, config, step.Wait)
+
+		outputs = Outputs{"task_arn": taskArn}
+		if err == nil {
+			outputs["exit_code"] = "0"
+		} else if code, ok := errorExitCode(err); ok {
+			outputs["exit_code"] = strconv.Itoa(code)
 		}
+	case "service":
+		var serviceName string
+		serviceName, err = step.Service.Run(ctx, client, config, step.Wait)
+
+		outputs = Outputs{"service_name": serviceName}
+	case "script":
+		outputs, err = step.Script.Run(ctx, config)
+	case "docker":
+		outputs, err = step.Docker.Run(ctx, client, config)
+	default:
+		Log.Fatal("Invalid configuration")
 	}
 
-	return err
+	return outputs, err
+}
+
+// logSummary shows the state of each step when the pipeline did not finish
+func (config Config) logSummary(statuses []string) {
+	Log.Info("Pipeline summary:")
+
+	for i, step := range config.Options.Pipeline {
+		name := step.Type
+		if step.Name != "" {
+			name = fmt.Sprintf("%s (%s)", step.Type, step.Name)
+		}
+
+		Log.Infof("[step %d] %s: %s", i+1, name, statuses[i])
+	}
 }
 
 // Remove deletes a resource
-func (config Config) Remove(resource, name string) (err error) {
-	c := Client{Region: config.Options.Region}
-	clients, err := c.InitClients()
+func (config Config) Remove(ctx context.Context, resource, name string) (err error) {
+	clients, err := NewClient(config).InitClients()
 	if err != nil {
 		return err
 	}
@@ -80,25 +264,60 @@ func (config Config) Remove(resource, name string) (err error) {
 		service.Name = name
 
 		serviceNamePrefix := service.serviceNamePrefix(config)
-		serviceName, err := service.checkServicePrefixExists(clients, config, serviceNamePrefix)
+		serviceName, err := service.checkServicePrefixExists(ctx, clients, config, serviceNamePrefix)
 		if err != nil {
 			return err
 		}
 
-		err = service.Delete(clients, config, serviceName)
+		err = service.Delete(ctx, clients, config, serviceName, service.Wait)
 		if err != nil {
 			return err
 		}
 
 		Log.Infof("Deleted service %s", serviceName)
 
+		err = deleteCodeDeployApplication(ctx, clients, config)
+		if err != nil {
+			return err
+		}
+
 	case "cluster":
 		Log.Infof("Deleting cluster %s", config.Options.ClusterName)
-		err = clients.DeleteCluster(config)
+		err = clients.DeleteCluster(ctx, config)
 		if err != nil {
 			return err
 		}
 		Log.Infof("Cluster %s deleted", config.Options.ClusterName)
+
+	case "role":
+		definition, ok := config.Definitions[name]
+		if !ok {
+			return fmt.Errorf("cannot find definition configured called %s", name)
+		}
+
+		// The execution role is shared by every definition that doesn't set
+		// its own, and is created again by the next deploy that needs it
+		var roleNames []string
+		if definition.IAM.enabled() {
+			roleNames = append(roleNames, config.taskRoleName(name))
+		}
+
+		if definition.ExecutionRoleName == "" {
+			roleNames = append(roleNames, config.executionRoleName())
+		}
+
+		if len(roleNames) == 0 {
+			return fmt.Errorf("definition %s does not have a role managed by flecs", name)
+		}
+
+		for _, roleName := range roleNames {
+			err = deleteRole(ctx, clients, roleName)
+			if err != nil {
+				return err
+			}
+
+			Log.Infof("Deleted role %s", roleName)
+		}
 	}
 
 	return err
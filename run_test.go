@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeployConditionalSteps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flecs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	yamlConfig = fmt.Sprintf(`---
+pipeline:
+  - type: script
+    name: staging-only
+    inline: touch %[1]s/staging
+    when: environment == "staging"
+  - type: script
+    name: allowed-to-fail
+    inline: "false"
+    on_failure: continue
+  - type: script
+    name: after-failure
+    inline: touch %[1]s/after-failure
+    when: steps.allowed-to-fail.result == "failure"
+`, dir)
+
+	cfg, err := LoadConfig(yamlConfig, "production", "abc123", "", false)
+	assert.Nil(t, err)
+	cfg.StateFile = filepath.Join(dir, "state.yaml")
+
+	err = cfg.Deploy(context.Background())
+	assert.Nil(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "staging"))
+	assert.True(t, os.IsNotExist(err))
+	assert.FileExists(t, filepath.Join(dir, "after-failure"))
+
+	// Skipped and allowed failures still complete the pipeline
+	state, err := cfg.LoadState()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3}, state.CompletedSteps)
+	assert.Equal(t, "abc123", state.LastDeployedTag)
+}
+
+func TestDeployAlwaysSteps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flecs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	yamlConfig = fmt.Sprintf(`---
+pipeline:
+  - type: script
+    name: fails
+    inline: "false"
+  - type: script
+    name: never-runs
+    inline: touch %[1]s/never-runs
+  - type: script
+    name: cleanup
+    inline: touch %[1]s/cleanup
+    always: true
+`, dir)
+
+	cfg, err := LoadConfig(yamlConfig, "", "", "", false)
+	assert.Nil(t, err)
+
+	err = cfg.Deploy(context.Background())
+	assert.NotNil(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "never-runs"))
+	assert.True(t, os.IsNotExist(err))
+	assert.FileExists(t, filepath.Join(dir, "cleanup"))
+
+	// After an interrupt, steps that always run are stopped at their timeout
+	yamlConfig = fmt.Sprintf(`---
+pipeline:
+  - type: script
+    name: hangs
+    inline: sleep 10
+    always: true
+    timeout: 100ms
+  - type: script
+    name: cleanup
+    inline: touch %[1]s/cleanup-after-interrupt
+    always: true
+`, dir)
+
+	cfg, err = LoadConfig(yamlConfig, "", "", "", false)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = cfg.Deploy(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.FileExists(t, filepath.Join(dir, "cleanup-after-interrupt"))
+}
+
+func TestDeployOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flecs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	yamlConfig = fmt.Sprintf(`---
+pipeline:
+  - type: script
+    name: version
+    inline: echo ::set-output name=version::42
+  - type: script
+    name: write
+    inline: touch %s/{{ steps.version.version }}
+`, dir)
+
+	cfg, err := LoadConfig(yamlConfig, "", "", "", false)
+	assert.Nil(t, err)
+
+	err = cfg.Deploy(context.Background())
+	assert.Nil(t, err)
+
+	assert.FileExists(t, filepath.Join(dir, "42"))
+}
+
+func TestWhenContextChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flecs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{ProjectName: "shop", StateFile: filepath.Join(dir, "state.yaml")}
+
+	// Without a previous deploy we don't know what has changed
+	files, err := cfg.whenContext().Changed()
+	assert.Nil(t, err)
+	assert.Nil(t, files)
+
+	// A revision given explicitly must exist
+	cfg.ChangedSince = "does-not-exist"
+	_, err = cfg.whenContext().Changed()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// scanSeverities are the finding severities from lowest to highest. Anything
+// else, such as UNDEFINED, is treated as the lowest
+var scanSeverities = []string{
+	ecr.FindingSeverityInformational,
+	ecr.FindingSeverityLow,
+	ecr.FindingSeverityMedium,
+	ecr.FindingSeverityHigh,
+	ecr.FindingSeverityCritical,
+}
+
+// ScanOptions fails the docker step if the ECR image scan finds
+// vulnerabilities at or above a severity
+type ScanOptions struct {
+	FailOn string           `yaml:"fail_on"`
+	Ignore []IgnoredFinding `yaml:"ignore"`
+
+	// Wait configures how long to wait for the scan to finish
+	Wait WaitOptions `yaml:",inline"`
+}
+
+// IgnoredFinding is a vulnerability that doesn't fail the step until it
+// expires
+type IgnoredFinding struct {
+	ID      string    `yaml:"id"`
+	Expires time.Time `yaml:"expires"`
+	Reason  string    `yaml:"reason"`
+}
+
+// scanFinding is a vulnerability found by either basic or enhanced scanning
+type scanFinding struct {
+	ID       string
+	Severity string
+	Package  string
+}
+
+// enabled returns true if the scan should be checked
+func (s ScanOptions) enabled() bool {
+	return s.FailOn != ""
+}
+
+// validate checks the scan options
+func (s ScanOptions) validate() (err error) {
+	if s.FailOn != "" && !stringInSlice(s.FailOn, scanSeverities) {
+		return fmt.Errorf("invalid scan fail_on %s, must be one of %s", s.FailOn, strings.Join(scanSeverities, ", "))
+	}
+
+	for _, ignore := range s.Ignore {
+		if ignore.ID == "" {
+			return fmt.Errorf("must specify id for each ignored scan finding")
+		}
+
+		if ignore.Expires.IsZero() {
+			return fmt.Errorf("must specify expires for ignored scan finding %s", ignore.ID)
+		}
+	}
+
+	return err
+}
+
+// severityRank returns how severe a finding is, for comparing severities
+func severityRank(severity string) int {
+	for i, s := range scanSeverities {
+		if s == severity {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// checkImage waits for the image scan to finish, and returns an error if it
+// found any vulnerabilities that fail the step
+func (s ScanOptions) checkImage(ctx context.Context, clients Clients, repository, digest string) (err error) {
+	Log.Infof("Waiting for image scan of %s@%s", repository, digest)
+
+	findings, err := s.findings(ctx, clients, repository, digest)
+	if err != nil {
+		return err
+	}
+
+	return s.evaluate(findings, time.Now(), os.Stdout)
+}
+
+// findings waits for the scan to finish and returns everything it found.
+// The scan is started if the repository doesn't scan on push
+func (s ScanOptions) findings(ctx context.Context, clients Clients, repository, digest string) (findings []scanFinding, err error) {
+	input := ecr.DescribeImageScanFindingsInput{
+		ImageId:        &ecr.ImageIdentifier{ImageDigest: aws.String(digest)},
+		RepositoryName: aws.String(repository),
+	}
+
+	started := false
+	err = s.Wait.merge(imageScanWait).poll(ctx, func() (bool, error) {
+		resp, err := clients.ECR.DescribeImageScanFindingsWithContext(ctx, &input)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeScanNotFoundException {
+			if started {
+				return false, nil
+			}
+
+			Log.Infof("Starting image scan of %s@%s", repository, digest)
+			_, err = clients.ECR.StartImageScanWithContext(ctx, &ecr.StartImageScanInput{
+				ImageId:        input.ImageId,
+				RepositoryName: input.RepositoryName,
+			})
+			started = true
+			return false, err
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		status := resp.ImageScanStatus
+		if status == nil {
+			return false, nil
+		}
+
+		switch aws.StringValue(status.Status) {
+		case ecr.ScanStatusComplete, ecr.ScanStatusActive:
+			return true, nil
+		case ecr.ScanStatusInProgress, ecr.ScanStatusPending:
+			return false, nil
+		}
+
+		return false, fmt.Errorf("image scan %s: %s", strings.ToLower(aws.StringValue(status.Status)), aws.StringValue(status.Description))
+	})
+	if err != nil {
+		return findings, err
+	}
+
+	for {
+		resp, err := clients.ECR.DescribeImageScanFindingsWithContext(ctx, &input)
+		if err != nil {
+			return findings, err
+		}
+
+		if resp.ImageScanFindings != nil {
+			for _, f := range resp.ImageScanFindings.Findings {
+				finding := scanFinding{
+					ID:       aws.StringValue(f.Name),
+					Severity: aws.StringValue(f.Severity),
+				}
+
+				for _, attribute := range f.Attributes {
+					if aws.StringValue(attribute.Key) == "package_name" {
+						finding.Package = aws.StringValue(attribute.Value)
+					}
+				}
+
+				findings = append(findings, finding)
+			}
+
+			for _, f := range resp.ImageScanFindings.EnhancedFindings {
+				finding := scanFinding{
+					ID:       aws.StringValue(f.Title),
+					Severity: aws.StringValue(f.Severity),
+				}
+
+				if details := f.PackageVulnerabilityDetails; details != nil {
+					finding.ID = aws.StringValue(details.VulnerabilityId)
+
+					if len(details.VulnerablePackages) > 0 {
+						finding.Package = aws.StringValue(details.VulnerablePackages[0].Name)
+					}
+				}
+
+				findings = append(findings, finding)
+			}
+		}
+
+		if resp.NextToken == nil {
+			return findings, err
+		}
+
+		input.NextToken = resp.NextToken
+	}
+}
+
+// evaluate prints a summary of the findings at or above the severity that
+// fails the step, and returns an error if any of them are not ignored
+func (s ScanOptions) evaluate(findings []scanFinding, now time.Time, out io.Writer) (err error) {
+	ignored := make(map[string]IgnoredFinding)
+	for _, ignore := range s.Ignore {
+		ignored[ignore.ID] = ignore
+	}
+
+	counts := make(map[string]int)
+	failed, rows := 0, 0
+
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tSEVERITY\tPACKAGE\tRESULT")
+
+	for _, finding := range findings {
+		counts[finding.Severity]++
+
+		if severityRank(finding.Severity) < severityRank(s.FailOn) {
+			continue
+		}
+
+		result := "fail"
+		if ignore, ok := ignored[finding.ID]; ok {
+			if now.Before(ignore.Expires) {
+				result = fmt.Sprintf("ignored until %s", ignore.Expires.Format("2006-01-02"))
+			} else {
+				result = fmt.Sprintf("fail (ignore expired %s)", ignore.Expires.Format("2006-01-02"))
+			}
+		}
+
+		if strings.HasPrefix(result, "fail") {
+			failed++
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", finding.ID, finding.Severity, finding.Package, result)
+		rows++
+	}
+
+	var summary []string
+	for i := len(scanSeverities) - 1; i >= 0; i-- {
+		summary = append(summary, fmt.Sprintf("%s: %d", scanSeverities[i], counts[scanSeverities[i]]))
+	}
+
+	Log.Infof("Image scan found %d vulnerabilities (%s)", len(findings), strings.Join(summary, ", "))
+
+	if rows > 0 {
+		err = table.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("image scan found %d vulnerabilities at or above %s", failed, s.FailOn)
+	}
+
+	return err
+}
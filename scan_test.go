@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanFindings(t *testing.T) {
+	responses := []*ecr.DescribeImageScanFindingsOutput{
+		nil,
+		{ImageScanStatus: &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusInProgress)}},
+		{ImageScanStatus: &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusComplete)}},
+		{
+			ImageScanFindings: &ecr.ImageScanFindings{
+				Findings: []*ecr.ImageScanFinding{
+					{
+						Name:       aws.String("CVE-2021-1"),
+						Severity:   aws.String("HIGH"),
+						Attributes: []*ecr.Attribute{{Key: aws.String("package_name"), Value: aws.String("openssl")}},
+					},
+				},
+			},
+			NextToken: aws.String("next"),
+		},
+		{
+			ImageScanFindings: &ecr.ImageScanFindings{
+				EnhancedFindings: []*ecr.EnhancedImageScanFinding{
+					{
+						Severity: aws.String("CRITICAL"),
+						PackageVulnerabilityDetails: &ecr.PackageVulnerabilityDetails{
+							VulnerabilityId:    aws.String("CVE-2021-2"),
+							VulnerablePackages: []*ecr.VulnerablePackage{{Name: aws.String("glibc")}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	var calls []string
+	clients := Clients{
+		ECR: mockedECRClient{
+			ScanFindings: func() (*ecr.DescribeImageScanFindingsOutput, error) {
+				resp := responses[0]
+				responses = responses[1:]
+
+				if resp == nil {
+					return resp, awserr.New(ecr.ErrCodeScanNotFoundException, "not found", nil)
+				}
+
+				return resp, nil
+			},
+			Calls: &calls,
+		},
+	}
+
+	scan := ScanOptions{FailOn: "HIGH", Wait: WaitOptions{Timeout: Duration(time.Second), PollInterval: Duration(time.Millisecond)}}
+
+	findings, err := scan.findings(context.Background(), clients, "app", "sha256:abc")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"StartImageScan"}, calls)
+	assert.Equal(t, []scanFinding{
+		{ID: "CVE-2021-1", Severity: "HIGH", Package: "openssl"},
+		{ID: "CVE-2021-2", Severity: "CRITICAL", Package: "glibc"},
+	}, findings)
+}
+
+func TestScanEvaluate(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	findings := []scanFinding{
+		{ID: "CVE-2021-1", Severity: "CRITICAL", Package: "openssl"},
+		{ID: "CVE-2021-2", Severity: "HIGH", Package: "glibc"},
+		{ID: "CVE-2021-3", Severity: "MEDIUM", Package: "zlib"},
+	}
+
+	scan := ScanOptions{
+		FailOn: "HIGH",
+		Ignore: []IgnoredFinding{
+			{ID: "CVE-2021-1", Expires: time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)},
+			{ID: "CVE-2021-2", Expires: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	var out bytes.Buffer
+	err := scan.evaluate(findings, now, &out)
+	assert.EqualError(t, err, "image scan found 1 vulnerabilities at or above HIGH")
+	assert.Equal(t, `ID          SEVERITY  PACKAGE  RESULT
+CVE-2021-1  CRITICAL  openssl  ignored until 2021-07-01
+CVE-2021-2  HIGH      glibc    fail (ignore expired 2021-05-01)
+`, out.String())
+
+	scan.FailOn = "CRITICAL"
+	out.Reset()
+	err = scan.evaluate(findings, now, &out)
+	assert.Nil(t, err)
+
+	assert.Nil(t, scan.validate())
+	assert.NotNil(t, ScanOptions{FailOn: "SEVERE"}.validate())
+	assert.NotNil(t, ScanOptions{FailOn: "HIGH", Ignore: []IgnoredFinding{{ID: "CVE-2021-1"}}}.validate())
+}
@@ -1,43 +1,74 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 )
 
-// Script runs an arbitary command
+// Script runs an arbitary command. Any lines written to stdout in the form
+// "::set-output name=<name>::<value>" are published as outputs
 type ScriptStep struct {
-	Path   string `yaml:"path"`
-	Inline string `yaml:"inline"`
+	Path   string            `yaml:"path"`
+	Inline string            `yaml:"inline"`
+	Env    map[string]string `yaml:"env"`
 }
 
-func (s ScriptStep) Run() (cmd exec.Cmd, err error) {
+func (s ScriptStep) Run(ctx context.Context, cfg Config) (outputs Outputs, err error) {
+	outputs = make(Outputs)
+
 	if s.Path != "" && s.Inline != "" {
-		return cmd, fmt.Errorf("cannot define both path and inline")
+		return outputs, fmt.Errorf("cannot define both path and inline")
 	}
 
+	var cmd *exec.Cmd
+
 	if s.Path != "" {
-		cmd = exec.Cmd{
-			Path: "/bin/bash",
-			Args: []string{"/bin/bash", s.Path},
-		}
+		cmd = exec.CommandContext(ctx, "/bin/bash", s.Path)
 	}
 
 	if s.Inline != "" {
-		args := strings.Split(s.Inline, " ")
-		if len(args) > 1 {
-			cmd = *exec.Command(args[0], args[1:len(args)-1]...)
-		} else {
-			cmd = *exec.Command(s.Inline)
+		inline, err := cfg.interpolate(s.Inline)
+		if err != nil {
+			return outputs, err
 		}
+
+		args := strings.Split(inline, " ")
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+	}
+
+	if cmd == nil {
+		return outputs, fmt.Errorf("must define one of path or inline")
+	}
+
+	env, err := cfg.interpolateMap(s.Env)
+	if err != nil {
+		return outputs, err
+	}
+
+	cmd.Env = os.Environ()
+	for name, value := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", name, value))
 	}
 
-	cmd.Stdout = os.Stdout
+	var stdout bytes.Buffer
+	cmd.Stdout = io.MultiWriter(os.Stdout, &stdout)
 	cmd.Stderr = os.Stderr
 
 	err = cmd.Run()
 
-	return cmd, err
+	for name, value := range parseSetOutputs(stdout.String()) {
+		outputs[name] = value
+	}
+
+	if cmd.ProcessState != nil {
+		outputs["exit_code"] = strconv.Itoa(cmd.ProcessState.ExitCode())
+	}
+
+	return outputs, err
 }
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	secretsStoreSSM            = "ssm"
+	secretsStoreSecretsManager = "secretsmanager"
+)
+
+// secretsStores are where secrets can be stored. SSM is used by default
+var secretsStores = []string{secretsStoreSSM, secretsStoreSecretsManager}
+
+// SecretsFile is a local file of secrets. The names are in plain text, and
+// each value is encrypted with a data key that is itself encrypted with KMS
+type SecretsFile struct {
+	KMSKeyID string            `yaml:"kms_key_id"`
+	DataKey  string            `yaml:"data_key"`
+	Secrets  map[string]string `yaml:"secrets"`
+
+	path string
+	key  []byte
+}
+
+// secretChange is a difference between the local secrets and the store
+type secretChange struct {
+	Name   string
+	Action string
+}
+
+// secretsPrefix returns the prefix of the secrets flecs manages for the
+// project and environment
+func (cfg Config) secretsPrefix() string {
+	parts := []string{"", "flecs", cfg.ProjectName}
+	if cfg.EnvironmentName != "" {
+		parts = append(parts, cfg.EnvironmentName)
+	}
+
+	return strings.Join(parts, "/") + "/"
+}
+
+// secretsFile returns the path to the local secrets file
+func (cfg Config) secretsFile() string {
+	if cfg.Options.SecretsFile != "" {
+		return cfg.Options.SecretsFile
+	}
+
+	if cfg.EnvironmentName != "" {
+		return fmt.Sprintf("flecs.%s.secrets.yaml", cfg.EnvironmentName)
+	}
+
+	return "flecs.secrets.yaml"
+}
+
+// resolveSecrets returns the secrets to pass to containers. Secrets that are
+// configured without a value refer to the secret of the same name that flecs
+// manages. For Secrets Manager this is a partial ARN without the random
+// suffix, which resolveSecretARNs completes
+func (cfg Config) resolveSecrets(accountID string) map[string]string {
+	secrets := make(map[string]string, len(cfg.Options.Secrets))
+	for name, valueFrom := range cfg.Options.Secrets {
+		if valueFrom == "" {
+			valueFrom = cfg.managedSecretARN(accountID, name)
+		}
+
+		secrets[name] = valueFrom
+	}
+
+	return secrets
+}
+
+// resolveSecretARNs returns the secrets to pass to containers, looking up
+// the full ARN of each Secrets Manager secret that flecs manages, since ECS
+// treats anything that isn't a full ARN as the name of an SSM parameter
+func (cfg Config) resolveSecretARNs(ctx context.Context, c Clients, accountID string) (secrets map[string]string, err error) {
+	secrets = cfg.resolveSecrets(accountID)
+	if cfg.Options.SecretsStore != secretsStoreSecretsManager {
+		return secrets, err
+	}
+
+	for _, name := range sortedKeys(cfg.Options.Secrets) {
+		if cfg.Options.Secrets[name] != "" {
+			continue
+		}
+
+		resp, err := c.SecretsManager.DescribeSecretWithContext(ctx, &secretsmanager.DescribeSecretInput{
+			SecretId: aws.String(cfg.secretsPrefix() + name),
+		})
+		if err != nil {
+			return secrets, fmt.Errorf("cannot find secret %s%s: %s", cfg.secretsPrefix(), name, err)
+		}
+
+		secrets[name] = aws.StringValue(resp.ARN)
+	}
+
+	return secrets, err
+}
+
+// managedSecretARN returns the ARN of a secret that flecs manages. Secrets
+// Manager adds a random suffix to the ARN, so this is a partial ARN
+func (cfg Config) managedSecretARN(accountID, name string) string {
+	if cfg.Options.SecretsStore == secretsStoreSecretsManager {
+		return fmt.Sprintf("arn:aws:secretsmanager:%s:%s:secret:%s%s", cfg.Options.Region, accountID, cfg.secretsPrefix(), name)
+	}
+
+	return fmt.Sprintf("arn:aws:ssm:%s:%s:parameter%s%s", cfg.Options.Region, accountID, cfg.secretsPrefix(), name)
+}
+
+// loadSecretsFile reads the secrets file, or returns an empty one if it
+// doesn't exist
+func loadSecretsFile(path string) (file SecretsFile, err error) {
+	file.path = path
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+
+	if err != nil {
+		return file, err
+	}
+
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		return file, fmt.Errorf("cannot read secrets file %s: %s", path, err)
+	}
+
+	return file, err
+}
+
+// unlock decrypts the data key with KMS, or creates one with the key if the
+// file is new
+func (f *SecretsFile) unlock(ctx context.Context, c Clients, kmsKeyID string) (err error) {
+	if f.DataKey == "" {
+		if kmsKeyID == "" {
+			return fmt.Errorf("must set secrets_kms_key_id to create %s", f.path)
+		}
+
+		resp, err := c.KMS.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+			KeyId:   aws.String(kmsKeyID),
+			KeySpec: aws.String(kms.DataKeySpecAes256),
+		})
+		if err != nil {
+			return err
+		}
+
+		f.KMSKeyID = kmsKeyID
+		f.DataKey = base64.StdEncoding.EncodeToString(resp.CiphertextBlob)
+		f.key = resp.Plaintext
+		return err
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(f.DataKey)
+	if err != nil {
+		return fmt.Errorf("invalid data_key in %s: %s", f.path, err)
+	}
+
+	resp, err := c.KMS.DecryptWithContext(ctx, &kms.DecryptInput{
+		CiphertextBlob: blob,
+		KeyId:          aws.String(f.KMSKeyID),
+	})
+	if err != nil {
+		return err
+	}
+
+	f.key = resp.Plaintext
+	return err
+}
+
+// gcm returns the cipher for the data key
+func (f SecretsFile) gcm() (gcm cipher.AEAD, err error) {
+	if f.key == nil {
+		return gcm, fmt.Errorf("secrets file %s is locked", f.path)
+	}
+
+	block, err := aes.NewCipher(f.key)
+	if err != nil {
+		return gcm, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Set encrypts and sets the value of a secret. The name is authenticated with
+// the value, so values cannot be swapped between secrets
+func (f *SecretsFile) Set(name, value string) (err error) {
+	gcm, err := f.gcm()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+
+	if f.Secrets == nil {
+		f.Secrets = make(map[string]string)
+	}
+
+	f.Secrets[name] = base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), []byte(name)))
+	return err
+}
+
+// Get decrypts the value of a secret
+func (f SecretsFile) Get(name string) (value string, err error) {
+	encrypted, ok := f.Secrets[name]
+	if !ok {
+		return value, fmt.Errorf("cannot find secret %s in %s", name, f.path)
+	}
+
+	gcm, err := f.gcm()
+	if err != nil {
+		return value, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return value, fmt.Errorf("invalid value for secret %s", name)
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return value, fmt.Errorf("cannot decrypt secret %s: %s", name, err)
+	}
+
+	return string(plaintext), err
+}
+
+// Values decrypts every secret
+func (f SecretsFile) Values() (values map[string]string, err error) {
+	values = make(map[string]string, len(f.Secrets))
+	for name := range f.Secrets {
+		values[name], err = f.Get(name)
+		if err != nil {
+			return values, err
+		}
+	}
+
+	return values, err
+}
+
+// Save writes the secrets file so that only the current user can read it
+func (f SecretsFile) Save() (err error) {
+	data, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(f.path, data, 0600)
+}
+
+// secretStore is somewhere that secrets are stored for tasks to read
+type secretStore interface {
+	// List returns the value of every secret, by name
+	List(ctx context.Context) (map[string]string, error)
+	Put(ctx context.Context, name, value string) error
+	Delete(ctx context.Context, name string) error
+}
+
+// newSecretStore returns the configured store
+func newSecretStore(c Clients, cfg Config) secretStore {
+	if cfg.Options.SecretsStore == secretsStoreSecretsManager {
+		return secretsManagerStore{clients: c, prefix: cfg.secretsPrefix()}
+	}
+
+	return ssmStore{clients: c, prefix: cfg.secretsPrefix()}
+}
+
+// ssmStore stores secrets as SecureString parameters in SSM Parameter Store
+type ssmStore struct {
+	clients Clients
+	prefix  string
+}
+
+// List returns the parameters under the prefix
+func (s ssmStore) List(ctx context.Context) (values map[string]string, err error) {
+	values = make(map[string]string)
+
+	// Names can contain slashes, which SSM treats as a hierarchy
+	err = s.clients.SSM.GetParametersByPathPagesWithContext(ctx, &ssm.GetParametersByPathInput{
+		Path:           aws.String(s.prefix),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	}, func(page *ssm.GetParametersByPathOutput, lastPage bool) bool {
+		for _, parameter := range page.Parameters {
+			values[strings.TrimPrefix(aws.StringValue(parameter.Name), s.prefix)] = aws.StringValue(parameter.Value)
+		}
+
+		return true
+	})
+
+	return values, err
+}
+
+// Put creates or updates a parameter
+func (s ssmStore) Put(ctx context.Context, name, value string) (err error) {
+	_, err = s.clients.SSM.PutParameterWithContext(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(s.prefix + name),
+		Overwrite: aws.Bool(true),
+		Type:      aws.String(ssm.ParameterTypeSecureString),
+		Value:     aws.String(value),
+	})
+
+	return err
+}
+
+// Delete deletes a parameter
+func (s ssmStore) Delete(ctx context.Context, name string) (err error) {
+	_, err = s.clients.SSM.DeleteParameterWithContext(ctx, &ssm.DeleteParameterInput{
+		Name: aws.String(s.prefix + name),
+	})
+
+	return err
+}
+
+// secretsManagerStore stores secrets in Secrets Manager
+type secretsManagerStore struct {
+	clients Clients
+	prefix  string
+}
+
+// List returns the secrets with names starting with the prefix
+func (s secretsManagerStore) List(ctx context.Context) (values map[string]string, err error) {
+	values = make(map[string]string)
+
+	var names []string
+	err = s.clients.SecretsManager.ListSecretsPagesWithContext(ctx, &secretsmanager.ListSecretsInput{
+		Filters: []*secretsmanager.Filter{
+			{Key: aws.String(secretsmanager.FilterNameStringTypeName), Values: aws.StringSlice([]string{s.prefix})},
+		},
+	}, func(page *secretsmanager.ListSecretsOutput, lastPage bool) bool {
+		for _, secret := range page.SecretList {
+			// The filter matches anywhere in the name
+			if strings.HasPrefix(aws.StringValue(secret.Name), s.prefix) {
+				names = append(names, aws.StringValue(secret.Name))
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return values, err
+	}
+
+	for _, name := range names {
+		resp, err := s.clients.SecretsManager.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(name),
+		})
+		if err != nil {
+			return values, err
+		}
+
+		values[strings.TrimPrefix(name, s.prefix)] = aws.StringValue(resp.SecretString)
+	}
+
+	return values, err
+}
+
+// Put creates a secret, or adds a new version if it exists
+func (s secretsManagerStore) Put(ctx context.Context, name, value string) (err error) {
+	_, err = s.clients.SecretsManager.PutSecretValueWithContext(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(s.prefix + name),
+		SecretString: aws.String(value),
+	})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != secretsmanager.ErrCodeResourceNotFoundException {
+		return err
+	}
+
+	_, err = s.clients.SecretsManager.CreateSecretWithContext(ctx, &secretsmanager.CreateSecretInput{
+		Name:         aws.String(s.prefix + name),
+		SecretString: aws.String(value),
+	})
+
+	return err
+}
+
+// Delete schedules a secret for deletion after the default recovery window
+func (s secretsManagerStore) Delete(ctx context.Context, name string) (err error) {
+	_, err = s.clients.SecretsManager.DeleteSecretWithContext(ctx, &secretsmanager.DeleteSecretInput{
+		SecretId: aws.String(s.prefix + name),
+	})
+
+	return err
+}
+
+// diffSecrets returns the changes needed to make the store match the local
+// values, in order of name
+func diffSecrets(local, remote map[string]string) (changes []secretChange) {
+	names := make(map[string]string)
+	for name := range local {
+		names[name] = ""
+	}
+
+	for name := range remote {
+		names[name] = ""
+	}
+
+	for _, name := range sortedKeys(names) {
+		localValue, inLocal := local[name]
+		remoteValue, inRemote := remote[name]
+
+		switch {
+		case inLocal && !inRemote:
+			changes = append(changes, secretChange{Name: name, Action: "add"})
+		case !inLocal && inRemote:
+			changes = append(changes, secretChange{Name: name, Action: "remove"})
+		case localValue != remoteValue:
+			changes = append(changes, secretChange{Name: name, Action: "update"})
+		}
+	}
+
+	return changes
+}
+
+// syncSecrets pushes local secrets that were added or changed to the store.
+// Secrets that are only in the store are deleted if prune is set
+func syncSecrets(ctx context.Context, store secretStore, local map[string]string, prune bool) (changes []secretChange, err error) {
+	remote, err := store.List(ctx)
+	if err != nil {
+		return changes, err
+	}
+
+	for _, change := range diffSecrets(local, remote) {
+		switch change.Action {
+		case "add", "update":
+			err = store.Put(ctx, change.Name, local[change.Name])
+		case "remove":
+			if !prune {
+				continue
+			}
+
+			err = store.Delete(ctx, change.Name)
+		}
+
+		if err != nil {
+			return changes, fmt.Errorf("cannot %s secret %s: %s", change.Action, change.Name, err)
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, err
+}
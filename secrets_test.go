@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memorySecretStore is a secret store for testing
+type memorySecretStore map[string]string
+
+func (m memorySecretStore) List(context.Context) (map[string]string, error) {
+	values := make(map[string]string)
+	for name, value := range m {
+		values[name] = value
+	}
+
+	return values, nil
+}
+
+func (m memorySecretStore) Put(ctx context.Context, name, value string) error {
+	m[name] = value
+	return nil
+}
+
+func (m memorySecretStore) Delete(ctx context.Context, name string) error {
+	delete(m, name)
+	return nil
+}
+
+func TestSecretsFile(t *testing.T) {
+	ctx := context.Background()
+	clients := Clients{KMS: mockedKMSClient{Key: []byte(strings.Repeat("k", 32))}}
+
+	dir, err := ioutil.TempDir("", "flecs-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "flecs.secrets.yaml")
+
+	file, err := loadSecretsFile(path)
+	assert.Nil(t, err)
+
+	// A new file needs a KMS key
+	assert.NotNil(t, file.unlock(ctx, clients, ""))
+	assert.Nil(t, file.unlock(ctx, clients, "alias/flecs"))
+
+	assert.Nil(t, file.Set("DB_PASSWORD", "hunter2"))
+	assert.Nil(t, file.Save())
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "DB_PASSWORD")
+	assert.NotContains(t, string(data), "hunter2")
+
+	file, err = loadSecretsFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "alias/flecs", file.KMSKeyID)
+
+	_, err = file.Get("DB_PASSWORD")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, file.unlock(ctx, clients, ""))
+
+	value, err := file.Get("DB_PASSWORD")
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	// Values can't be moved to another secret
+	file.Secrets["API_KEY"] = file.Secrets["DB_PASSWORD"]
+	_, err = file.Values()
+	assert.NotNil(t, err)
+}
+
+func TestSyncSecrets(t *testing.T) {
+	ctx := context.Background()
+	store := memorySecretStore{"DB_PASSWORD": "old", "OLD_TOKEN": "token"}
+	local := map[string]string{"DB_PASSWORD": "new", "API_KEY": "key"}
+
+	assert.Equal(t, []secretChange{
+		{Name: "API_KEY", Action: "add"},
+		{Name: "DB_PASSWORD", Action: "update"},
+		{Name: "OLD_TOKEN", Action: "remove"},
+	}, diffSecrets(local, store))
+
+	changes, err := syncSecrets(ctx, store, local, false)
+	assert.Nil(t, err)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, memorySecretStore{"DB_PASSWORD": "new", "API_KEY": "key", "OLD_TOKEN": "token"}, store)
+
+	changes, err = syncSecrets(ctx, store, local, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []secretChange{{Name: "OLD_TOKEN", Action: "remove"}}, changes)
+	assert.Equal(t, memorySecretStore{"DB_PASSWORD": "new", "API_KEY": "key"}, store)
+}
+
+func TestSSMStoreList(t *testing.T) {
+	clients := Clients{SSM: mockedSSMClient{Parameters: map[string]string{
+		"/flecs/shop/production/DB_PASSWORD":    "hunter2",
+		"/flecs/shop/production/stripe/API_KEY": "key",
+		"/flecs/shop/staging/DB_PASSWORD":       "password",
+	}}}
+
+	values, err := ssmStore{clients: clients, prefix: "/flecs/shop/production/"}.List(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"DB_PASSWORD": "hunter2", "stripe/API_KEY": "key"}, values)
+}
+
+func TestResolveSecrets(t *testing.T) {
+	cfg := Config{
+		ProjectName:     "shop",
+		EnvironmentName: "production",
+		Options: ConfigOptions{
+			Region:  "eu-west-1",
+			Secrets: map[string]string{"DB_PASSWORD": "", "TOKEN": "/shared/token"},
+		},
+	}
+
+	assert.Equal(t, "/flecs/shop/production/", cfg.secretsPrefix())
+	assert.Equal(t, "flecs.production.secrets.yaml", cfg.secretsFile())
+	assert.Equal(t, map[string]string{
+		"DB_PASSWORD": "arn:aws:ssm:eu-west-1:123456789012:parameter/flecs/shop/production/DB_PASSWORD",
+		"TOKEN":       "/shared/token",
+	}, cfg.resolveSecrets("123456789012"))
+
+	cfg.Options.SecretsStore = secretsStoreSecretsManager
+	assert.Equal(t, "arn:aws:secretsmanager:eu-west-1:123456789012:secret:/flecs/shop/production/DB_PASSWORD", cfg.resolveSecrets("123456789012")["DB_PASSWORD"])
+
+	// Task definitions get the full ARN, with the suffix Secrets Manager adds
+	clients := Clients{SecretsManager: mockedSecretsManagerClient{ARNs: map[string]string{
+		"/flecs/shop/production/DB_PASSWORD": "arn:aws:secretsmanager:eu-west-1:123456789012:secret:/flecs/shop/production/DB_PASSWORD-AbCdEf",
+	}}}
+
+	secrets, err := cfg.resolveSecretARNs(context.Background(), clients, "123456789012")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"DB_PASSWORD": "arn:aws:secretsmanager:eu-west-1:123456789012:secret:/flecs/shop/production/DB_PASSWORD-AbCdEf",
+		"TOKEN":       "/shared/token",
+	}, secrets)
+
+	cfg.Options.Secrets["API_KEY"] = ""
+	_, err = cfg.resolveSecretARNs(context.Background(), clients, "123456789012")
+	assert.NotNil(t, err)
+	delete(cfg.Options.Secrets, "API_KEY")
+
+	_, arns := cfg.secretARNs("123456789012")
+	assert.Equal(t, []string{"arn:aws:secretsmanager:eu-west-1:123456789012:secret:/flecs/shop/production/DB_PASSWORD-??????"}, arns)
+}
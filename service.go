@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 	"regexp"
 	"strings"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
@@ -23,17 +24,78 @@ type Service struct {
 	LaunchType   string `yaml:"launch_type"`
 	Name         string
 	LoadBalancer LoadBalancer `yaml:"load_balancer"`
+
+	// LoadBalancers are added to load_balancer, for services that sit
+	// behind more than one target group
+	LoadBalancers []LoadBalancer `yaml:"load_balancers"`
+
+	// DeploymentController is ECS for rolling updates, which is the
+	// default, or CODE_DEPLOY for blue/green deployments
+	DeploymentController string    `yaml:"deployment_controller"`
+	BlueGreen            BlueGreen `yaml:"blue_green"`
+
+	// DeploymentConfiguration tunes rolling updates
+	DeploymentConfiguration DeploymentConfiguration `yaml:"deployment_configuration"`
+
+	// HealthCheckGracePeriod is how many seconds to ignore failing load
+	// balancer health checks after a task starts
+	HealthCheckGracePeriod int64 `yaml:"health_check_grace_period"`
+
+	EnableECSManagedTags bool   `yaml:"enable_ecs_managed_tags"`
+	EnableExecuteCommand bool   `yaml:"enable_execute_command"`
+	PlatformVersion      string `yaml:"platform_version"`
+	PropagateTags        string `yaml:"propagate_tags"`
+
+	// SchedulingStrategy is REPLICA, the default, or DAEMON to run a task on
+	// every container instance. It can't be changed once the service exists
+	SchedulingStrategy string `yaml:"scheduling_strategy"`
+
+	Wait WaitOptions `yaml:",inline"`
 }
 
-// LoadBalancer configures a load balancer that has been created elsewhere
+// DeploymentConfiguration sets how many tasks run during a rolling update,
+// as a percentage of the desired count, and whether a circuit breaker stops
+// updates that fail
+type DeploymentConfiguration struct {
+	MaximumPercent int64 `yaml:"maximum_percent"`
+
+	// MinimumHealthyPercent is a pointer so that it can be set to 0
+	MinimumHealthyPercent *int64 `yaml:"minimum_healthy_percent"`
+
+	CircuitBreaker CircuitBreaker `yaml:"circuit_breaker"`
+}
+
+// CircuitBreaker stops a rolling update when tasks fail to start, and rolls
+// back to the last deployment that completed if rollback is set
+type CircuitBreaker struct {
+	Enable   bool `yaml:"enable"`
+	Rollback bool `yaml:"rollback"`
+}
+
+// maxLoadBalancers is how many target groups ECS allows on a service
+const maxLoadBalancers = 5
+
+// LoadBalancer configures a load balancer that has been created elsewhere.
+// The target group is given by its ARN, or by its name to look it up
 type LoadBalancer struct {
-	TargetGroupArn string `yaml:"target_group_arn"`
-	ContainerName  string `yaml:"container_name"`
-	ContainerPort  int64  `yaml:"container_port"`
+	TargetGroupArn  string `yaml:"target_group_arn"`
+	TargetGroupName string `yaml:"target_group_name"`
+	ContainerName   string `yaml:"container_name"`
+	ContainerPort   int64  `yaml:"container_port"`
 }
 
-// Run runs the service step
-func (s ServiceStep) Run(c Client, cfg Config) (serviceName string, err error) {
+// targetGroupName returns the name of the target group
+func (lb LoadBalancer) targetGroupName() string {
+	if lb.TargetGroupName != "" {
+		return lb.TargetGroupName
+	}
+
+	return targetGroupName(lb.TargetGroupArn)
+}
+
+// Run runs the service step. Wait options set on the step take precedence
+// over those set on the service
+func (s ServiceStep) Run(ctx context.Context, c Client, cfg Config, wait WaitOptions) (serviceName string, err error) {
 	// Set up ECS client
 	clients, err := c.InitClients()
 	if err != nil {
@@ -46,17 +108,19 @@ func (s ServiceStep) Run(c Client, cfg Config) (serviceName string, err error) {
 	}
 
 	service.Name = s.Service
+	wait = wait.merge(service.Wait)
 
 	// Check if the cluster exists
-	clusterExists, err := clients.ClusterExists(cfg)
+	clusterExists, err := clients.ClusterExists(ctx, cfg)
 	if err != nil {
 		return serviceName, err
 	}
 
-	// Create a default cluster if it doesn't
+	// Create a default cluster if it doesn't. Step and service wait options
+	// are for the deployment, so the cluster uses its own
 	if !clusterExists {
 		Log.Infof("Creating cluster %s", cfg.Options.ClusterName)
-		err = clients.CreateCluster(cfg, 5)
+		err = clients.CreateCluster(ctx, cfg, WaitOptions{})
 		if err != nil {
 			return serviceName, err
 		}
@@ -65,17 +129,32 @@ func (s ServiceStep) Run(c Client, cfg Config) (serviceName string, err error) {
 	// If the cluster exists, check if the service exists
 	if clusterExists {
 		serviceNamePrefix := service.serviceNamePrefix(cfg)
-		serviceName, err = service.checkServicePrefixExists(clients, cfg, serviceNamePrefix)
+		serviceName, err = service.checkServicePrefixExists(ctx, clients, cfg, serviceNamePrefix)
+		if err != nil {
+			return serviceName, err
+		}
+	}
+
+	// The deployment controller of a running service can't be changed, so
+	// switching to or from CodeDeploy means re-creating the service
+	controllerChanged := false
+	if serviceName != "" {
+		controllerChanged, err = service.checkDeploymentController(ctx, clients, cfg, serviceName)
 		if err != nil {
 			return serviceName, err
 		}
 	}
 
+	// Blue/green deployments already replace every task without downtime
+	if serviceName != "" && cfg.RecreateServices && service.blueGreen() && !controllerChanged {
+		Log.Infof("Deploying service %s with CodeDeploy instead of re-creating it", serviceName)
+	}
+
 	// If the service exists, and we want to recreate, then we have to create
 	// a new service, then delete the old service
-	if serviceName != "" && cfg.RecreateServices {
+	if serviceName != "" && cfg.RecreateServices && (!service.blueGreen() || controllerChanged) {
 		Log.Infof("Re-creating service %s", serviceName)
-		newServiceName, err := service.Create(clients, cfg)
+		newServiceName, err := service.Create(ctx, clients, cfg, wait)
 		if err != nil {
 			return newServiceName, err
 		}
@@ -84,7 +163,7 @@ func (s ServiceStep) Run(c Client, cfg Config) (serviceName string, err error) {
 
 		oldServiceName := serviceName
 		Log.Infof("Deleting old service %s", oldServiceName)
-		err = service.Delete(clients, cfg, oldServiceName)
+		err = service.Delete(ctx, clients, cfg, oldServiceName, wait)
 		if err != nil {
 			return newServiceName, err
 		}
@@ -96,7 +175,12 @@ func (s ServiceStep) Run(c Client, cfg Config) (serviceName string, err error) {
 	// Update the service if it already exists
 	if serviceName != "" {
 		Log.Infof("Updating service %s", serviceName)
-		serviceName, err = service.Update(clients, cfg, serviceName)
+		runTask := func(ctx context.Context, task string) error {
+			_, err := TaskStep{Task: task}.Run(ctx, c, cfg, WaitOptions{})
+			return err
+		}
+
+		serviceName, err = service.Update(ctx, clients, cfg, serviceName, wait, runTask)
 		if err != nil {
 			return serviceName, err
 		}
@@ -107,7 +191,7 @@ func (s ServiceStep) Run(c Client, cfg Config) (serviceName string, err error) {
 
 	// Otherwise create the service
 	Log.Infof("Creating service %s", serviceName)
-	serviceName, err = service.Create(clients, cfg)
+	serviceName, err = service.Create(ctx, clients, cfg, wait)
 	if err != nil {
 		return serviceName, err
 	}
@@ -117,9 +201,10 @@ func (s ServiceStep) Run(c Client, cfg Config) (serviceName string, err error) {
 	return serviceName, err
 }
 
-// Update updates a running service
-func (s Service) Update(c Clients, cfg Config, service string) (serviceName string, err error) {
-	networkConfiguration, err := c.NetworkConfiguration(cfg)
+// Update updates a running service. Services using CodeDeploy are updated
+// with a blue/green deployment, which runs any hook tasks with runTask
+func (s Service) Update(ctx context.Context, c Clients, cfg Config, service string, wait WaitOptions, runTask taskRunner) (serviceName string, err error) {
+	networkConfiguration, err := c.NetworkConfiguration(ctx, cfg)
 	if err != nil {
 		return serviceName, err
 	}
@@ -132,24 +217,29 @@ func (s Service) Update(c Clients, cfg Config, service string) (serviceName stri
 
 	serviceNamePrefix := s.serviceNamePrefix(cfg)
 
-	taskDefinitionArn, err := definition.Create(c, cfg, serviceNamePrefix)
+	taskDefinitionArn, err := definition.Create(ctx, c, cfg, serviceNamePrefix)
 	if err != nil {
 		return serviceName, err
 	}
 	Log.Infof("Registered task definition %s", taskDefinitionArn)
 
-	input := ecs.UpdateServiceInput{
-		Cluster:              aws.String(cfg.Options.ClusterName),
-		NetworkConfiguration: &networkConfiguration,
-		Service:              aws.String(service),
-		TaskDefinition:       aws.String(taskDefinitionArn),
+	loadBalancers, err := s.ecsLoadBalancers(ctx, c)
+	if err != nil {
+		return serviceName, err
 	}
 
-	resp, err := c.ECS.UpdateService(&input)
+	input := s.updateServiceInput(cfg, service, taskDefinitionArn, networkConfiguration, loadBalancers)
+
+	resp, err := c.ECS.UpdateServiceWithContext(ctx, &input)
 	if err != nil {
 		return serviceName, err
 	}
 
+	if s.blueGreen() {
+		err = s.deployBlueGreen(ctx, c, cfg, service, taskDefinitionArn, networkConfiguration, wait, runTask)
+		return service, err
+	}
+
 	serviceName = aws.StringValue(resp.Service.ServiceName)
 
 	waitUntilInput := ecs.DescribeServicesInput{
@@ -157,7 +247,7 @@ func (s Service) Update(c Clients, cfg Config, service string) (serviceName stri
 		Services: aws.StringSlice([]string{serviceName}),
 	}
 
-	err = c.ECS.WaitUntilServicesStable(&waitUntilInput)
+	err = c.ECS.WaitUntilServicesStableWithContext(ctx, &waitUntilInput, wait.merge(servicesStableWait).waiterOptions()...)
 	if err != nil {
 		return serviceName, err
 	}
@@ -167,14 +257,14 @@ func (s Service) Update(c Clients, cfg Config, service string) (serviceName stri
 
 // Create creates a service if it doesn't exist, and returns the name of the
 // service
-func (s Service) Create(c Clients, cfg Config) (serviceName string, err error) {
+func (s Service) Create(ctx context.Context, c Clients, cfg Config, wait WaitOptions) (serviceName string, err error) {
 	clientECS := c.ECS
 
 	// serviceNamePrefix ensures that services have unique IDs, which will
 	// eventually be used when we have to safely recreate a service
 	serviceNamePrefix := s.serviceNamePrefix(cfg)
 
-	networkConfiguration, err := c.NetworkConfiguration(cfg)
+	networkConfiguration, err := c.NetworkConfiguration(ctx, cfg)
 	if err != nil {
 		return serviceName, err
 	}
@@ -185,7 +275,7 @@ func (s Service) Create(c Clients, cfg Config) (serviceName string, err error) {
 		return serviceName, fmt.Errorf("cannot find task definition called %s", s.Definition)
 	}
 
-	taskDefinitionArn, err := definition.Create(c, cfg, serviceNamePrefix)
+	taskDefinitionArn, err := definition.Create(ctx, c, cfg, serviceNamePrefix)
 	if err != nil {
 		return serviceName, err
 	}
@@ -195,28 +285,14 @@ func (s Service) Create(c Clients, cfg Config) (serviceName string, err error) {
 	serviceName = strings.Join([]string{serviceNamePrefix, uniuri.NewLen(8)}, "-")
 
 	// Create service
-	createServiceInput := ecs.CreateServiceInput{
-		Cluster:              aws.String(cfg.Options.ClusterName),
-		DesiredCount:         aws.Int64(1),
-		LaunchType:           aws.String(s.LaunchType),
-		NetworkConfiguration: &networkConfiguration,
-		ServiceName:          aws.String(serviceName),
-		TaskDefinition:       aws.String(taskDefinitionArn),
+	loadBalancers, err := s.ecsLoadBalancers(ctx, c)
+	if err != nil {
+		return serviceName, err
 	}
 
-	if s.LoadBalancer != (LoadBalancer{}) {
-		loadBalancers := []*ecs.LoadBalancer{
-			&ecs.LoadBalancer{
-				ContainerName:  aws.String(s.LoadBalancer.ContainerName),
-				ContainerPort:  aws.Int64(s.LoadBalancer.ContainerPort),
-				TargetGroupArn: aws.String(s.LoadBalancer.TargetGroupArn),
-			},
-		}
+	createServiceInput := s.createServiceInput(cfg, serviceName, taskDefinitionArn, networkConfiguration, loadBalancers)
 
-		createServiceInput.SetLoadBalancers(loadBalancers)
-	}
-
-	output, err := clientECS.CreateService(&createServiceInput)
+	output, err := clientECS.CreateServiceWithContext(ctx, &createServiceInput)
 	if err != nil {
 		return serviceName, err
 	}
@@ -224,65 +300,447 @@ func (s Service) Create(c Clients, cfg Config) (serviceName string, err error) {
 	Log.Infof("Waiting for service to be ready: %s", aws.StringValue(output.Service.ServiceArn))
 
 	// Wait for service to become stable
-	err = clientECS.WaitUntilServicesStable(&ecs.DescribeServicesInput{
+	err = clientECS.WaitUntilServicesStableWithContext(ctx, &ecs.DescribeServicesInput{
 		Cluster:  aws.String(cfg.Options.ClusterName),
 		Services: aws.StringSlice([]string{aws.StringValue(output.Service.ServiceName)}),
-	})
+	}, wait.merge(servicesStableWait).waiterOptions()...)
 	if err != nil {
 		return serviceName, err
 	}
 
+	// The deployment group can only be created once the service exists
+	if s.blueGreen() {
+		err = s.createDeploymentGroup(ctx, c, cfg, serviceName)
+		if err != nil {
+			return serviceName, err
+		}
+	}
+
 	return serviceName, err
 }
 
+// createServiceInput returns the settings for a new service
+func (s Service) createServiceInput(cfg Config, serviceName, taskDefinitionArn string, networkConfiguration ecs.NetworkConfiguration, loadBalancers []*ecs.LoadBalancer) ecs.CreateServiceInput {
+	input := ecs.CreateServiceInput{
+		Cluster:                 aws.String(cfg.Options.ClusterName),
+		DeploymentConfiguration: s.DeploymentConfiguration.ecsDeploymentConfiguration(),
+		EnableECSManagedTags:    aws.Bool(s.EnableECSManagedTags),
+		EnableExecuteCommand:    aws.Bool(s.EnableExecuteCommand),
+		LaunchType:              aws.String(s.LaunchType),
+		NetworkConfiguration:    &networkConfiguration,
+		ServiceName:             aws.String(serviceName),
+		TaskDefinition:          aws.String(taskDefinitionArn),
+	}
+
+	// Daemon services run a task on every instance instead
+	if s.SchedulingStrategy != ecs.SchedulingStrategyDaemon {
+		input.SetDesiredCount(1)
+	}
+
+	if len(loadBalancers) > 0 {
+		input.SetLoadBalancers(loadBalancers)
+	}
+
+	if s.DeploymentController != "" {
+		input.SetDeploymentController(&ecs.DeploymentController{Type: aws.String(s.DeploymentController)})
+	}
+
+	if s.HealthCheckGracePeriod != 0 {
+		input.SetHealthCheckGracePeriodSeconds(s.HealthCheckGracePeriod)
+	}
+
+	if s.PlatformVersion != "" {
+		input.SetPlatformVersion(s.PlatformVersion)
+	}
+
+	if s.PropagateTags != "" {
+		input.SetPropagateTags(s.PropagateTags)
+	}
+
+	if s.SchedulingStrategy != "" {
+		input.SetSchedulingStrategy(s.SchedulingStrategy)
+	}
+
+	return input
+}
+
+// updateServiceInput returns the changes to make to a running service.
+// Services using CodeDeploy can only change settings that don't need a new
+// deployment, as the deployment sets the task definition, network
+// configuration, platform version and load balancer
+func (s Service) updateServiceInput(cfg Config, service, taskDefinitionArn string, networkConfiguration ecs.NetworkConfiguration, loadBalancers []*ecs.LoadBalancer) ecs.UpdateServiceInput {
+	input := ecs.UpdateServiceInput{
+		Cluster:                 aws.String(cfg.Options.ClusterName),
+		DeploymentConfiguration: s.updateDeploymentConfiguration(),
+		EnableECSManagedTags:    aws.Bool(s.EnableECSManagedTags),
+		Service:                 aws.String(service),
+	}
+
+	// ECS only accepts a grace period for services with a load balancer.
+	// Sending zero when it isn't configured removes one set before
+	if len(s.loadBalancers()) > 0 {
+		input.SetHealthCheckGracePeriodSeconds(s.HealthCheckGracePeriod)
+	}
+
+	if s.PropagateTags != "" {
+		input.SetPropagateTags(s.PropagateTags)
+	}
+
+	if s.blueGreen() {
+		return input
+	}
+
+	input.SetEnableExecuteCommand(s.EnableExecuteCommand)
+	input.SetNetworkConfiguration(&networkConfiguration)
+	input.SetTaskDefinition(taskDefinitionArn)
+
+	// An empty list removes load balancers that are no longer configured
+	if loadBalancers == nil {
+		loadBalancers = []*ecs.LoadBalancer{}
+	}
+	input.SetLoadBalancers(loadBalancers)
+
+	if s.PlatformVersion != "" {
+		input.SetPlatformVersion(s.PlatformVersion)
+	}
+
+	return input
+}
+
+// ecsDeploymentConfiguration returns the deployment configuration for ECS,
+// or nil to leave it unchanged
+func (d DeploymentConfiguration) ecsDeploymentConfiguration() *ecs.DeploymentConfiguration {
+	if d.MaximumPercent == 0 && d.MinimumHealthyPercent == nil && d.CircuitBreaker == (CircuitBreaker{}) {
+		return nil
+	}
+
+	var config ecs.DeploymentConfiguration
+
+	if d.MaximumPercent != 0 {
+		config.SetMaximumPercent(d.MaximumPercent)
+	}
+
+	if d.MinimumHealthyPercent != nil {
+		config.SetMinimumHealthyPercent(*d.MinimumHealthyPercent)
+	}
+
+	if d.CircuitBreaker != (CircuitBreaker{}) {
+		config.SetDeploymentCircuitBreaker(&ecs.DeploymentCircuitBreaker{
+			Enable:   aws.Bool(d.CircuitBreaker.Enable),
+			Rollback: aws.Bool(d.CircuitBreaker.Rollback),
+		})
+	}
+
+	return &config
+}
+
+// updateDeploymentConfiguration returns the deployment configuration for a
+// running service. Leaving a setting out of an update leaves it unchanged,
+// so anything that isn't configured is set back to the ECS default
+func (s Service) updateDeploymentConfiguration() *ecs.DeploymentConfiguration {
+	maximum, minimum := int64(200), int64(100)
+	if s.SchedulingStrategy == ecs.SchedulingStrategyDaemon {
+		maximum, minimum = 100, 0
+	}
+
+	d := s.DeploymentConfiguration
+	if d.MaximumPercent != 0 {
+		maximum = d.MaximumPercent
+	}
+
+	if d.MinimumHealthyPercent != nil {
+		minimum = *d.MinimumHealthyPercent
+	}
+
+	config := &ecs.DeploymentConfiguration{
+		MaximumPercent:        aws.Int64(maximum),
+		MinimumHealthyPercent: aws.Int64(minimum),
+	}
+
+	// CodeDeploy rolls back itself, and doesn't allow a circuit breaker
+	if !s.blueGreen() {
+		config.SetDeploymentCircuitBreaker(&ecs.DeploymentCircuitBreaker{
+			Enable:   aws.Bool(d.CircuitBreaker.Enable),
+			Rollback: aws.Bool(d.CircuitBreaker.Rollback),
+		})
+	}
+
+	return config
+}
+
+// validate checks the deployment configuration
+func (d DeploymentConfiguration) validate() (err error) {
+	if d.MaximumPercent < 0 || (d.MinimumHealthyPercent != nil && *d.MinimumHealthyPercent < 0) {
+		return fmt.Errorf("maximum_percent and minimum_healthy_percent cannot be negative")
+	}
+
+	if d.MaximumPercent != 0 && d.MinimumHealthyPercent != nil && d.MaximumPercent < *d.MinimumHealthyPercent {
+		return fmt.Errorf("maximum_percent must be at least minimum_healthy_percent")
+	}
+
+	if d.CircuitBreaker.Rollback && !d.CircuitBreaker.Enable {
+		return fmt.Errorf("must enable the circuit_breaker to use rollback")
+	}
+
+	return err
+}
+
+// validate checks the service configuration
+func (s Service) validate(cfg Config) (err error) {
+	controllers := []string{ecs.DeploymentControllerTypeEcs, ecs.DeploymentControllerTypeCodeDeploy}
+	if s.DeploymentController != "" && !stringInSlice(s.DeploymentController, controllers) {
+		return fmt.Errorf("service %s: invalid deployment_controller %s, must be one of %s", s.Name, s.DeploymentController, strings.Join(controllers, ", "))
+	}
+
+	err = s.DeploymentConfiguration.validate()
+	if err != nil {
+		return fmt.Errorf("service %s: deployment_configuration: %s", s.Name, err)
+	}
+
+	if s.PropagateTags != "" && !stringInSlice(s.PropagateTags, ecs.PropagateTags_Values()) {
+		return fmt.Errorf("service %s: invalid propagate_tags %s, must be one of %s", s.Name, s.PropagateTags, strings.Join(ecs.PropagateTags_Values(), ", "))
+	}
+
+	if s.SchedulingStrategy != "" && !stringInSlice(s.SchedulingStrategy, ecs.SchedulingStrategy_Values()) {
+		return fmt.Errorf("service %s: invalid scheduling_strategy %s, must be one of %s", s.Name, s.SchedulingStrategy, strings.Join(ecs.SchedulingStrategy_Values(), ", "))
+	}
+
+	if s.SchedulingStrategy == ecs.SchedulingStrategyDaemon && (s.LaunchType == ecs.LaunchTypeFargate || s.blueGreen()) {
+		return fmt.Errorf("service %s: the %s scheduling_strategy cannot be used with Fargate or %s", s.Name, ecs.SchedulingStrategyDaemon, ecs.DeploymentControllerTypeCodeDeploy)
+	}
+
+	if s.PlatformVersion != "" && s.LaunchType != ecs.LaunchTypeFargate {
+		return fmt.Errorf("service %s: platform_version can only be used with the %s launch type", s.Name, ecs.LaunchTypeFargate)
+	}
+
+	err = s.validateLoadBalancers(cfg)
+	if err != nil {
+		return fmt.Errorf("service %s: %s", s.Name, err)
+	}
+
+	if definition, ok := cfg.Definitions[s.Definition]; ok && s.EnableExecuteCommand && !definition.IAM.enabled() && definition.TaskRoleName == "" {
+		return fmt.Errorf("service %s: enable_execute_command needs definition %s to have a task role, set with iam or task_role_name", s.Name, s.Definition)
+	}
+
+	if s.HealthCheckGracePeriod != 0 && len(s.loadBalancers()) == 0 {
+		return fmt.Errorf("service %s: health_check_grace_period can only be used with a load_balancer", s.Name)
+	}
+
+	if !s.blueGreen() {
+		if !reflect.DeepEqual(s.BlueGreen, BlueGreen{}) {
+			return fmt.Errorf("service %s: blue_green can only be used with the %s deployment controller", s.Name, ecs.DeploymentControllerTypeCodeDeploy)
+		}
+
+		return err
+	}
+
+	if s.DeploymentConfiguration.CircuitBreaker.Enable {
+		return fmt.Errorf("service %s: circuit_breaker cannot be used with %s, which rolls back with CodeDeploy instead", s.Name, ecs.DeploymentControllerTypeCodeDeploy)
+	}
+
+	if len(s.loadBalancers()) != 1 {
+		return fmt.Errorf("service %s: must configure exactly one load balancer to use %s", s.Name, ecs.DeploymentControllerTypeCodeDeploy)
+	}
+
+	err = s.BlueGreen.validate(cfg)
+	if err != nil {
+		return fmt.Errorf("service %s: blue_green: %s", s.Name, err)
+	}
+
+	return err
+}
+
+// loadBalancers returns the load balancers in load_balancer and
+// load_balancers
+func (s Service) loadBalancers() (loadBalancers []LoadBalancer) {
+	if s.LoadBalancer != (LoadBalancer{}) {
+		loadBalancers = append(loadBalancers, s.LoadBalancer)
+	}
+
+	return append(loadBalancers, s.LoadBalancers...)
+}
+
+// validateLoadBalancers checks that each load balancer has one target group,
+// and sends traffic to a port that its container maps
+func (s Service) validateLoadBalancers(cfg Config) (err error) {
+	loadBalancers := s.loadBalancers()
+	if len(loadBalancers) > maxLoadBalancers {
+		return fmt.Errorf("cannot have more than %d load balancers", maxLoadBalancers)
+	}
+
+	definition, ok := cfg.Definitions[s.Definition]
+
+	for _, lb := range loadBalancers {
+		if (lb.TargetGroupArn == "") == (lb.TargetGroupName == "") {
+			return fmt.Errorf("load balancers must specify one of target_group_arn or target_group_name")
+		}
+
+		if lb.ContainerName == "" || lb.ContainerPort == 0 {
+			return fmt.Errorf("load balancer %s must specify container_name and container_port", lb.targetGroupName())
+		}
+
+		if ok && !definition.hasPortMapping(lb.ContainerName, lb.ContainerPort) {
+			return fmt.Errorf("container %s in definition %s does not map port %d for load balancer %s", lb.ContainerName, s.Definition, lb.ContainerPort, lb.targetGroupName())
+		}
+	}
+
+	return err
+}
+
+// ecsLoadBalancers returns the load balancers for the service, looking up
+// the ARNs of target groups given by name
+func (s Service) ecsLoadBalancers(ctx context.Context, c Clients) (loadBalancers []*ecs.LoadBalancer, err error) {
+	var names []string
+	for _, lb := range s.loadBalancers() {
+		if lb.TargetGroupName != "" && !stringInSlice(lb.TargetGroupName, names) {
+			names = append(names, lb.TargetGroupName)
+		}
+	}
+
+	var arns map[string]string
+	if len(names) > 0 {
+		arns, err = c.GetTargetGroupARNs(ctx, names)
+		if err != nil {
+			return loadBalancers, err
+		}
+	}
+
+	for _, lb := range s.loadBalancers() {
+		targetGroupArn := lb.TargetGroupArn
+		if lb.TargetGroupName != "" {
+			targetGroupArn = arns[lb.TargetGroupName]
+		}
+
+		loadBalancers = append(loadBalancers, &ecs.LoadBalancer{
+			ContainerName:  aws.String(lb.ContainerName),
+			ContainerPort:  aws.Int64(lb.ContainerPort),
+			TargetGroupArn: aws.String(targetGroupArn),
+		})
+	}
+
+	return loadBalancers, err
+}
+
+// blueGreen returns true if the service is deployed with CodeDeploy
+func (s Service) blueGreen() bool {
+	return s.DeploymentController == ecs.DeploymentControllerTypeCodeDeploy
+}
+
 // Delete deletes a service (but not created log groups, clusters or roles)
-func (s Service) Delete(c Clients, cfg Config, service string) (err error) {
+func (s Service) Delete(ctx context.Context, c Clients, cfg Config, service string, wait WaitOptions) (err error) {
 	clientECS := c.ECS
 
+	// The deployment group of a service using CodeDeploy goes with it. This
+	// depends on the running service rather than the configuration, since
+	// the service may be being re-created with another deployment controller
+	controller, err := runningDeploymentController(ctx, c, cfg, service)
+	if err != nil {
+		return err
+	}
+
 	deleteServiceInput := ecs.DeleteServiceInput{
 		Cluster: aws.String(cfg.Options.ClusterName),
 		Force:   aws.Bool(true),
 		Service: aws.String(service),
 	}
 
-	_, err = clientECS.DeleteService(&deleteServiceInput)
+	_, err = clientECS.DeleteServiceWithContext(ctx, &deleteServiceInput)
 	if err != nil {
 		return err
 	}
 
-	for count := 0; count < 30; count++ {
-		serviceExists, err := s.checkServiceExists(c, cfg, service)
-		if err != nil {
-			return err
-		}
-
-		if serviceExists {
-			break
+	err = wait.merge(serviceDeleteWait).poll(ctx, func() (bool, error) {
+		serviceExists, err := s.checkServiceExists(ctx, c, cfg, service)
+		if err != nil || !serviceExists {
+			return true, err
 		}
 
 		Log.Infof("Waiting for service %s to terminate", service)
-		time.Sleep(10 * time.Second)
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if controller == ecs.DeploymentControllerTypeCodeDeploy {
+		err = s.deleteDeploymentGroup(ctx, c, cfg)
 	}
 
 	return err
 }
 
-func (s Service) checkServiceExists(c Clients, cfg Config, service string) (result bool, err error) {
+// checkServiceExists returns true if the service exists and has not yet
+// become inactive
+func (s Service) checkServiceExists(ctx context.Context, c Clients, cfg Config, service string) (result bool, err error) {
 	input := ecs.DescribeServicesInput{
 		Cluster:  aws.String(cfg.Options.ClusterName),
 		Services: []*string{aws.String(service)},
 	}
 
-	resp, err := c.ECS.DescribeServices(&input)
+	resp, err := c.ECS.DescribeServicesWithContext(ctx, &input)
 	if err != nil {
 		return result, err
 	}
 
-	result = len(resp.Services) > 0
+	for _, svc := range resp.Services {
+		if aws.StringValue(svc.Status) != "INACTIVE" {
+			result = true
+		}
+	}
+
 	return result, err
 }
 
-func (s Service) checkServicePrefixExists(c Clients, cfg Config, serviceNamePrefix string) (serviceName string, err error) {
+// checkDeploymentController returns true if the running service uses a
+// different deployment controller to the one configured. This is an error
+// unless services are being re-created, since ECS can't change it
+func (s Service) checkDeploymentController(ctx context.Context, c Clients, cfg Config, service string) (changed bool, err error) {
+	current, err := runningDeploymentController(ctx, c, cfg, service)
+	if err != nil {
+		return changed, err
+	}
+
+	wanted := s.DeploymentController
+	if wanted == "" {
+		wanted = ecs.DeploymentControllerTypeEcs
+	}
+
+	if current == wanted {
+		return changed, err
+	}
+
+	if !cfg.RecreateServices {
+		return true, fmt.Errorf("service %s uses the %s deployment controller, which cannot be changed to %s on a running service: deploy with --recreate-services to replace it", service, current, wanted)
+	}
+
+	Log.Infof("Service %s uses the %s deployment controller, re-creating it to use %s", service, current, wanted)
+	return true, err
+}
+
+// runningDeploymentController returns the deployment controller that a
+// running service uses
+func runningDeploymentController(ctx context.Context, c Clients, cfg Config, service string) (controller string, err error) {
+	resp, err := c.ECS.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{
+		Cluster:  aws.String(cfg.Options.ClusterName),
+		Services: aws.StringSlice([]string{service}),
+	})
+	if err != nil {
+		return controller, err
+	}
+
+	if len(resp.Services) < 1 {
+		return controller, fmt.Errorf("cannot find service %s", service)
+	}
+
+	controller = ecs.DeploymentControllerTypeEcs
+	if resp.Services[0].DeploymentController != nil {
+		controller = aws.StringValue(resp.Services[0].DeploymentController.Type)
+	}
+
+	return controller, err
+}
+
+func (s Service) checkServicePrefixExists(ctx context.Context, c Clients, cfg Config, serviceNamePrefix string) (serviceName string, err error) {
 	client := c.ECS
 
 	// Check if service already exists, if so, return early with the name
@@ -291,7 +749,7 @@ func (s Service) checkServicePrefixExists(c Clients, cfg Config, serviceNamePref
 		LaunchType: aws.String(s.LaunchType),
 		MaxResults: aws.Int64(100),
 	}
-	listServiceOutput, err := client.ListServices(&listServiceInput)
+	listServiceOutput, err := client.ListServicesWithContext(ctx, &listServiceInput)
 	if err != nil {
 		return serviceName, err
 	}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceInputs(t *testing.T) {
+	cfg := Config{Options: ConfigOptions{ClusterName: "flecs"}}
+	network := ecs.NetworkConfiguration{AwsvpcConfiguration: &ecs.AwsVpcConfiguration{Subnets: aws.StringSlice([]string{"subnet-1"})}}
+
+	service := Service{
+		Name:       "web",
+		LaunchType: "FARGATE",
+		DeploymentConfiguration: DeploymentConfiguration{
+			MaximumPercent:        150,
+			MinimumHealthyPercent: aws.Int64(0),
+			CircuitBreaker:        CircuitBreaker{Enable: true, Rollback: true},
+		},
+		EnableExecuteCommand: true,
+		PlatformVersion:      "1.4.0",
+		PropagateTags:        "SERVICE",
+	}
+
+	deploymentConfiguration := &ecs.DeploymentConfiguration{
+		MaximumPercent:           aws.Int64(150),
+		MinimumHealthyPercent:    aws.Int64(0),
+		DeploymentCircuitBreaker: &ecs.DeploymentCircuitBreaker{Enable: aws.Bool(true), Rollback: aws.Bool(true)},
+	}
+
+	assert.Equal(t, ecs.CreateServiceInput{
+		Cluster:                 aws.String("flecs"),
+		DeploymentConfiguration: deploymentConfiguration,
+		DesiredCount:            aws.Int64(1),
+		EnableECSManagedTags:    aws.Bool(false),
+		EnableExecuteCommand:    aws.Bool(true),
+		LaunchType:              aws.String("FARGATE"),
+		NetworkConfiguration:    &network,
+		PlatformVersion:         aws.String("1.4.0"),
+		PropagateTags:           aws.String("SERVICE"),
+		ServiceName:             aws.String("flecs-shop-web-abcd1234"),
+		TaskDefinition:          aws.String("arn:task-definition"),
+	}, service.createServiceInput(cfg, "flecs-shop-web-abcd1234", "arn:task-definition", network, nil))
+
+	// Settings are applied to running services too
+	assert.Equal(t, ecs.UpdateServiceInput{
+		Cluster:                 aws.String("flecs"),
+		DeploymentConfiguration: deploymentConfiguration,
+		EnableECSManagedTags:    aws.Bool(false),
+		EnableExecuteCommand:    aws.Bool(true),
+		LoadBalancers:           []*ecs.LoadBalancer{},
+		NetworkConfiguration:    &network,
+		PlatformVersion:         aws.String("1.4.0"),
+		PropagateTags:           aws.String("SERVICE"),
+		Service:                 aws.String("flecs-shop-web-abcd1234"),
+		TaskDefinition:          aws.String("arn:task-definition"),
+	}, service.updateServiceInput(cfg, "flecs-shop-web-abcd1234", "arn:task-definition", network, nil))
+
+	// CodeDeploy sets the task definition, network and platform version
+	service = blueGreenService
+	service.HealthCheckGracePeriod = 30
+	service.EnableECSManagedTags = true
+
+	assert.Equal(t, ecs.UpdateServiceInput{
+		Cluster:                       aws.String("flecs"),
+		DeploymentConfiguration:       &ecs.DeploymentConfiguration{MaximumPercent: aws.Int64(200), MinimumHealthyPercent: aws.Int64(100)},
+		EnableECSManagedTags:          aws.Bool(true),
+		HealthCheckGracePeriodSeconds: aws.Int64(30),
+		Service:                       aws.String("flecs-shop-web-abcd1234"),
+	}, service.updateServiceInput(cfg, "flecs-shop-web-abcd1234", "arn:task-definition", network, nil))
+
+	// Settings that are removed go back to the ECS defaults
+	service.HealthCheckGracePeriod = 0
+	update := service.updateServiceInput(cfg, "flecs-shop-web-abcd1234", "arn:task-definition", network, nil)
+	assert.Equal(t, int64(0), aws.Int64Value(update.HealthCheckGracePeriodSeconds))
+
+	service = Service{Name: "web"}
+	assert.Equal(t, &ecs.DeploymentConfiguration{
+		MaximumPercent:           aws.Int64(200),
+		MinimumHealthyPercent:    aws.Int64(100),
+		DeploymentCircuitBreaker: &ecs.DeploymentCircuitBreaker{Enable: aws.Bool(false), Rollback: aws.Bool(false)},
+	}, service.updateServiceInput(cfg, "flecs-shop-web-abcd1234", "arn:task-definition", network, nil).DeploymentConfiguration)
+
+	// Daemon services don't have a desired count
+	service = Service{Name: "agent", LaunchType: "EC2", SchedulingStrategy: "DAEMON"}
+	input := service.createServiceInput(cfg, "flecs-shop-agent-abcd1234", "arn:task-definition", network, nil)
+	assert.Nil(t, input.DesiredCount)
+	assert.Nil(t, input.DeploymentConfiguration)
+	assert.Equal(t, "DAEMON", aws.StringValue(input.SchedulingStrategy))
+}
+
+func TestServiceValidate(t *testing.T) {
+	assert.Nil(t, Service{Name: "web", LaunchType: "FARGATE", PlatformVersion: "LATEST", PropagateTags: "TASK_DEFINITION"}.validate(Config{}))
+	assert.Nil(t, Service{Name: "agent", LaunchType: "EC2", SchedulingStrategy: "DAEMON"}.validate(Config{}))
+
+	assert.NotNil(t, Service{Name: "web", DeploymentConfiguration: DeploymentConfiguration{MaximumPercent: 50, MinimumHealthyPercent: aws.Int64(100)}}.validate(Config{}))
+	assert.NotNil(t, Service{Name: "web", DeploymentConfiguration: DeploymentConfiguration{CircuitBreaker: CircuitBreaker{Rollback: true}}}.validate(Config{}))
+	assert.NotNil(t, Service{Name: "web", PropagateTags: "CLUSTER"}.validate(Config{}))
+	assert.NotNil(t, Service{Name: "web", SchedulingStrategy: "SPREAD"}.validate(Config{}))
+	assert.NotNil(t, Service{Name: "agent", LaunchType: "FARGATE", SchedulingStrategy: "DAEMON"}.validate(Config{}))
+	assert.NotNil(t, Service{Name: "web", LaunchType: "EC2", PlatformVersion: "1.4.0"}.validate(Config{}))
+	assert.NotNil(t, Service{Name: "web", HealthCheckGracePeriod: 30}.validate(Config{}))
+
+	// Execute command needs a task role to allow the ssmmessages actions
+	exec := Service{Name: "web", Definition: "web", EnableExecuteCommand: true}
+	assert.NotNil(t, exec.validate(Config{Definitions: map[string]Definition{"web": {}}}))
+	assert.Nil(t, exec.validate(Config{Definitions: map[string]Definition{"web": {TaskRoleName: "web"}}}))
+
+	service := blueGreenService
+	service.DeploymentConfiguration.CircuitBreaker.Enable = true
+	assert.NotNil(t, service.validate(Config{Tasks: map[string]Task{"smoke-test": {}}}))
+}
+
+func TestServiceLoadBalancers(t *testing.T) {
+	cfg := Config{Definitions: map[string]Definition{"api": {Containers: []Container{
+		{Name: "api", PortMappings: []PortMapping{{ContainerPort: 8080}, {ContainerPort: 9090}}},
+	}}}}
+
+	service := Service{
+		Name:       "api",
+		Definition: "api",
+		LoadBalancer: LoadBalancer{
+			TargetGroupArn: "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/api-public/abc",
+			ContainerName:  "api",
+			ContainerPort:  8080,
+		},
+		LoadBalancers: []LoadBalancer{
+			{TargetGroupName: "api-internal", ContainerName: "api", ContainerPort: 9090},
+		},
+	}
+
+	assert.Nil(t, service.validate(cfg))
+
+	clients := Clients{ELBV2: mockedELBV2Client{TargetGroups: map[string]string{
+		"api-internal": "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/api-internal/def",
+	}}}
+
+	loadBalancers, err := service.ecsLoadBalancers(context.Background(), clients)
+	assert.Nil(t, err)
+	assert.Equal(t, []*ecs.LoadBalancer{
+		{ContainerName: aws.String("api"), ContainerPort: aws.Int64(8080), TargetGroupArn: aws.String("arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/api-public/abc")},
+		{ContainerName: aws.String("api"), ContainerPort: aws.Int64(9090), TargetGroupArn: aws.String("arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/api-internal/def")},
+	}, loadBalancers)
+
+	input := service.updateServiceInput(Config{}, "flecs-shop-api-abcd1234", "arn:task-definition", ecs.NetworkConfiguration{}, loadBalancers)
+	assert.Equal(t, loadBalancers, input.LoadBalancers)
+
+	// Target groups that don't exist are an error
+	service.LoadBalancers[0].TargetGroupName = "api-private"
+	_, err = service.ecsLoadBalancers(context.Background(), clients)
+	assert.EqualError(t, err, "cannot find target group api-private")
+
+	// With several target groups, the missing one is named
+	_, err = clients.GetTargetGroupARNs(context.Background(), []string{"api-internal", "api-private"})
+	assert.EqualError(t, err, "cannot find target group api-private")
+
+	// The container must map the port
+	service.LoadBalancers[0].ContainerPort = 80
+	assert.EqualError(t, service.validate(cfg), "service api: container api in definition api does not map port 80 for load balancer api-private")
+
+	service.LoadBalancers[0] = LoadBalancer{TargetGroupArn: "arn", TargetGroupName: "api-internal", ContainerName: "api", ContainerPort: 9090}
+	assert.NotNil(t, service.validate(cfg))
+
+	// CodeDeploy can only use one load balancer
+	service = blueGreenService
+	service.LoadBalancers = []LoadBalancer{{TargetGroupName: "web-internal", ContainerName: "web", ContainerPort: 8080}}
+	assert.EqualError(t, service.validate(Config{Tasks: map[string]Task{"smoke-test": {}}}), "service web: must configure exactly one load balancer to use CODE_DEPLOY")
+}
+
+func TestCheckDeploymentController(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Options: ConfigOptions{ClusterName: "flecs"}}
+	clients := Clients{ECS: mockedECSClient{DescribeServicesResp: ecs.DescribeServicesOutput{
+		Services: []*ecs.Service{{
+			ServiceName:          aws.String("flecs-shop-web-abcd1234"),
+			DeploymentController: &ecs.DeploymentController{Type: aws.String("ECS")},
+		}},
+	}}}
+
+	changed, err := Service{Name: "web"}.checkDeploymentController(ctx, clients, cfg, "flecs-shop-web-abcd1234")
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	// Switching to CodeDeploy needs the service to be re-created
+	changed, err = blueGreenService.checkDeploymentController(ctx, clients, cfg, "flecs-shop-web-abcd1234")
+	assert.EqualError(t, err, "service flecs-shop-web-abcd1234 uses the ECS deployment controller, which cannot be changed to CODE_DEPLOY on a running service: deploy with --recreate-services to replace it")
+	assert.True(t, changed)
+
+	cfg.RecreateServices = true
+	changed, err = blueGreenService.checkDeploymentController(ctx, clients, cfg, "flecs-shop-web-abcd1234")
+	assert.Nil(t, err)
+	assert.True(t, changed)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -23,10 +24,33 @@ type Task struct {
 	Definition string `yaml:"definition"`
 	LaunchType string `yaml:"launch_type"`
 	TaskName   string `yaml:"task_name"`
+
+	Wait WaitOptions `yaml:",inline"`
+
+	// StopOnInterrupt stops the running task if flecs is interrupted while
+	// waiting for it to finish
+	StopOnInterrupt bool `yaml:"stop_on_interrupt"`
+}
+
+// ContainerError is returned when a container in a task exits with a non-zero
+// exit code
+type ContainerError struct {
+	Container string
+	ExitCode  int64
+	Reason    string
+}
+
+func (e ContainerError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("container %s failed with exit code %d: %s", e.Container, e.ExitCode, e.Reason)
+	}
+
+	return fmt.Sprintf("container %s failed with exit code %d", e.Container, e.ExitCode)
 }
 
-// Run performs the task step
-func (t TaskStep) Run(c Client, cfg Config) (taskArn string, err error) {
+// Run performs the task step. Wait options set on the step take precedence
+// over those set on the task
+func (t TaskStep) Run(ctx context.Context, c Client, cfg Config, wait WaitOptions) (taskArn string, err error) {
 	// Set up clients
 	clients, err := c.InitClients()
 	if err != nil {
@@ -38,6 +62,8 @@ func (t TaskStep) Run(c Client, cfg Config) (taskArn string, err error) {
 		return taskArn, fmt.Errorf("cannot find task configured called %s", t.Task)
 	}
 
+	wait = wait.merge(task.Wait)
+
 	if task.TaskName == "" && task.Command == "" {
 		return taskArn, fmt.Errorf("must specify either one of command or task_name")
 	}
@@ -50,7 +76,7 @@ func (t TaskStep) Run(c Client, cfg Config) (taskArn string, err error) {
 		task.LaunchType = "FARGATE"
 	}
 
-	networkConfiguration, err := clients.NetworkConfiguration(cfg)
+	networkConfiguration, err := clients.NetworkConfiguration(ctx, cfg)
 	if err != nil {
 		return taskArn, err
 	}
@@ -73,7 +99,7 @@ func (t TaskStep) Run(c Client, cfg Config) (taskArn string, err error) {
 		taskName = fmt.Sprintf("%s-%s", taskName, name)
 	}
 
-	taskDefinitionArn, err := definition.Create(clients, cfg, taskName)
+	taskDefinitionArn, err := definition.Create(ctx, clients, cfg, taskName)
 	if err != nil {
 		return taskArn, err
 	}
@@ -92,7 +118,12 @@ func (t TaskStep) Run(c Client, cfg Config) (taskArn string, err error) {
 	}
 
 	if task.Command != "" {
-		command := strings.Split(task.Command, " ")
+		taskCommand, err := cfg.interpolate(task.Command)
+		if err != nil {
+			return taskArn, err
+		}
+
+		command := strings.Split(taskCommand, " ")
 
 		overrides := ecs.TaskOverride{
 			ContainerOverrides: []*ecs.ContainerOverride{
@@ -106,7 +137,7 @@ func (t TaskStep) Run(c Client, cfg Config) (taskArn string, err error) {
 		runTaskInput.SetOverrides(&overrides)
 	}
 
-	resp, err := clients.ECS.RunTask(&runTaskInput)
+	resp, err := clients.ECS.RunTaskWithContext(ctx, &runTaskInput)
 	if err != nil {
 		return taskArn, err
 	}
@@ -123,12 +154,16 @@ func (t TaskStep) Run(c Client, cfg Config) (taskArn string, err error) {
 		Cluster: aws.String(cfg.Options.ClusterName),
 		Tasks:   aws.StringSlice([]string{taskArn}),
 	}
-	err = clients.ECS.WaitUntilTasksStopped(&describeTasksInput)
+	err = clients.ECS.WaitUntilTasksStoppedWithContext(ctx, &describeTasksInput, wait.merge(tasksStoppedWait).waiterOptions()...)
 	if err != nil {
+		if ctx.Err() != nil && task.StopOnInterrupt {
+			t.stopTask(clients, cfg, taskArn)
+		}
+
 		return taskArn, err
 	}
 
-	describeTasksOutput, err := clients.ECS.DescribeTasks(&describeTasksInput)
+	describeTasksOutput, err := clients.ECS.DescribeTasksWithContext(ctx, &describeTasksInput)
 	if err != nil {
 		return taskArn, err
 	}
@@ -142,11 +177,11 @@ func (t TaskStep) Run(c Client, cfg Config) (taskArn string, err error) {
 
 	for _, container := range taskResp.Containers {
 		if aws.Int64Value(container.ExitCode) != 0 {
-			if aws.StringValue(container.Reason) != "" {
-				return taskArn, fmt.Errorf("container %s failed: %s", aws.StringValue(container.Name), aws.StringValue(container.Reason))
+			return taskArn, ContainerError{
+				Container: aws.StringValue(container.Name),
+				ExitCode:  aws.Int64Value(container.ExitCode),
+				Reason:    aws.StringValue(container.Reason),
 			}
-
-			return taskArn, fmt.Errorf("container %s failed", aws.StringValue(container.Name))
 		}
 	}
 
@@ -154,17 +189,29 @@ func (t TaskStep) Run(c Client, cfg Config) (taskArn string, err error) {
 	taskID := t.taskIDfromARN(taskArn)
 
 	for _, container := range taskResp.Containers {
-		logStreamName := fmt.Sprintf("%s/%s/%s", taskName, aws.StringValue(container.Name), taskID)
-		_, err := t.waitForLogStream(clients, cfg, logStreamName)
+		// Logs can only be shown for containers that send them to
+		// CloudWatch Logs
+		logging := definition.containerLogging(aws.StringValue(container.Name))
+		if logging.driver() != ecs.LogDriverAwslogs {
+			continue
+		}
+
+		options := logging.awslogsOptions(cfg, taskName, cfg.Options.LogGroupName)
+		logGroupName := options["awslogs-group"]
+
+		logStreamName := fmt.Sprintf("%s/%s/%s", options["awslogs-stream-prefix"], aws.StringValue(container.Name), taskID)
+		// Step and task wait options are for the task, so the log stream
+		// uses its own
+		_, err := t.waitForLogStream(ctx, clients, logGroupName, logStreamName, WaitOptions{})
 		if err != nil {
 			return taskArn, err
 		}
 
 		getLogEventsInput := cloudwatchlogs.GetLogEventsInput{
-			LogGroupName:  aws.String(cfg.Options.LogGroupName),
+			LogGroupName:  aws.String(logGroupName),
 			LogStreamName: aws.String(logStreamName),
 		}
-		events, err := clients.CloudWatchLogs.GetLogEvents(&getLogEventsInput)
+		events, err := clients.CloudWatchLogs.GetLogEventsWithContext(ctx, &getLogEventsInput)
 		if err != nil {
 			return taskArn, err
 		}
@@ -187,6 +234,27 @@ func (t TaskStep) Run(c Client, cfg Config) (taskArn string, err error) {
 	return taskArn, err
 }
 
+// stopTask stops a task that we are no longer waiting for. The pipeline
+// context has already been cancelled at this point, so we use a fresh one
+func (t TaskStep) stopTask(c Clients, cfg Config, taskArn string) {
+	Log.Warnf("Stopping task %s", taskArn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := c.ECS.StopTaskWithContext(ctx, &ecs.StopTaskInput{
+		Cluster: aws.String(cfg.Options.ClusterName),
+		Reason:  aws.String("Stopped by flecs after interrupt"),
+		Task:    aws.String(taskArn),
+	})
+	if err != nil {
+		Log.Errorf("Failed to stop task %s: %s", taskArn, err)
+		return
+	}
+
+	Log.Infof("Stopped task %s", taskArn)
+}
+
 func (t TaskStep) checkFailures(failures []*ecs.Failure) (err error) {
 	if len(failures) > 0 {
 		formattedFailures := ""
@@ -206,24 +274,27 @@ func (t TaskStep) taskIDfromARN(taskArn string) (taskID string) {
 	return taskID
 }
 
-func (t TaskStep) waitForLogStream(c Clients, cfg Config, logStreamName string) (logStream cloudwatchlogs.LogStream, err error) {
-	for count := 0; count < 30; count++ {
-		resp, err := c.CloudWatchLogs.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
-			LogGroupName:        aws.String(cfg.Options.LogGroupName),
+func (t TaskStep) waitForLogStream(ctx context.Context, c Clients, logGroupName, logStreamName string, wait WaitOptions) (logStream cloudwatchlogs.LogStream, err error) {
+	err = wait.merge(logStreamWait).poll(ctx, func() (bool, error) {
+		resp, err := c.CloudWatchLogs.DescribeLogStreamsWithContext(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
+			LogGroupName:        aws.String(logGroupName),
 			LogStreamNamePrefix: aws.String(logStreamName),
 		})
 		if err != nil {
-			return logStream, err
+			return false, err
 		}
 
 		if len(resp.LogStreams) > 0 {
 			logStream = *resp.LogStreams[0]
-			return logStream, nil
+			return true, nil
 		}
 
 		Log.Infof("Waiting for log stream %s", logStreamName)
-		time.Sleep(5 * time.Second)
+		return false, nil
+	})
+	if err != nil {
+		return logStream, fmt.Errorf("failed waiting for log stream %s/%s: %s", logGroupName, logStreamName, err)
 	}
 
-	return logStream, fmt.Errorf("Timed out waiting for log stream: %s/%s", cfg.Options.LogGroupName, logStreamName)
+	return logStream, err
 }
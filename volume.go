@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// dockerVolumeScopes are the valid scopes for Docker volumes
+var dockerVolumeScopes = []string{ecs.ScopeTask, ecs.ScopeShared}
+
+// Volume is a task definition volume that containers can mount. It is a bind
+// mount unless one of efs, docker or fsx is set
+type Volume struct {
+	Name     string        `yaml:"name"`
+	HostPath string        `yaml:"host_path"`
+	EFS      *EFSVolume    `yaml:"efs"`
+	Docker   *DockerVolume `yaml:"docker"`
+	FSx      *FSxVolume    `yaml:"fsx"`
+}
+
+// EFSVolume mounts an Amazon EFS file system
+type EFSVolume struct {
+	FileSystemID          string `yaml:"file_system_id"`
+	RootDirectory         string `yaml:"root_directory"`
+	AccessPointID         string `yaml:"access_point_id"`
+	TransitEncryption     bool   `yaml:"transit_encryption"`
+	TransitEncryptionPort int64  `yaml:"transit_encryption_port"`
+
+	// IAM authorizes the mount with the task role
+	IAM bool `yaml:"iam"`
+}
+
+// DockerVolume is a volume managed by a Docker volume driver, which is only
+// supported on the EC2 launch type
+type DockerVolume struct {
+	Driver        string            `yaml:"driver"`
+	DriverOpts    map[string]string `yaml:"driver_opts"`
+	Labels        map[string]string `yaml:"labels"`
+	Scope         string            `yaml:"scope"`
+	Autoprovision bool              `yaml:"autoprovision"`
+}
+
+// FSxVolume mounts an Amazon FSx for Windows File Server file system
+type FSxVolume struct {
+	FileSystemID  string `yaml:"file_system_id"`
+	RootDirectory string `yaml:"root_directory"`
+
+	// CredentialsParameter is the ARN of the Secrets Manager secret or SSM
+	// parameter with the credentials of the Active Directory user
+	CredentialsParameter string `yaml:"credentials_parameter"`
+	Domain               string `yaml:"domain"`
+}
+
+// volumes returns all the volumes in the definition, including the bind
+// volume set with volume_name
+func (d Definition) volumes() (volumes []Volume) {
+	if d.VolumeName != "" {
+		volumes = append(volumes, Volume{Name: d.VolumeName})
+	}
+
+	return append(volumes, d.Volumes...)
+}
+
+// validateVolumes checks each volume, and that every mount point refers to
+// one of them
+func (d Definition) validateVolumes() (err error) {
+	names := make(map[string]bool)
+	for _, volume := range d.volumes() {
+		if volume.Name == "" {
+			return fmt.Errorf("must specify name for each volume")
+		}
+
+		if names[volume.Name] {
+			return fmt.Errorf("volume %s is defined more than once", volume.Name)
+		}
+		names[volume.Name] = true
+
+		err = volume.validate()
+		if err != nil {
+			return fmt.Errorf("volume %s: %s", volume.Name, err)
+		}
+	}
+
+	for _, container := range d.Containers {
+		for _, mount := range container.MountPoints {
+			if mount.ContainerPath == "" {
+				return fmt.Errorf("must specify container_path for each mount point in container %s", container.Name)
+			}
+
+			if !names[mount.SourceVolume] {
+				return fmt.Errorf("mount point %s in container %s refers to unknown volume %q", mount.ContainerPath, container.Name, mount.SourceVolume)
+			}
+		}
+	}
+
+	return err
+}
+
+// validate checks the volume configuration
+func (v Volume) validate() (err error) {
+	types := 0
+	for _, set := range []bool{v.HostPath != "", v.EFS != nil, v.Docker != nil, v.FSx != nil} {
+		if set {
+			types++
+		}
+	}
+
+	if types > 1 {
+		return fmt.Errorf("can only set one of host_path, efs, docker or fsx")
+	}
+
+	if efs := v.EFS; efs != nil {
+		if efs.FileSystemID == "" {
+			return fmt.Errorf("must specify efs file_system_id")
+		}
+
+		if efs.AccessPointID != "" && efs.RootDirectory != "" && efs.RootDirectory != "/" {
+			return fmt.Errorf("cannot set efs root_directory when using an access point")
+		}
+
+		if (efs.AccessPointID != "" || efs.IAM) && !efs.TransitEncryption {
+			return fmt.Errorf("efs transit_encryption must be enabled when using an access point or iam")
+		}
+
+		if efs.TransitEncryptionPort != 0 && !efs.TransitEncryption {
+			return fmt.Errorf("cannot set efs transit_encryption_port without transit_encryption")
+		}
+	}
+
+	if docker := v.Docker; docker != nil {
+		if docker.Scope != "" && !stringInSlice(docker.Scope, dockerVolumeScopes) {
+			return fmt.Errorf("invalid docker scope %s, must be task or shared", docker.Scope)
+		}
+
+		if docker.Autoprovision && docker.Scope != ecs.ScopeShared {
+			return fmt.Errorf("docker autoprovision can only be used with the shared scope")
+		}
+	}
+
+	if fsx := v.FSx; fsx != nil {
+		if fsx.FileSystemID == "" || fsx.RootDirectory == "" {
+			return fmt.Errorf("must specify fsx file_system_id and root_directory")
+		}
+
+		if fsx.CredentialsParameter == "" || fsx.Domain == "" {
+			return fmt.Errorf("must specify fsx credentials_parameter and domain")
+		}
+	}
+
+	return err
+}
+
+// ecsVolume returns the volume for the task definition
+func (v Volume) ecsVolume() *ecs.Volume {
+	volume := ecs.Volume{Name: aws.String(v.Name)}
+
+	if v.HostPath != "" {
+		volume.Host = &ecs.HostVolumeProperties{SourcePath: aws.String(v.HostPath)}
+	}
+
+	if efs := v.EFS; efs != nil {
+		config := ecs.EFSVolumeConfiguration{FileSystemId: aws.String(efs.FileSystemID)}
+
+		if efs.RootDirectory != "" {
+			config.SetRootDirectory(efs.RootDirectory)
+		}
+
+		if efs.TransitEncryption {
+			config.SetTransitEncryption(ecs.EFSTransitEncryptionEnabled)
+		}
+
+		if efs.TransitEncryptionPort != 0 {
+			config.SetTransitEncryptionPort(efs.TransitEncryptionPort)
+		}
+
+		if efs.AccessPointID != "" || efs.IAM {
+			config.AuthorizationConfig = &ecs.EFSAuthorizationConfig{}
+
+			if efs.AccessPointID != "" {
+				config.AuthorizationConfig.SetAccessPointId(efs.AccessPointID)
+			}
+
+			if efs.IAM {
+				config.AuthorizationConfig.SetIam(ecs.EFSAuthorizationConfigIAMEnabled)
+			}
+		}
+
+		volume.EfsVolumeConfiguration = &config
+	}
+
+	if docker := v.Docker; docker != nil {
+		config := ecs.DockerVolumeConfiguration{}
+
+		if docker.Driver != "" {
+			config.SetDriver(docker.Driver)
+		}
+
+		if len(docker.DriverOpts) > 0 {
+			config.SetDriverOpts(aws.StringMap(docker.DriverOpts))
+		}
+
+		if len(docker.Labels) > 0 {
+			config.SetLabels(aws.StringMap(docker.Labels))
+		}
+
+		if docker.Scope != "" {
+			config.SetScope(docker.Scope)
+		}
+
+		if docker.Autoprovision {
+			config.SetAutoprovision(true)
+		}
+
+		volume.DockerVolumeConfiguration = &config
+	}
+
+	if fsx := v.FSx; fsx != nil {
+		volume.FsxWindowsFileServerVolumeConfiguration = &ecs.FSxWindowsFileServerVolumeConfiguration{
+			FileSystemId:  aws.String(fsx.FileSystemID),
+			RootDirectory: aws.String(fsx.RootDirectory),
+			AuthorizationConfig: &ecs.FSxWindowsFileServerAuthorizationConfig{
+				CredentialsParameter: aws.String(fsx.CredentialsParameter),
+				Domain:               aws.String(fsx.Domain),
+			},
+		}
+	}
+
+	return &volume
+}
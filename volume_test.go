@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeValidate(t *testing.T) {
+	assert.Nil(t, Volume{Name: "data", HostPath: "/data"}.validate())
+	assert.Nil(t, Volume{Name: "media", EFS: &EFSVolume{FileSystemID: "fs-1", AccessPointID: "fsap-1", TransitEncryption: true, IAM: true}}.validate())
+	assert.Nil(t, Volume{Name: "cache", Docker: &DockerVolume{Driver: "local", Scope: "shared", Autoprovision: true}}.validate())
+
+	assert.NotNil(t, Volume{Name: "data", HostPath: "/data", EFS: &EFSVolume{FileSystemID: "fs-1"}}.validate())
+	assert.NotNil(t, Volume{Name: "media", EFS: &EFSVolume{}}.validate())
+	assert.NotNil(t, Volume{Name: "media", EFS: &EFSVolume{FileSystemID: "fs-1", IAM: true}}.validate())
+	assert.NotNil(t, Volume{Name: "media", EFS: &EFSVolume{FileSystemID: "fs-1", AccessPointID: "fsap-1", RootDirectory: "/media", TransitEncryption: true}}.validate())
+	assert.NotNil(t, Volume{Name: "cache", Docker: &DockerVolume{Scope: "global"}}.validate())
+	assert.NotNil(t, Volume{Name: "cache", Docker: &DockerVolume{Scope: "task", Autoprovision: true}}.validate())
+	assert.NotNil(t, Volume{Name: "share", FSx: &FSxVolume{FileSystemID: "fs-1", RootDirectory: "share"}}.validate())
+}
+
+func TestDefinitionValidateVolumes(t *testing.T) {
+	definition := Definition{
+		VolumeName: "errors",
+		Volumes:    []Volume{{Name: "media", EFS: &EFSVolume{FileSystemID: "fs-1"}}},
+		Containers: []Container{
+			{Name: "web", MountPoints: []MountPoint{
+				{ContainerPath: "/errors", SourceVolume: "errors"},
+				{ContainerPath: "/media", SourceVolume: "media"},
+			}},
+		},
+	}
+
+	assert.Nil(t, definition.validateVolumes())
+
+	definition.Containers[0].MountPoints[1].SourceVolume = "uploads"
+	assert.NotNil(t, definition.validateVolumes())
+
+	definition.Containers = nil
+	definition.Volumes = append(definition.Volumes, Volume{Name: "errors"})
+	assert.NotNil(t, definition.validateVolumes())
+}
+
+func TestVolumeECSVolume(t *testing.T) {
+	assert.Equal(t, &ecs.Volume{Name: aws.String("errors")}, Volume{Name: "errors"}.ecsVolume())
+
+	assert.Equal(t, &ecs.Volume{
+		Name: aws.String("media"),
+		EfsVolumeConfiguration: &ecs.EFSVolumeConfiguration{
+			FileSystemId:      aws.String("fs-1"),
+			TransitEncryption: aws.String("ENABLED"),
+			AuthorizationConfig: &ecs.EFSAuthorizationConfig{
+				AccessPointId: aws.String("fsap-1"),
+				Iam:           aws.String("ENABLED"),
+			},
+		},
+	}, Volume{Name: "media", EFS: &EFSVolume{FileSystemID: "fs-1", AccessPointID: "fsap-1", TransitEncryption: true, IAM: true}}.ecsVolume())
+
+	assert.Equal(t, &ecs.Volume{
+		Name: aws.String("cache"),
+		DockerVolumeConfiguration: &ecs.DockerVolumeConfiguration{
+			Driver:        aws.String("local"),
+			DriverOpts:    aws.StringMap(map[string]string{"type": "tmpfs"}),
+			Scope:         aws.String("shared"),
+			Autoprovision: aws.Bool(true),
+		},
+	}, Volume{Name: "cache", Docker: &DockerVolume{Driver: "local", DriverOpts: map[string]string{"type": "tmpfs"}, Scope: "shared", Autoprovision: true}}.ecsVolume())
+}
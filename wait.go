@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Default wait options for each of the things we wait for. These are used
+// for anything not set in configuration. CodeDeploy deployments wait longer
+// depending on how they are configured
+var (
+	clusterWait        = WaitOptions{Timeout: Duration(150 * time.Second), PollInterval: Duration(5 * time.Second)}
+	codeDeployWait     = WaitOptions{Timeout: Duration(30 * time.Minute), PollInterval: Duration(15 * time.Second)}
+	imageScanWait      = WaitOptions{Timeout: Duration(10 * time.Minute), PollInterval: Duration(10 * time.Second)}
+	logStreamWait      = WaitOptions{Timeout: Duration(150 * time.Second), PollInterval: Duration(5 * time.Second)}
+	serviceDeleteWait  = WaitOptions{Timeout: Duration(300 * time.Second), PollInterval: Duration(10 * time.Second)}
+	servicesStableWait = WaitOptions{Timeout: Duration(10 * time.Minute), PollInterval: Duration(15 * time.Second)}
+	tasksStoppedWait   = WaitOptions{Timeout: Duration(10 * time.Minute), PollInterval: Duration(6 * time.Second)}
+)
+
+// Duration allows configuring a time.Duration as a string such as "10m" or
+// "30s". Plain numbers are treated as seconds
+type Duration time.Duration
+
+// UnmarshalYAML parses a duration from the configuration
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var value string
+	err = unmarshal(&value)
+	if err != nil {
+		return err
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		*d = Duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+
+	*d = Duration(parsed)
+	return err
+}
+
+// WaitOptions configures how long flecs waits for something to finish, and
+// how often it checks
+type WaitOptions struct {
+	Timeout      Duration `yaml:"timeout"`
+	PollInterval Duration `yaml:"poll_interval"`
+}
+
+// merge returns the wait options, using values from defaults for anything
+// that has not been set
+func (w WaitOptions) merge(defaults WaitOptions) WaitOptions {
+	if w.Timeout == 0 {
+		w.Timeout = defaults.Timeout
+	}
+
+	if w.PollInterval == 0 {
+		w.PollInterval = defaults.PollInterval
+	}
+
+	return w
+}
+
+// attempts returns how many times to check before timing out
+func (w WaitOptions) attempts() int {
+	if w.PollInterval <= 0 {
+		return 1
+	}
+
+	attempts := int(w.Timeout / w.PollInterval)
+	if attempts < 1 {
+		return 1
+	}
+
+	return attempts
+}
+
+// waiterOptions returns the options to pass to the AWS SDK waiters
+func (w WaitOptions) waiterOptions() []request.WaiterOption {
+	return []request.WaiterOption{
+		request.WithWaiterDelay(request.ConstantWaiterDelay(time.Duration(w.PollInterval))),
+		request.WithWaiterMaxAttempts(w.attempts()),
+	}
+}
+
+// poll calls check until it returns true, sleeping for the poll interval
+// between each attempt. It returns an error if the timeout is reached
+func (w WaitOptions) poll(ctx context.Context, check func() (bool, error)) (err error) {
+	for count := 0; count < w.attempts(); count++ {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+
+		if done {
+			return nil
+		}
+
+		err = aws.SleepWithContext(ctx, time.Duration(w.PollInterval))
+		if err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("timed out after %s", time.Duration(w.Timeout))
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Step results that can be checked with steps.<name>.result. Any other
+// steps.<name>.<output> refers to an output of the step
+const (
+	stepResultFailure = "failure"
+	stepResultSkipped = "skipped"
+	stepResultSuccess = "success"
+)
+
+// whenContext contains everything a when expression can refer to. Branch
+// and changed files are only looked up if an expression uses them
+type whenContext struct {
+	Environment string
+	ProjectName string
+	Tag         string
+	Results     map[string]string
+	Outputs     map[string]Outputs
+
+	Branch  func() (string, error)
+	Changed func() ([]string, error)
+
+	branch       *string
+	changedFiles *[]string
+}
+
+// getBranch looks up the branch the first time it is needed
+func (w *whenContext) getBranch() (branch string, err error) {
+	if w.branch == nil {
+		if w.Branch != nil {
+			branch, err = w.Branch()
+			if err != nil {
+				return branch, err
+			}
+		}
+
+		w.branch = &branch
+	}
+
+	return *w.branch, err
+}
+
+// getChanged looks up the changed files the first time they are needed. A
+// nil result means that we don't know what has changed
+func (w *whenContext) getChanged() (files []string, err error) {
+	if w.changedFiles == nil {
+		if w.Changed != nil {
+			files, err = w.Changed()
+			if err != nil {
+				return files, err
+			}
+		}
+
+		w.changedFiles = &files
+	}
+
+	return *w.changedFiles, err
+}
+
+// whenNode is part of a parsed when expression. Every node evaluates to a
+// string, and conditions are true unless they are empty or "false"
+type whenNode interface {
+	eval(w *whenContext) (string, error)
+}
+
+type whenString string
+
+type whenVariable string
+
+type whenNot struct {
+	node whenNode
+}
+
+type whenBinary struct {
+	op          string
+	left, right whenNode
+}
+
+type whenCall struct {
+	name string
+	args []whenNode
+}
+
+// parseWhen parses a when expression, such as:
+//
+//	environment == "staging" && changed("db/**")
+func parseWhen(expression string) (node whenNode, err error) {
+	tokens, err := tokenizeWhen(expression)
+	if err != nil {
+		return node, err
+	}
+
+	p := whenParser{tokens: tokens}
+	node, err = p.parseOr()
+	if err != nil {
+		return node, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return node, fmt.Errorf("unexpected %q in when expression", p.tokens[p.pos])
+	}
+
+	return node, err
+}
+
+// evalWhen returns true if the expression is true
+func evalWhen(expression string, w *whenContext) (result bool, err error) {
+	if strings.TrimSpace(expression) == "" {
+		return true, err
+	}
+
+	node, err := parseWhen(expression)
+	if err != nil {
+		return result, err
+	}
+
+	value, err := node.eval(w)
+	if err != nil {
+		return result, err
+	}
+
+	return whenTruthy(value), err
+}
+
+func whenTruthy(value string) bool {
+	return value != "" && value != "false"
+}
+
+func whenBool(value bool) string {
+	if value {
+		return "true"
+	}
+
+	return "false"
+}
+
+func tokenizeWhen(expression string) (tokens []string, err error) {
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+
+			if end >= len(runes) {
+				return tokens, fmt.Errorf("unterminated string in when expression")
+			}
+
+			tokens = append(tokens, string(runes[i:end+1]))
+			i = end + 1
+
+		case strings.ContainsRune("(),", r):
+			tokens = append(tokens, string(r))
+			i++
+
+		case strings.ContainsRune("=!&|~", r):
+			if i+1 < len(runes) {
+				op := string(runes[i : i+2])
+				switch op {
+				case "==", "!=", "=~", "!~", "&&", "||":
+					tokens = append(tokens, op)
+					i += 2
+					continue
+				}
+			}
+
+			if r != '!' {
+				return tokens, fmt.Errorf("unexpected %q in when expression", string(r))
+			}
+
+			tokens = append(tokens, "!")
+			i++
+
+		case isWhenIdentifier(r):
+			end := i
+			for end < len(runes) && isWhenIdentifier(runes[end]) {
+				end++
+			}
+
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+
+		default:
+			return tokens, fmt.Errorf("unexpected %q in when expression", string(r))
+		}
+	}
+
+	return tokens, err
+}
+
+func isWhenIdentifier(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+type whenParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *whenParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *whenParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *whenParser) expect(token string) error {
+	if next := p.next(); next != token {
+		return fmt.Errorf("expected %q in when expression, found %q", token, next)
+	}
+
+	return nil
+}
+
+func (p *whenParser) parseOr() (node whenNode, err error) {
+	node, err = p.parseAnd()
+	if err != nil {
+		return node, err
+	}
+
+	for p.peek() == "||" {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return node, err
+		}
+
+		node = whenBinary{op: "||", left: node, right: right}
+	}
+
+	return node, err
+}
+
+func (p *whenParser) parseAnd() (node whenNode, err error) {
+	node, err = p.parseUnary()
+	if err != nil {
+		return node, err
+	}
+
+	for p.peek() == "&&" {
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return node, err
+		}
+
+		node = whenBinary{op: "&&", left: node, right: right}
+	}
+
+	return node, err
+}
+
+func (p *whenParser) parseUnary() (node whenNode, err error) {
+	if p.peek() == "!" {
+		p.next()
+
+		node, err = p.parseUnary()
+		return whenNot{node: node}, err
+	}
+
+	return p.parseComparison()
+}
+
+func (p *whenParser) parseComparison() (node whenNode, err error) {
+	node, err = p.parseOperand()
+	if err != nil {
+		return node, err
+	}
+
+	switch op := p.peek(); op {
+	case "==", "!=", "=~", "!~":
+		p.next()
+
+		right, err := p.parseOperand()
+		if err != nil {
+			return node, err
+		}
+
+		if op == "=~" || op == "!~" {
+			pattern, ok := right.(whenString)
+			if !ok {
+				return node, fmt.Errorf("%s must be followed by a string in when expression", op)
+			}
+
+			_, err = regexp.Compile(string(pattern))
+			if err != nil {
+				return node, err
+			}
+		}
+
+		node = whenBinary{op: op, left: node, right: right}
+	}
+
+	return node, err
+}
+
+func (p *whenParser) parseOperand() (node whenNode, err error) {
+	token := p.next()
+
+	switch {
+	case token == "":
+		return node, fmt.Errorf("unexpected end of when expression")
+
+	case token == "(":
+		node, err = p.parseOr()
+		if err != nil {
+			return node, err
+		}
+
+		return node, p.expect(")")
+
+	case strings.HasPrefix(token, "\"") || strings.HasPrefix(token, "'"):
+		return whenString(token[1 : len(token)-1]), err
+
+	case p.peek() == "(":
+		return p.parseCall(token)
+
+	case isWhenIdentifier([]rune(token)[0]):
+		err = validateWhenVariable(token)
+		return whenVariable(token), err
+	}
+
+	return node, fmt.Errorf("unexpected %q in when expression", token)
+}
+
+func (p *whenParser) parseCall(name string) (node whenNode, err error) {
+	if name != "changed" {
+		return node, fmt.Errorf("unknown function %s in when expression", name)
+	}
+
+	err = p.expect("(")
+	if err != nil {
+		return node, err
+	}
+
+	call := whenCall{name: name}
+	for p.peek() != ")" {
+		arg, err := p.parseOperand()
+		if err != nil {
+			return node, err
+		}
+
+		call.args = append(call.args, arg)
+
+		if p.peek() == "," {
+			p.next()
+		}
+	}
+	p.next()
+
+	if len(call.args) == 0 {
+		return node, fmt.Errorf("%s requires at least one path in when expression", name)
+	}
+
+	return call, err
+}
+
+func validateWhenVariable(name string) (err error) {
+	switch name {
+	case "environment", "tag", "branch", "project_name", "true", "false":
+		return nil
+	}
+
+	parts := strings.Split(name, ".")
+	switch {
+	case parts[0] == "env" && len(parts) == 2 && parts[1] != "":
+		return nil
+	case parts[0] == "steps" && len(parts) == 3 && parts[1] != "" && parts[2] != "":
+		return nil
+	}
+
+	return fmt.Errorf("unknown variable %s in when expression", name)
+}
+
+func (n whenString) eval(w *whenContext) (string, error) {
+	return string(n), nil
+}
+
+func (n whenVariable) eval(w *whenContext) (value string, err error) {
+	name := string(n)
+
+	switch name {
+	case "environment":
+		return w.Environment, err
+	case "tag":
+		return w.Tag, err
+	case "project_name":
+		return w.ProjectName, err
+	case "true", "false":
+		return name, err
+	case "branch":
+		return w.getBranch()
+	}
+
+	parts := strings.Split(name, ".")
+	if parts[0] == "env" {
+		return os.Getenv(parts[1]), err
+	}
+
+	if parts[2] == "result" {
+		return w.Results[parts[1]], err
+	}
+
+	return w.Outputs[parts[1]][parts[2]], err
+}
+
+func (n whenNot) eval(w *whenContext) (value string, err error) {
+	value, err = n.node.eval(w)
+	return whenBool(!whenTruthy(value)), err
+}
+
+func (n whenBinary) eval(w *whenContext) (value string, err error) {
+	left, err := n.left.eval(w)
+	if err != nil {
+		return value, err
+	}
+
+	// Avoid evaluating the right hand side if we don't need to, since
+	// looking up changed files can be slow
+	switch n.op {
+	case "&&":
+		if !whenTruthy(left) {
+			return whenBool(false), err
+		}
+	case "||":
+		if whenTruthy(left) {
+			return whenBool(true), err
+		}
+	}
+
+	right, err := n.right.eval(w)
+	if err != nil {
+		return value, err
+	}
+
+	switch n.op {
+	case "==":
+		return whenBool(left == right), err
+	case "!=":
+		return whenBool(left != right), err
+	case "=~":
+		return whenBool(regexp.MustCompile(right).MatchString(left)), err
+	case "!~":
+		return whenBool(!regexp.MustCompile(right).MatchString(left)), err
+	}
+
+	return whenBool(whenTruthy(right)), err
+}
+
+func (n whenCall) eval(w *whenContext) (value string, err error) {
+	files, err := w.getChanged()
+	if err != nil {
+		return value, err
+	}
+
+	// If we don't know what has changed, assume everything has
+	if files == nil {
+		return whenBool(true), err
+	}
+
+	for _, arg := range n.args {
+		pattern, err := arg.eval(w)
+		if err != nil {
+			return value, err
+		}
+
+		for _, file := range files {
+			if matchChangedPath(pattern, file) {
+				return whenBool(true), err
+			}
+		}
+	}
+
+	return whenBool(false), err
+}
+
+// matchChangedPath matches a file path against a pattern. Patterns ending
+// in "/" or "/**" match everything under a directory
+func matchChangedPath(pattern, file string) bool {
+	if strings.HasSuffix(pattern, "/**") || strings.HasSuffix(pattern, "/") {
+		dir := strings.TrimSuffix(strings.TrimSuffix(pattern, "**"), "/")
+		return file == dir || strings.HasPrefix(file, dir+"/")
+	}
+
+	if matched, _ := path.Match(pattern, file); matched {
+		return true
+	}
+
+	// Patterns without a directory match the file name anywhere
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(file))
+		return matched
+	}
+
+	return false
+}
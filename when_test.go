@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestEvalWhen(t *testing.T) {
+	os.Setenv("FLECS_TEST_WHEN", "yes")
+	defer os.Unsetenv("FLECS_TEST_WHEN")
+
+	w := &whenContext{
+		Environment: "staging",
+		ProjectName: "app",
+		Tag:         "v1.2.3",
+		Results: map[string]string{
+			"build": stepResultSuccess,
+		},
+		Outputs: map[string]Outputs{
+			"build": Outputs{"image_digest": "sha256:abc"},
+		},
+		Branch: func() (string, error) {
+			return "main", nil
+		},
+		Changed: func() ([]string, error) {
+			return []string{"db/migrate/001.sql", "README.md"}, nil
+		},
+	}
+
+	expressions := map[string]bool{
+		``:                               true,
+		`environment == "staging"`:       true,
+		`environment != 'staging'`:       false,
+		`!(environment == "production")`: true,
+		`tag =~ "^v[0-9]+"`:              true,
+		`tag !~ "^v"`:                    false,
+		`branch == "main" && project_name == "app"`:    true,
+		`branch == "develop" || env.FLECS_TEST_WHEN`:   true,
+		`env.FLECS_TEST_MISSING`:                       false,
+		`steps.build.result == "success"`:              true,
+		`steps.deploy.result == "success"`:             false,
+		`steps.build.image_digest == "sha256:abc"`:     true,
+		`changed("db/**")`:                             true,
+		`changed("src/", "*.go")`:                      false,
+		`changed("*.md")`:                              true,
+		`environment == "staging" && !changed("db/")`:  false,
+		`(environment == "production" || true) && tag`: true,
+	}
+
+	for expression, expected := range expressions {
+		result, err := evalWhen(expression, w)
+		assert.Nil(t, err, expression)
+		assert.Equal(t, expected, result, expression)
+	}
+}
+
+func TestEvalWhenUnknownChanges(t *testing.T) {
+	w := &whenContext{
+		Changed: func() ([]string, error) {
+			return nil, nil
+		},
+	}
+
+	result, err := evalWhen(`changed("db/")`, w)
+	assert.Nil(t, err)
+	assert.True(t, result)
+}
+
+func TestParseWhenErrors(t *testing.T) {
+	expressions := []string{
+		`environment ==`,
+		`environment = "staging"`,
+		`"unterminated`,
+		`region == "eu-west-1"`,
+		`steps.build`,
+		`deployed("db/")`,
+		`changed()`,
+		`tag =~ environment`,
+		`(environment == "staging"`,
+	}
+
+	for _, expression := range expressions {
+		_, err := parseWhen(expression)
+		assert.NotNil(t, err, expression)
+	}
+}